@@ -21,11 +21,21 @@ func New(bucketSize int) *T {
 	return bucket
 }
 
+//Direct contacts are preferred over relayed ones, which take a detour through the relay and depend on it.
+//A direct contact takes the place of a relayed one in a full bucket, the relayed one goes to the replacementCache.
 func (bucket *T) AddContact(c contact.T) {
 	element := bucket.getElement(bucket.list, c)
 	if element == nil {
+		relayed := bucket.lastRelayed(bucket.list)
 		if bucket.list.Len() < bucket.bucketSize {
 			bucket.list.PushFront(c)
+		} else if !c.Relayed && relayed != nil {
+			bucket.list.Remove(relayed)
+			bucket.replacementCache.PushFront(relayed.Value.(contact.T))
+			if bucket.replacementCache.Len() > bucket.bucketSize {
+				bucket.replacementCache.Remove(bucket.replacementCache.Back())
+			}
+			bucket.list.PushFront(c)
 		} else {
 			//The bucket is full, put the contact in the replacementCache
 			element = bucket.getElement(bucket.replacementCache, c)
@@ -38,10 +48,35 @@ func (bucket *T) AddContact(c contact.T) {
 			}
 		}
 	} else {
+		if old := element.Value.(contact.T); old.Relayed != c.Relayed {
+			//The node got a relay or doesn't need it anymore, its address has changed
+			c.RTT = old.RTT
+			element.Value = c
+		}
 		bucket.list.MoveToFront(element)
 	}
 }
 
+//Returns the least recently seen relayed contact in l, nil if there is none
+func (bucket *T) lastRelayed(l *list.List) *list.Element {
+	for e := l.Back(); e != nil; e = e.Prev() {
+		if e.Value.(contact.T).Relayed {
+			return e
+		}
+	}
+	return nil
+}
+
+//Returns the most recently seen direct contact in l, or the most recently seen contact if they are all relayed
+func (bucket *T) firstDirect(l *list.List) *list.Element {
+	for e := l.Front(); e != nil; e = e.Next() {
+		if !e.Value.(contact.T).Relayed {
+			return e
+		}
+	}
+	return l.Front()
+}
+
 //Remove the contact c from the bucket and replace it with the most recently seen from the replacement cache
 func (bucket *T) EvictAndReplace(c contact.T) {
 	element := bucket.getElement(bucket.list, c)
@@ -51,7 +86,7 @@ func (bucket *T) EvictAndReplace(c contact.T) {
 		} else {
 			//If there is at least one element in the cache and the bucket is full, evict and replace
 			bucket.list.Remove(element)
-			replacement := bucket.replacementCache.Front()
+			replacement := bucket.firstDirect(bucket.replacementCache)
 			if replacement != nil {
 				bucket.AddContact(replacement.Value.(contact.T))
 				bucket.replacementCache.Remove(replacement)
@@ -72,6 +107,30 @@ func (bucket *T) getElement(l *list.List, c contact.T) *list.Element {
 	return element
 }
 
+//Returns the contact with the given ID if it is in the bucket
+func (bucket *T) GetContact(id *kademliaid.T) (contact.T, bool) {
+	for e := bucket.list.Front(); e != nil; e = e.Next() {
+		c := e.Value.(contact.T)
+		if c.ID.Equals(id) {
+			return c, true
+		}
+	}
+	return contact.T{}, false
+}
+
+//Tells whether the contact with the given ID is in the bucket or its replacement cache
+func (bucket *T) Knows(id *kademliaid.T) bool {
+	if _, ok := bucket.GetContact(id); ok {
+		return true
+	}
+	for e := bucket.replacementCache.Front(); e != nil; e = e.Next() {
+		if e.Value.(contact.T).ID.Equals(id) {
+			return true
+		}
+	}
+	return false
+}
+
 func (bucket *T) GetContactAndCalcDistance(target *kademliaid.T) []contact.T {
 	var contacts []contact.T
 
@@ -0,0 +1,57 @@
+package clock
+
+import (
+	"time"
+)
+
+//A T tells the time and runs functions later. Nodes use Real, the simulator a Virtual clock.
+type T interface {
+	Now() time.Time
+	//Calls f in its own goroutine once d has passed, like time.AfterFunc
+	AfterFunc(d time.Duration, f func()) Timer
+	//Returns a timer that sends the time on its channel once d has passed, like time.NewTimer
+	NewTimer(d time.Duration) Timer
+}
+
+//A Timer made by a T, like a time.Timer
+type Timer interface {
+	//The channel of a timer made by NewTimer, nil for one made by AfterFunc
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+//The system clock
+var Real T = realClock{}
+
+//Returns the time elapsed since t on c
+func Since(c T, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+//Returns a channel that receives the time once d has passed on c, like time.After
+func After(c T, d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+type realClock struct{}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
@@ -0,0 +1,79 @@
+package clock
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVirtual(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewVirtual(start)
+	var order []int
+	var mux sync.Mutex
+	record := func(i int) func() {
+		return func() {
+			mux.Lock()
+			order = append(order, i)
+			mux.Unlock()
+		}
+	}
+	c.AfterFunc(3*time.Second, record(3))
+	c.AfterFunc(time.Second, record(1))
+	stopped := c.AfterFunc(2*time.Second, record(2))
+	if !stopped.Stop() {
+		t.Error("Stop of a pending timer returned false")
+	}
+	reset := c.AfterFunc(time.Hour, record(4))
+	reset.Reset(4 * time.Second)
+	timer := c.NewTimer(5 * time.Second)
+
+	c.RunUntil(start.Add(4*time.Second), 0)
+	mux.Lock()
+	if len(order) != 3 || order[0] != 1 || order[1] != 3 || order[2] != 4 {
+		t.Error("Timers fired in the wrong order:", order)
+	}
+	mux.Unlock()
+	if now := c.Now(); !now.Equal(start.Add(4 * time.Second)) {
+		t.Error("The clock is at", now)
+	}
+	select {
+	case <-timer.C():
+		t.Error("The timer fired early")
+	default:
+	}
+	c.RunUntil(start.Add(time.Minute), 0)
+	select {
+	case now := <-timer.C():
+		if !now.Equal(start.Add(5 * time.Second)) {
+			t.Error("The timer fired at", now)
+		}
+	default:
+		t.Error("The timer didn't fire")
+	}
+	if _, ok := c.Next(); ok {
+		t.Error("A timer is still set")
+	}
+}
+
+func TestVirtualWaits(t *testing.T) {
+	// a goroutine woken by one timer sets the next, the clock has to wait for it
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewVirtual(start)
+	done := make(chan time.Time, 1)
+	go func() {
+		for i := 0; i < 10; i++ {
+			<-c.NewTimer(time.Second).C()
+		}
+		done <- c.Now()
+	}()
+	c.RunUntil(start.Add(time.Minute), 0)
+	select {
+	case now := <-done:
+		if !now.Equal(start.Add(10 * time.Second)) {
+			t.Error("Ten sleeps of a second ended at", now)
+		}
+	default:
+		t.Error("The goroutine didn't get through its timers")
+	}
+}
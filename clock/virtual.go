@@ -0,0 +1,237 @@
+package clock
+
+import (
+	"bytes"
+	"container/heap"
+	"runtime"
+	"sync"
+	"time"
+)
+
+//A clock that only moves when it is told to, for simulations. Timers fire in the order of their deadlines,
+//timers with the same deadline in the order they were set.
+//The functions of AfterFunc still run in their own goroutines, so that they can wait for other timers.
+//Settle waits for those goroutines before the clock moves on, the time doesn't pass while they run.
+//It waits for every goroutine of the process, so only one simulation should run at a time.
+type Virtual struct {
+	now time.Time
+	timers timerHeap
+	// orders timers with the same deadline
+	seq uint64
+	mux sync.Mutex
+	// the stack traces Settle reads the states of the goroutines from, kept for the next Settle
+	stacks []byte
+	settling sync.Mutex
+}
+
+type virtualTimer struct {
+	clock *Virtual
+	deadline time.Time
+	seq uint64
+	// the function of an AfterFunc timer, nil for NewTimer
+	f func()
+	c chan time.Time
+	// position in the heap, -1 if the timer is not set
+	index int
+}
+
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+func (v *Virtual) Now() time.Time {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	return v.now
+}
+
+func (v *Virtual) AfterFunc(d time.Duration, f func()) Timer {
+	t := &virtualTimer{clock: v, f: f, index: -1}
+	t.Reset(d)
+	return t
+}
+
+func (v *Virtual) NewTimer(d time.Duration) Timer {
+	t := &virtualTimer{clock: v, c: make(chan time.Time, 1), index: -1}
+	t.Reset(d)
+	return t
+}
+
+func (t *virtualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *virtualTimer) Stop() bool {
+	v := t.clock
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&v.timers, t.index)
+	return true
+}
+
+func (t *virtualTimer) Reset(d time.Duration) bool {
+	v := t.clock
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	active := t.index >= 0
+	if active {
+		heap.Remove(&v.timers, t.index)
+	}
+	if d < 0 {
+		d = 0
+	}
+	t.deadline = v.now.Add(d)
+	t.seq = v.seq
+	v.seq++
+	heap.Push(&v.timers, t)
+	return active
+}
+
+//Next returns the deadline of the next timer, false if no timer is set
+func (v *Virtual) Next() (time.Time, bool) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if len(v.timers) == 0 {
+		return time.Time{}, false
+	}
+	return v.timers[0].deadline, true
+}
+
+//Fire moves the clock to the deadline of the next timer and fires the timers that are due up to resolution later,
+//one after another in their order, settling in between so that they take effect in the same order every time.
+//Returns false if no timer is set. Call Settle before the next Fire so that the woken goroutines see the right time.
+func (v *Virtual) Fire(resolution time.Duration) bool {
+	v.mux.Lock()
+	if len(v.timers) == 0 {
+		v.mux.Unlock()
+		return false
+	}
+	if v.timers[0].deadline.After(v.now) {
+		v.now = v.timers[0].deadline
+	}
+	end := v.now.Add(resolution)
+	now := v.now
+	v.mux.Unlock()
+
+	for first := true; ; first = false {
+		v.mux.Lock()
+		if len(v.timers) == 0 || v.timers[0].deadline.After(end) {
+			v.mux.Unlock()
+			return true
+		}
+		t := heap.Pop(&v.timers).(*virtualTimer)
+		v.mux.Unlock()
+		if !first {
+			v.Settle()
+		}
+		if t.f != nil {
+			go t.f()
+		} else {
+			select {
+			case t.c <- now:
+			default:
+			}
+		}
+	}
+}
+
+//Settle waits until every other goroutine is blocked, on a timer, a channel, a lock or a datagram. Only the clock
+//can wake them then, as long as none of them waits for real time or I/O, so the time doesn't pass while they run.
+func (v *Virtual) Settle() {
+	v.settling.Lock()
+	defer v.settling.Unlock()
+	for {
+		// let the goroutines that were just woken run before looking at all of them
+		runtime.Gosched()
+		if v.othersBlocked() {
+			return
+		}
+	}
+}
+
+// othersBlocked tells whether none of the goroutines but the caller is running or about to, from the states in the
+// headers of their stack traces, e.g. "goroutine 7 [chan receive]:". Running, runnable, in a system call or assisting
+// the garbage collector is busy.
+func (v *Virtual) othersBlocked() bool {
+	if v.stacks == nil {
+		v.stacks = make([]byte, 64*1024)
+	}
+	n := runtime.Stack(v.stacks, true)
+	for n == len(v.stacks) {
+		v.stacks = make([]byte, 2*len(v.stacks))
+		n = runtime.Stack(v.stacks, true)
+	}
+	// the caller's trace comes first
+	stacks := v.stacks[:n]
+	header := []byte("\ngoroutine ")
+	for {
+		i := bytes.Index(stacks, header)
+		if i < 0 {
+			return true
+		}
+		stacks = stacks[i+len(header):]
+		from := bytes.IndexByte(stacks, '[')
+		if from < 0 {
+			return true
+		}
+		state := stacks[from+1:]
+		if bytes.HasPrefix(state, []byte("run")) || bytes.HasPrefix(state, []byte("syscall")) || bytes.HasPrefix(state, []byte("GC assist")) {
+			return false
+		}
+	}
+}
+
+//RunUntil fires the timers up to end, settling after each, and leaves the clock at end
+func (v *Virtual) RunUntil(end time.Time, resolution time.Duration) {
+	v.Settle()
+	for {
+		next, ok := v.Next()
+		if !ok || next.After(end) {
+			break
+		}
+		v.Fire(resolution)
+		v.Settle()
+	}
+	v.mux.Lock()
+	if end.After(v.now) {
+		v.now = end
+	}
+	v.mux.Unlock()
+}
+
+type timerHeap []*virtualTimer
+
+func (h timerHeap) Len() int {
+	return len(h)
+}
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].deadline.Equal(h[j].deadline) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].deadline.Before(h[j].deadline)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*virtualTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
@@ -2,20 +2,30 @@ package cmd
 
 import (
 	"encoding/binary"
+	"fmt"
+	"net/http"
 	"os"
+	"strconv"
 	"github.com/spf13/cobra"
 	"github.com/vmihailenco/msgpack"
 	"github.com/mjolnir92/kdfs/restmsg"
 )
 
+var catQuorum int
+
 var catCmd = &cobra.Command{
   Use:   "cat",
   Short: "Read data with a specific ID and send to standard output",
-  Long: `Read data with the given ID and send it to standard output. Unlike its namesake, it has nothing to do with concatenating files.`,
+  Long: `Read data with the given ID and send it to standard output. Unlike its namesake, it has nothing to do with concatenating files.
+With --quorum the data is read from that many replicas, and if they disagree on whether it is pinned,
+the newest version and how many replicas have another one are shown on standard error.`,
 	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// TODO: get host and port from some config
 		url := "http://" + server + "/v1/store/" + args[0]
+		if catQuorum > 1 {
+			url += "?quorum=" + strconv.Itoa(catQuorum)
+		}
 		b, err := get(url)
 		if err != nil {
 			return err
@@ -25,6 +35,12 @@ var catCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		if res.Status != http.StatusOK {
+			return fmt.Errorf("%v", res.Message)
+		}
+		if res.Versions > 1 {
+			fmt.Fprintf(os.Stderr, "%v. The newest is from %v, pinned: %v\n", res.Message, res.Timestamp, res.Pin)
+		}
 		err = binary.Write(os.Stdout, binary.LittleEndian, res.File)
 		if err != nil {
 			return err
@@ -34,5 +50,6 @@ var catCmd = &cobra.Command{
 }
 
 func init() {
+	catCmd.Flags().IntVarP(&catQuorum, "quorum", "q", 1, "replicas to read from, the newest version they have is returned")
 	RootCmd.AddCommand(catCmd)
 }
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"os"
+	"text/tabwriter"
+	"github.com/spf13/cobra"
+	"github.com/vmihailenco/msgpack"
+	"github.com/mjolnir92/kdfs/restmsg"
+)
+
+var debugLookupNode bool
+var debugLookupJSON bool
+
+var debugCmd = &cobra.Command{
+  Use:   "debug",
+  Short: "Look into what the server does",
+  Long: `Commands that show what the server does, to find out why something goes wrong.`,
+  Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+  },
+}
+
+var debugLookupCmd = &cobra.Command{
+  Use:   "lookup",
+  Short: "Look up an ID and show every query of the lookup",
+  Long: `Has the server look up the data with the given ID, or the closest nodes to it with --node, and shows every node
+that was queried in the order they answered: the round it was queried in, its distance to the ID as the number of
+significant bits, the time it took to answer and how many contacts it returned, or why it failed.
+--json shows everything, including the contacts that were returned and the RTTs in nanoseconds.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		url := "http://" + server + "/v1/debug/lookup/" + args[0]
+		if debugLookupNode {
+			url += "?type=node"
+		}
+		b, err := get(url)
+		if err != nil {
+			return err
+		}
+		var res restmsg.LookupTraceResponse
+		err = msgpack.Unmarshal(b, &res)
+		if err != nil {
+			return err
+		}
+		if debugLookupJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(res)
+		}
+		printTrace(&res)
+		return nil
+  },
+}
+
+// printTrace prints the queries of a lookup as a table
+func printTrace(res *restmsg.LookupTraceResponse) {
+	switch {
+	case res.Error != "":
+		fmt.Printf("Lookup of %v failed after %v queries: %v\n", res.Target, len(res.Steps), res.Error)
+	case res.Type == "value":
+		fmt.Printf("Lookup of %v found the value after %v queries\n", res.Target, len(res.Steps))
+	default:
+		fmt.Printf("Lookup of %v finished after %v queries\n", res.Target, len(res.Steps))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROUND\tPATH\tID\tADDRESS\tDISTANCE\tRTT\tRETURNED\tRESULT")
+	for _, s := range res.Steps {
+		result := "ok"
+		if s.Error != "" {
+			result = s.Error
+		} else if s.Found {
+			result = "found the value"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", s.Round, s.Path, s.Contact.ID, s.Contact.Address, distanceBits(s.Distance), s.RTT, len(s.Contacts), result)
+	}
+	w.Flush()
+}
+
+// distanceBits returns the number of significant bits of a distance in hex, 0 for the target itself
+func distanceBits(distance string) int {
+	b, err := hex.DecodeString(distance)
+	if err != nil {
+		return -1
+	}
+	for i, d := range b {
+		if d != 0 {
+			return (len(b)-i-1)*8 + bits.Len8(d)
+		}
+	}
+	return 0
+}
+
+func init() {
+	debugLookupCmd.Flags().BoolVar(&debugLookupNode, "node", false, "look up the closest nodes to the ID instead of data")
+	debugLookupCmd.Flags().BoolVar(&debugLookupJSON, "json", false, "show the trace as JSON")
+	debugCmd.AddCommand(debugLookupCmd)
+	RootCmd.AddCommand(debugCmd)
+}
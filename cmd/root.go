@@ -6,10 +6,17 @@ import (
 	"bytes"
 	"io/ioutil"
 	"fmt"
+	"time"
 	"github.com/vmihailenco/msgpack"
 )
 
 var server string
+//Requests to the server are given up after this, the server stops their lookups then. 0 waits forever.
+var timeout time.Duration
+
+func client() *http.Client {
+	return &http.Client{Timeout: timeout}
+}
 
 var RootCmd = &cobra.Command{
   Use:   "kdfs",
@@ -22,6 +29,7 @@ var RootCmd = &cobra.Command{
 
 func init() {
 	RootCmd.PersistentFlags().StringVarP(&server, "server", "s", "localhost:8080", "internet socket for the server")
+	RootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "give up on the server after this long, 0 waits forever")
 }
 func Execute() {
 	RootCmd.Execute()
@@ -33,7 +41,7 @@ func postMsgPack(url string, req interface{}) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	res, err := http.Post(url, "application/msgpack", bytes.NewBuffer(body))
+	res, err := client().Post(url, "application/msgpack", bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +58,7 @@ func postMsgPack(url string, req interface{}) ([]byte, error) {
 
 func postNoBody(url string) ([]byte, error) {
 	var body []byte
-	res, err := http.Post(url, "text/plain", bytes.NewBuffer(body))
+	res, err := client().Post(url, "text/plain", bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
@@ -66,7 +74,7 @@ func postNoBody(url string) ([]byte, error) {
 }
 
 func get(url string) ([]byte, error) {
-	res, err := http.Get(url)
+	res, err := client().Get(url)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"github.com/spf13/cobra"
+	"github.com/mjolnir92/kdfs/simulator"
+)
+
+var simulateConfig = simulator.DefaultConfig()
+var simulateVerbose bool
+
+var simulateCmd = &cobra.Command{
+  Use:   "simulate",
+  Short: "Simulate a network of nodes",
+  Long: `Runs nodes on a simulated network and a virtual clock, with churn and a workload of stores and lookups,
+and reports how the lookups went and how many values survived. Runs with the same seed go the same way.
+Doesn't need a server.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if simulateConfig.Nodes < 1 {
+			return fmt.Errorf("Need at least one node")
+		}
+		if !simulateVerbose {
+			log.SetOutput(ioutil.Discard)
+		}
+		report := simulator.New(simulateConfig).Run()
+		fmt.Print(report.String())
+		return nil
+  },
+}
+
+func init() {
+	f := simulateCmd.Flags()
+	f.IntVar(&simulateConfig.Nodes, "nodes", simulateConfig.Nodes, "nodes in the network")
+	f.DurationVar(&simulateConfig.JoinInterval, "join-interval", simulateConfig.JoinInterval, "time between the joins of the nodes before the workload starts")
+	f.DurationVar(&simulateConfig.Duration, "duration", simulateConfig.Duration, "simulated time the workload and churn run for")
+	f.Float64Var(&simulateConfig.Churn, "churn", simulateConfig.Churn, "fraction of the nodes replaced per hour")
+	f.Float64Var(&simulateConfig.Stores, "stores", simulateConfig.Stores, "values stored per hour")
+	f.Float64Var(&simulateConfig.Lookups, "lookups", simulateConfig.Lookups, "lookups per hour")
+	f.IntVar(&simulateConfig.ValueSize, "value-size", simulateConfig.ValueSize, "bytes of a stored value")
+	f.Float64Var(&simulateConfig.DropRate, "drop", simulateConfig.DropRate, "probability that a datagram is lost")
+	f.DurationVar(&simulateConfig.MinLatency, "min-latency", simulateConfig.MinLatency, "smallest one way latency between two nodes")
+	f.DurationVar(&simulateConfig.MaxLatency, "max-latency", simulateConfig.MaxLatency, "largest one way latency between two nodes")
+	f.DurationVar(&simulateConfig.Jitter, "jitter", simulateConfig.Jitter, "largest jitter added to a datagram")
+	f.DurationVar(&simulateConfig.Resolution, "resolution", simulateConfig.Resolution, "timers due within this of each other fire at the same time")
+	f.Float64Var(&simulateConfig.Liars, "liars", simulateConfig.Liars, "fraction of the nodes that answer lookups with lies")
+	f.IntVar(&simulateConfig.Paths, "paths", simulateConfig.Paths, "disjoint paths of the lookups, 0 for the default")
+	f.Int64Var(&simulateConfig.Seed, "seed", simulateConfig.Seed, "seed of the simulation")
+	f.BoolVarP(&simulateVerbose, "verbose", "v", false, "show the log of the nodes")
+	RootCmd.AddCommand(simulateCmd)
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"github.com/spf13/cobra"
+	"github.com/vmihailenco/msgpack"
+	"github.com/mjolnir92/kdfs/restmsg"
+)
+
+var statsCmd = &cobra.Command{
+  Use:   "stats",
+  Short: "Show how many requests the server has dropped",
+  Long: `Shows how many requests from other nodes the server has dropped because of its rate limits.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		url := "http://" + server + "/v1/stats"
+		b, err := get(url)
+		if err != nil {
+			return err
+		}
+		var res restmsg.StatsResponse
+		err = msgpack.Unmarshal(b, &res)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Dropped, too many from one source: %v\n", res.DroppedSource)
+		fmt.Printf("Dropped, too many concurrent stores: %v\n", res.DroppedStore)
+		types := make([]string, 0, len(res.DroppedType))
+		for t := range res.DroppedType {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			fmt.Printf("Dropped, too many %v: %v\n", t, res.DroppedType[t])
+		}
+		return nil
+  },
+}
+
+func init() {
+	RootCmd.AddCommand(statsCmd)
+}
@@ -2,6 +2,9 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"errors"
+	"net/http"
 	"io/ioutil"
 	"github.com/spf13/cobra"
 	"github.com/mjolnir92/kdfs/restmsg"
@@ -11,7 +14,7 @@ import (
 var storeCmd = &cobra.Command{
   Use:   "store",
   Short: "Store the file in the network",
-  Long: `Stores the data in the given file in the network. The ID of the file is returned.`,
+  Long: `Stores the data in the given file in the network. The ID of the file is returned, the number of nodes that confirmed storing it is printed to standard error.`,
 	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		content, err := ioutil.ReadFile(args[0])
@@ -30,7 +33,12 @@ var storeCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		if res.Status != http.StatusOK {
+			return errors.New(res.Message)
+		}
 		fmt.Println(res.ID)
+		// the ID alone goes to stdout so that it can be used in scripts
+		fmt.Fprintf(os.Stderr, "Stored on %v nodes\n", res.Replicas)
 		return nil
   },
 }
@@ -7,15 +7,95 @@ import (
 const (
 	ALPHA = 3
 	K = 20
+	// Addresses a contact may have, one per family is usual
+	MAX_ADDRS = 8
+	// Disjoint paths of a lookup, more resist lying nodes better
+	LOOKUP_PATHS = 1
 
+	// Timeout for nodes we have no round trip time estimate for yet
 	TIMEOUT = 500 * time.Millisecond
+	// Bounds for timeouts derived from the round trip time
+	MIN_TIMEOUT = 100 * time.Millisecond
+	MAX_TIMEOUT = 5 * time.Second
+	// Times an RPC is sent again, with the timeout doubled each time, before the node is considered dead
+	RETRIES = 2
+
+	// Messages larger than FRAGMENT_SIZE are split into fragments of at most FRAGMENT_SIZE bytes
+	FRAGMENT_SIZE = 1200
+	MAX_DATAGRAM_SIZE = 65507
+	READ_BUFFER_SIZE = 4 * 1024 * 1024
+	// Largest message that will be reassembled from fragments
+	MAX_MESSAGE_SIZE = 64 * 1024 * 1024
+	// Time without new fragments before the missing ones are requested again
+	FRAGMENT_TIMEOUT = 100 * time.Millisecond
+	FRAGMENT_RETRIES = 5
+	// Keeps a FRAGMENT_NACK within a single datagram
+	MAX_NACK_FRAGMENTS = 200
+	// How long sent fragments are kept around for retransmission
+	TRANSFER_TIMEOUT = 10 * time.Second
+	// Bytes of the responses that are kept for TRANSFER_TIMEOUT, to answer requests that are sent again
+	RESPONSE_CACHE_SIZE = 16 * 1024 * 1024
+	// Messages that are not responses to our requests reassembled at the same time, from one IP address and in total
+	MAX_SOURCE_REASSEMBLIES = 16
+	MAX_REASSEMBLIES = 256
+
+	// Smaller messages and values are not compressed, it wouldn't save much
+	COMPRESS_MIN_SIZE = 256
+	// Larger messages are not compressed, nor decompressed
+	MAX_DECOMPRESSED_SIZE = 4 * 1024 * 1024
+	// Snappy makes at most 64 bytes out of 3, a compressed message that claims to grow more is not decompressed
+	MAX_COMPRESSION_RATIO = 22
+
+	// Bytes of data a node is willing to store for others
+	STORE_QUOTA = 1024 * 1024 * 1024
+	// Bytes of data a node keeps in its cache of values found by lookups, apart from STORE_QUOTA
+	CACHE_QUOTA = 256 * 1024 * 1024
+
+	// Requests per second and burst a node accepts from one IP address
+	SOURCE_RATE = 200
+	SOURCE_BURST = 400
+	// Requests per second and burst a node accepts of each RPC type, from all sources together
+	TYPE_RATE = 2000
+	TYPE_BURST = 4000
+	// STOREs that are handled at the same time, more are dropped
+	MAX_CONCURRENT_STORES = 16
+	// The secret STORE tokens are made with changes this often, a token is accepted for up to twice as long
+	TOKEN_ROTATION = 5 * time.Minute
+
+	// Closest nodes asked for the address they see us on
+	REACHABILITY_PEERS = 3
+	// Time to wait for the ping of a dial back
+	PROBE_TIMEOUT = 5 * time.Second
+	REACHABILITY_CHECK = time.Hour
+	// Peers whose votes for the address they see us on are kept, and for how long
+	MAX_OBSERVERS = 64
+	OBSERVATION_TTL = 2 * REACHABILITY_CHECK
+
+	// Nodes a relay relays for at most
+	MAX_RELAYED_NODES = 64
+	// A relayed node registers again this often, well within the time NAT keeps a UDP mapping
+	RELAY_REFRESH = 25 * time.Second
+	// A relay forgets a node that hasn't registered for this long
+	RELAY_TTL = 2 * time.Minute
+	// A relay passes responses to a request back for this long after it passed the request on
+	RELAYED_REQUEST_TTL = 30 * time.Second
+
+	// Time a node gets to finish its lookups and RPCs when it is shut down
+	SHUTDOWN_TIMEOUT = 10 * time.Second
 
 	PUBLISH_TIME = 24 * time.Hour
 	REPUBLISH_TIME = time.Hour
 	EXPIRE_TIME = 24 * time.Hour
 	BUCKET_REFRESH = time.Hour
+	// A cached value expires after CACHE_EXPIRE_TIME halved for every node the caching node knows
+	// that is closer to the key, but not before MIN_CACHE_EXPIRE_TIME
+	CACHE_EXPIRE_TIME = EXPIRE_TIME
+	MIN_CACHE_EXPIRE_TIME = time.Minute
 
 	PUBLISH = "PUBLISH"
 	REPUBLISH = "REPUBLISH"
 	EXPIRE = "EXPIRE"
+	CACHE_EXPIRE = "CACHE_EXPIRE"
+	REACHABILITY = "REACHABILITY"
+	RELAY = "RELAY"
 )
@@ -0,0 +1,107 @@
+package contact
+
+import (
+	"errors"
+	"net/netip"
+	"encoding/binary"
+	"github.com/vmihailenco/msgpack"
+	"github.com/mjolnir92/kdfs/constants"
+)
+
+//A contact with more than MAX_ADDRS addresses is not decoded
+var ErrTooManyAddrs = errors.New("Contact has too many addresses")
+
+//The IP addresses and ports a node listens on, at most one per family is usual.
+//They are encoded compactly in RPCs, see AppendAddr.
+type Addrs []netip.AddrPort
+
+//Appends the compact encoding of a to b: the 4 or 16 byte IP followed by the port in big endian
+func AppendAddr(b []byte, a netip.AddrPort) []byte {
+	ip := a.Addr().Unmap().AsSlice()
+	b = append(b, ip...)
+	return binary.BigEndian.AppendUint16(b, a.Port())
+}
+
+//Decodes an address encoded by AppendAddr
+func DecodeAddr(b []byte) (netip.AddrPort, error) {
+	if len(b) != 4+2 && len(b) != 16+2 {
+		return netip.AddrPort{}, errors.New("Address has the wrong length")
+	}
+	ip, _ := netip.AddrFromSlice(b[:len(b)-2])
+	return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(b[len(b)-2:])), nil
+}
+
+//Parses an IP:port address, false if address is something else, e.g. a host name
+func ParseAddr(address string) (netip.AddrPort, bool) {
+	a, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(a.Addr().Unmap(), a.Port()), true
+}
+
+//Tells whether a is one of the addresses
+func (addrs Addrs) Contains(a netip.AddrPort) bool {
+	for _, addr := range addrs {
+		if addr == a {
+			return true
+		}
+	}
+	return false
+}
+
+//Tells whether there is an address of the same family as a, IPv4 or IPv6
+func (addrs Addrs) HasFamily(a netip.AddrPort) bool {
+	for _, addr := range addrs {
+		if addr.Addr().Is4() == a.Addr().Is4() {
+			return true
+		}
+	}
+	return false
+}
+
+//Encodes the addresses as an array of binary strings, see AppendAddr
+func (addrs Addrs) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if addrs == nil {
+		return enc.EncodeNil()
+	}
+	err := enc.EncodeArrayLen(len(addrs))
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		err = enc.EncodeBytes(AppendAddr(nil, a))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (addrs *Addrs) DecodeMsgpack(dec *msgpack.Decoder) error {
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		*addrs = nil
+		return nil
+	}
+	// the length comes from the wire, it may be anything
+	if n > constants.MAX_ADDRS {
+		return ErrTooManyAddrs
+	}
+	*addrs = make(Addrs, 0, n)
+	for i := 0; i < n; i++ {
+		b, err := dec.DecodeBytes()
+		if err != nil {
+			return err
+		}
+		a, err := DecodeAddr(b)
+		if err != nil {
+			return err
+		}
+		*addrs = append(*addrs, a)
+	}
+	return nil
+}
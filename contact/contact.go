@@ -3,16 +3,40 @@ package contact
 import (
 	"fmt"
 	"github.com/mjolnir92/kdfs/kademliaid"
+	"github.com/mjolnir92/kdfs/rtt"
 )
 
 type T struct {
 	ID       *kademliaid.T
 	Address  string
+	//All addresses of the node, e.g. an IPv4 and an IPv6 one. Empty if Address is not an IP and a port.
+	Addrs    Addrs
+	//The node is not reachable directly, Address and Addrs are those of a relay that passes RPCs on to it
+	Relayed  bool
+	//Ed25519 public key of the node, the ID is derived from it. Nil if the node has no identity.
+	PublicKey []byte
+	//Solution of the dynamic crypto puzzle for ID, see kademliaid.Puzzle
+	Nonce kademliaid.T
+	//Round trip time estimate, shared by all copies of the contact in the routing table. It is not sent to other nodes.
+	RTT      *rtt.T `msgpack:"-"`
 	distance *kademliaid.T
 }
 
 func New(id *kademliaid.T, address string) T {
-	return T{id, address, nil}
+	c := T{ID: id, Address: address}
+	if a, ok := ParseAddr(address); ok {
+		c.Addrs = Addrs{a}
+	}
+	return c
+}
+
+//Creates a contact for a node with several addresses, the first one is also used as Address
+func NewWithAddrs(id *kademliaid.T, addrs Addrs) T {
+	c := T{ID: id, Addrs: addrs}
+	if len(addrs) > 0 {
+		c.Address = addrs[0].String()
+	}
+	return c
 }
 
 func (contact *T) CalcDistance(target *kademliaid.T) {
@@ -0,0 +1,70 @@
+package contact
+
+import (
+	"net/netip"
+	"testing"
+	"github.com/mjolnir92/kdfs/constants"
+	"github.com/mjolnir92/kdfs/kademliaid"
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestAddr(t *testing.T) {
+	for _, s := range []string{"10.0.0.1:1200", "[2001:db8::1]:65535"} {
+		a := netip.MustParseAddrPort(s)
+		b := AppendAddr(nil, a)
+		if len(b) != len(a.Addr().AsSlice())+2 {
+			t.Errorf("%v was encoded in %v bytes", s, len(b))
+		}
+		got, err := DecodeAddr(b)
+		if err != nil || got != a {
+			t.Errorf("Expected %v, got %v %v", a, got, err)
+		}
+	}
+	// IPv4 addresses mapped to IPv6 are sent as IPv4
+	mapped, ok := ParseAddr("[::ffff:10.0.0.1]:1200")
+	if !ok || !mapped.Addr().Is4() || len(AppendAddr(nil, mapped)) != 6 {
+		t.Error("The mapped address was not unmapped:", mapped)
+	}
+	if _, ok := ParseAddr("localhost:1200"); ok {
+		t.Error("A host name is not an IP address")
+	}
+	if _, err := DecodeAddr([]byte{1, 2, 3}); err == nil {
+		t.Error("An address of the wrong length was decoded")
+	}
+}
+
+func TestMsgpackAddrs(t *testing.T) {
+	c := NewWithAddrs(kademliaid.NewRandom(), Addrs{netip.MustParseAddrPort("10.0.0.1:1200"), netip.MustParseAddrPort("[2001:db8::1]:1200")})
+	b, err := msgpack.Marshal(c)
+	if err != nil {
+		t.Fatal("Marshal failed:", err)
+	}
+	var got T
+	err = msgpack.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatal("Unmarshal failed:", err)
+	}
+	if got.Address != "10.0.0.1:1200" || len(got.Addrs) != 2 || got.Addrs[0] != c.Addrs[0] || got.Addrs[1] != c.Addrs[1] {
+		t.Errorf("Expected %v %v, got %v %v", c.Address, c.Addrs, got.Address, got.Addrs)
+	}
+	// contacts from nodes that don't send addresses still decode
+	b, _ = msgpack.Marshal(map[string]interface{}{"ID": c.ID, "Address": "localhost:1200"})
+	got = T{}
+	if err := msgpack.Unmarshal(b, &got); err != nil || got.Address != "localhost:1200" || got.Addrs != nil {
+		t.Error("Contact without addresses was not decoded:", got, err)
+	}
+}
+
+func TestMsgpackAddrsLength(t *testing.T) {
+	// an array of 2^31-1 addresses in 5 bytes must not be allocated
+	var addrs Addrs
+	err := msgpack.Unmarshal([]byte{0xdd, 0x7f, 0xff, 0xff, 0xff}, &addrs)
+	if err != ErrTooManyAddrs {
+		t.Error("Expected ErrTooManyAddrs for a huge array, got", err)
+	}
+	many := make(Addrs, constants.MAX_ADDRS+1)
+	b, _ := msgpack.Marshal(many)
+	if err := msgpack.Unmarshal(b, &addrs); err != ErrTooManyAddrs {
+		t.Error("Expected ErrTooManyAddrs for more than MAX_ADDRS addresses, got", err)
+	}
+}
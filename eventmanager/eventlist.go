@@ -3,21 +3,28 @@ package eventmanager
 import (
 	"sync"
 	"time"
+	"github.com/mjolnir92/kdfs/clock"
 )
 
 type eventList struct {
-	List map[Event]*time.Timer
+	List map[Event]clock.Timer
+	closed bool
 	mux sync.Mutex
 }
 
 func newEventList() *eventList {
 	eventList := &eventList{}
-	eventList.List = make(map[Event]*time.Timer)
+	eventList.List = make(map[Event]clock.Timer)
 	return eventList
 }
 
-func (l *eventList) insertEvent(e Event, t *time.Timer, d time.Duration) {
+func (l *eventList) insertEvent(e Event, t clock.Timer, d time.Duration) {
 	l.mux.Lock()
+	if l.closed {
+		t.Stop()
+		l.mux.Unlock()
+		return
+	}
 	//If the event already exists, stop and delete the old event and insert the new.
 	if val, ok := l.List[e]; ok {
 		val.Stop()
@@ -45,4 +52,15 @@ func (l *eventList) resetTimer(e Event, d time.Duration) {
 		val.Reset(d)
 	}
 	l.mux.Unlock()
-}
\ No newline at end of file
+}
+
+//Stop all timers and refuse new events
+func (l *eventList) close() {
+	l.mux.Lock()
+	l.closed = true
+	for e, val := range l.List {
+		val.Stop()
+		delete(l.List, e)
+	}
+	l.mux.Unlock()
+}
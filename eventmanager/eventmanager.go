@@ -2,15 +2,22 @@ package eventmanager
 
 import (
 	"time"
+	"github.com/mjolnir92/kdfs/clock"
 	"github.com/mjolnir92/kdfs/kademliaid"
 )
 
 type T struct {
 	list *eventList
+	clock clock.T
 }
 
 func New() *T {
-	return &T{list : newEventList()}
+	return NewWithClock(clock.Real)
+}
+
+//Creates an event manager whose timers run on c, e.g. a virtual clock in a simulation
+func NewWithClock(c clock.T) *T {
+	return &T{list : newEventList(), clock: c}
 }
 
 //Creates a new event that periodically calls the callback function f.
@@ -24,7 +31,7 @@ func (t *T) InsertEvent(id kademliaid.T, eventType interface{}, f func() , d tim
 		//Reset the timer so that the event will periodically run. Should there be an option for non-periodic events?
 		t.list.resetTimer(event, d)
 	}
-	timer := time.AfterFunc(d, eventFunc)
+	timer := t.clock.AfterFunc(d, eventFunc)
 	t.list.insertEvent(event, timer, d)
 }
 
@@ -36,4 +43,10 @@ func (t *T) DeleteEvent(id kademliaid.T, eventType interface{}) {
 func (t *T) ResetEvent(id kademliaid.T, eventType interface{}, d time.Duration) {
 	event := NewEvent(id, eventType)
 	t.list.resetTimer(event, d)
-}
\ No newline at end of file
+}
+
+//Stops all events, for when the node shuts down. Events inserted afterwards never run.
+//A callback that is already running is not waited for.
+func (t *T) Close() {
+	t.list.close()
+}
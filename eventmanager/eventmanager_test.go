@@ -1,6 +1,7 @@
 package eventmanager
 
 import (
+	"sync"
 	"testing"
 	"time"
 	"github.com/mjolnir92/kdfs/kademliaid"
@@ -22,4 +23,25 @@ func TestEventManager(t *testing.T) {
 	if count != 3 {
 		t.Error("TestEventmanager failed, the event was not deleted")
 	}
-}
\ No newline at end of file
+}
+
+func TestClose(t *testing.T) {
+	manager := New()
+	id := kademliaid.NewHash([]byte("event"))
+	var mux sync.Mutex
+	count := 0
+	f := func() {
+		mux.Lock()
+		count = count + 1
+		mux.Unlock()
+	}
+	manager.InsertEvent(*id, "EVENT", f, 10*time.Millisecond)
+	manager.Close()
+	manager.InsertEvent(*id, "OTHER", f, 10*time.Millisecond)
+	time.Sleep(35*time.Millisecond)
+	mux.Lock()
+	defer mux.Unlock()
+	if count != 0 {
+		t.Error("TestClose failed, an event ran after Close")
+	}
+}
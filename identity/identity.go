@@ -0,0 +1,111 @@
+package identity
+
+import (
+	"os"
+	"errors"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/ed25519"
+	"encoding/pem"
+	"github.com/mjolnir92/kdfs/kademliaid"
+)
+
+//The Ed25519 keypair of a node. The node ID is derived from the public key,
+//so other nodes can check that a node owns its ID by verifying its signatures.
+type T struct {
+	private ed25519.PrivateKey
+}
+
+//Generates a new keypair
+func New() (*T, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &T{private}, nil
+}
+
+//Generates keypairs until one gives an ID that solves the static puzzle. Takes about 2^puzzle.Static tries.
+func NewWithPuzzle(puzzle kademliaid.Puzzle) (*T, error) {
+	for {
+		id, err := New()
+		if err != nil {
+			return nil, err
+		}
+		if puzzle.CheckStatic(id.ID()) {
+			return id, nil
+		}
+	}
+}
+
+//Reads a keypair saved with Save
+func Load(path string) (*T, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("No private key in " + path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("The key in " + path + " is not an Ed25519 key")
+	}
+	return &T{private}, nil
+}
+
+//Loads the keypair at path, or generates one that solves the static puzzle and saves it there if the file doesn't exist
+func LoadOrCreate(path string, puzzle kademliaid.Puzzle) (*T, error) {
+	id, err := Load(path)
+	if err == nil && !puzzle.CheckStatic(id.ID()) {
+		return nil, errors.New("The key in " + path + " doesn't solve the static puzzle")
+	}
+	if !os.IsNotExist(err) {
+		return id, err
+	}
+	id, err = NewWithPuzzle(puzzle)
+	if err != nil {
+		return nil, err
+	}
+	err = id.Save(path)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+//Saves the private key as PEM encoded PKCS #8, readable only by the owner
+func (id *T) Save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.private)
+	if err != nil {
+		return err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return os.WriteFile(path, b, 0600)
+}
+
+func (id *T) PublicKey() ed25519.PublicKey {
+	return id.private.Public().(ed25519.PublicKey)
+}
+
+//The kademlia ID that belongs to the keypair
+func (id *T) ID() *kademliaid.T {
+	return kademliaid.NewFromPublicKey(id.PublicKey())
+}
+
+func (id *T) Sign(message []byte) []byte {
+	return ed25519.Sign(id.private, message)
+}
+
+//Checks that signature is a signature of message by the owner of publicKey
+func Verify(publicKey []byte, message []byte, signature []byte) bool {
+	if len(publicKey) != ed25519.PublicKeySize || len(signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(publicKey, message, signature)
+}
@@ -0,0 +1,54 @@
+package identity
+
+import (
+	"testing"
+	"path/filepath"
+	"github.com/mjolnir92/kdfs/kademliaid"
+)
+
+func TestIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+	id, err := LoadOrCreate(path, kademliaid.Puzzle{})
+	if err != nil {
+		t.Fatal("TestIdentity failed, could not create the key:", err)
+	}
+	if *id.ID() != *kademliaid.NewFromPublicKey(id.PublicKey()) {
+		t.Error("TestIdentity failed, the ID is not derived from the public key")
+	}
+	loaded, err := LoadOrCreate(path, kademliaid.Puzzle{})
+	if err != nil {
+		t.Fatal("TestIdentity failed, could not load the key:", err)
+	}
+	if *loaded.ID() != *id.ID() {
+		t.Error("TestIdentity failed, the loaded key is not the one that was saved")
+	}
+	message := []byte("ping")
+	signature := id.Sign(message)
+	if !Verify(loaded.PublicKey(), message, signature) {
+		t.Error("TestIdentity failed, a valid signature was rejected")
+	}
+	if Verify(loaded.PublicKey(), []byte("pong"), signature) {
+		t.Error("TestIdentity failed, the signature of another message was accepted")
+	}
+	other, _ := New()
+	if Verify(other.PublicKey(), message, signature) {
+		t.Error("TestIdentity failed, a signature by another key was accepted")
+	}
+}
+
+func TestPuzzle(t *testing.T) {
+	puzzle := kademliaid.Puzzle{Static: 6}
+	id, err := NewWithPuzzle(puzzle)
+	if err != nil {
+		t.Fatal("TestPuzzle failed:", err)
+	}
+	if !puzzle.CheckStatic(id.ID()) {
+		t.Error("TestPuzzle failed, the ID doesn't solve the puzzle")
+	}
+	path := filepath.Join(t.TempDir(), "node.key")
+	id.Save(path)
+	_, err = LoadOrCreate(path, kademliaid.Puzzle{Static: 40})
+	if err == nil {
+		t.Error("TestPuzzle failed, a key that doesn't solve the puzzle was loaded")
+	}
+}
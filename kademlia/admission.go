@@ -0,0 +1,121 @@
+package kademlia
+
+import (
+	"net"
+	"sync"
+	"github.com/mjolnir92/kdfs/ratelimit"
+)
+
+//Limits on the requests a node handles. A rate of 0 turns that limit off.
+type Limits struct {
+	//Requests per second and burst accepted from one IP address
+	SourceRate float64
+	SourceBurst int
+	//Requests per second and burst accepted of each RPC type, from all sources together
+	TypeRate float64
+	TypeBurst int
+	//STOREs handled at the same time, 0 for no limit
+	MaxStores int
+}
+
+//Counters of the requests a node has dropped
+type Stats struct {
+	//Dropped because their source sent too many requests
+	DroppedSource uint64
+	//Dropped because too many requests of their type arrived, by type
+	DroppedType map[string]uint64
+	//STOREs dropped because MaxStores were already being handled
+	DroppedStore uint64
+}
+
+var rpcNames = map[int]string{PING: "PING", FIND_NODE: "FIND_NODE", FIND_VALUE: "FIND_VALUE", STORE: "STORE", FRAGMENT: "FRAGMENT", DIAL_BACK: "DIAL_BACK", RELAY: "RELAY", RELAY_REGISTER: "RELAY_REGISTER"}
+
+// Decides which requests are handled. Responses are never limited, they answer our own requests.
+type admission struct {
+	sources *ratelimit.T
+	types *ratelimit.T
+	// a slot is taken while a STORE is handled, nil if there is no limit
+	stores chan struct{}
+	stats Stats
+	mux sync.Mutex
+}
+
+func newAdmission(limits Limits) *admission {
+	a := &admission{sources: ratelimit.New(limits.SourceRate, limits.SourceBurst), types: ratelimit.New(limits.TypeRate, limits.TypeBurst)}
+	a.stats.DroppedType = make(map[string]uint64)
+	if limits.MaxStores > 0 {
+		a.stores = make(chan struct{}, limits.MaxStores)
+	}
+	return a
+}
+
+// source returns the host requests from raddr are counted for
+func source(raddr string) string {
+	host, _, err := net.SplitHostPort(raddr)
+	if err != nil {
+		// not an IP address and a port, e.g. an in-memory transport
+		return raddr
+	}
+	return host
+}
+
+// admit tells whether a request of rpcType from raddr is handled. The first fragment of a message
+// that isn't a response to us counts as a request of type FRAGMENT.
+func (a *admission) admit(rpcType int, raddr string) bool {
+	if !a.admitSource(raddr) {
+		return false
+	}
+	if !a.types.Allow(rpcNames[rpcType]) {
+		a.mux.Lock()
+		a.stats.DroppedType[rpcNames[rpcType]]++
+		a.mux.Unlock()
+		return false
+	}
+	return true
+}
+
+// admitSource tells whether raddr may send another message, for messages whose type is not known yet
+func (a *admission) admitSource(raddr string) bool {
+	if !a.sources.Allow(source(raddr)) {
+		a.mux.Lock()
+		a.stats.DroppedSource++
+		a.mux.Unlock()
+		return false
+	}
+	return true
+}
+
+// acquireStore takes a slot for handling a STORE, returns false if they are all taken
+func (a *admission) acquireStore() bool {
+	if a.stores == nil {
+		return true
+	}
+	select {
+	case a.stores <- struct{}{}:
+		return true
+	default:
+		a.mux.Lock()
+		a.stats.DroppedStore++
+		a.mux.Unlock()
+		return false
+	}
+}
+
+func (a *admission) releaseStore() {
+	if a.stores != nil {
+		<-a.stores
+	}
+}
+
+//Returns the counters of dropped requests
+func (nw *T) Stats() Stats {
+	a := nw.admission
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	stats := a.stats
+	stats.DroppedType = make(map[string]uint64)
+	for k, v := range a.stats.DroppedType {
+		stats.DroppedType[k] = v
+	}
+	return stats
+}
@@ -0,0 +1,52 @@
+package kademlia
+
+import (
+	"github.com/vmihailenco/msgpack"
+)
+
+// A Codec turns the RPC structs into bytes and back.
+// Requests are sent with the codec in Options.Codec, responses with the codec the request arrived in.
+type Codec interface {
+	Marshal(msg interface{}) ([]byte, error)
+	// msg has to be a pointer to one of the RPC structs or an RPCHeader
+	Unmarshal(b []byte, msg interface{}) error
+	Name() string
+}
+
+var (
+	MsgPack Codec = msgpackCodec{}
+	Protobuf Codec = protobufCodec{}
+)
+
+// Returns the codec with the given name, or nil if there is none
+func CodecByName(name string) Codec {
+	for _, c := range []Codec{MsgPack, Protobuf} {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// detectCodec tells the codecs apart by the first byte of the message.
+// msgpack encodes the structs as maps, which never start with the tag of protobuf field 1 (0x08).
+func detectCodec(b []byte) Codec {
+	if len(b) > 0 && b[0] == protobufFirstByte {
+		return Protobuf
+	}
+	return MsgPack
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(msg interface{}) ([]byte, error) {
+	return msgpack.Marshal(msg)
+}
+
+func (msgpackCodec) Unmarshal(b []byte, msg interface{}) error {
+	return msgpack.Unmarshal(b, msg)
+}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
@@ -0,0 +1,51 @@
+package kademlia
+
+import (
+	"errors"
+	"github.com/golang/snappy"
+	"github.com/mjolnir92/kdfs/kademliaid"
+	"github.com/mjolnir92/kdfs/constants"
+)
+
+// A compressed message is frameEscape, frameCompressed and the snappy compressed (signed) message.
+// Messages are compressed before they are encrypted, encrypted data doesn't compress.
+
+// compress compresses b for the node with ID to if it announced CAP_SNAPPY and b gets smaller
+func (nw *T) compress(to *kademliaid.T, b []byte) []byte {
+	if !nw.options.Compression || to == nil || len(b) < constants.COMPRESS_MIN_SIZE || len(b) > constants.MAX_DECOMPRESSED_SIZE {
+		return b
+	}
+	capabilities, ok := nw.routingtable.GetCapabilities(to)
+	if !ok || capabilities&CAP_SNAPPY == 0 {
+		return b
+	}
+	compressed := make([]byte, 2, 2+snappy.MaxEncodedLen(len(b)))
+	compressed[0] = frameEscape
+	compressed[1] = frameCompressed
+	compressed = compressed[:2+len(snappy.Encode(compressed[2:cap(compressed)], b))]
+	if len(compressed) >= len(b) {
+		return b
+	}
+	return compressed
+}
+
+// compressed tells whether b is a compressed frame
+func compressed(b []byte) bool {
+	return len(b) >= 2 && b[0] == frameEscape && b[1] == frameCompressed
+}
+
+// decompress returns the message in a compressed frame. Other messages are returned as they are.
+func decompress(b []byte) ([]byte, error) {
+	if !compressed(b) {
+		return b, nil
+	}
+	n, err := snappy.DecodedLen(b[2:])
+	if err != nil {
+		return nil, err
+	}
+	// the decoded length is allocated up front, whatever the frame claims
+	if n > constants.MAX_DECOMPRESSED_SIZE || n > (len(b)-2)*constants.MAX_COMPRESSION_RATIO {
+		return nil, errors.New("Compressed message is too large")
+	}
+	return snappy.Decode(nil, b[2:])
+}
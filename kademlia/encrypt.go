@@ -0,0 +1,223 @@
+package kademlia
+
+import (
+	"log"
+	"sync"
+	"bytes"
+	"errors"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/ecdh"
+	"crypto/cipher"
+	"crypto/sha256"
+	"github.com/mjolnir92/kdfs/kademliaid"
+	"github.com/mjolnir92/kdfs/contact"
+)
+
+// Nodes with an identity encrypt their RPCs. Each node has an X25519 key that it announces in its signed PINGs
+// and PING_RESPONSEs, so the key can't be swapped by someone in between. Both ends of a pair of nodes derive
+// the same AES-GCM key from their X25519 keys. The key pair is made when the node starts, old traffic can't be
+// decrypted once it has been shut down.
+// An encrypted message is frameEscape, frameEncrypted, the X25519 key of the sender, the nonce and then the
+// encrypted signed RPC. PING, PING_RESPONSE and ERROR are not encrypted, they are used to exchange the keys.
+const (
+	encryptionKeySize = 32
+	encryptedHeaderSize = 2 + encryptionKeySize + 12
+)
+
+type sessions struct {
+	private *ecdh.PrivateKey
+	// keys announced by other nodes in their pings, by node ID
+	peers map[kademliaid.T][]byte
+	// ciphers by the key of the other node
+	aeads map[string]cipher.AEAD
+	mux sync.Mutex
+}
+
+func newSessions() (*sessions, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &sessions{private: private, peers: make(map[kademliaid.T][]byte), aeads: make(map[string]cipher.AEAD)}, nil
+}
+
+func (s *sessions) publicKey() []byte {
+	return s.private.PublicKey().Bytes()
+}
+
+// setPeer remembers the key a node announced in a verified ping
+func (s *sessions) setPeer(id *kademliaid.T, key []byte) {
+	if len(key) != encryptionKeySize {
+		return
+	}
+	a, err := s.newAEAD(key)
+	if err != nil {
+		log.Printf("Can't use the encryption key of %v: %v\n", id, err)
+		return
+	}
+	s.mux.Lock()
+	if old, ok := s.peers[*id]; ok {
+		delete(s.aeads, string(old))
+	}
+	s.peers[*id] = key
+	s.aeads[string(key)] = a
+	s.mux.Unlock()
+}
+
+// peer returns the key of a node, nil if we haven't exchanged pings with it
+func (s *sessions) peer(id *kademliaid.T) []byte {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.peers[*id]
+}
+
+// dropPeer forgets the key of a node, the keys are exchanged again before the next RPC to it
+func (s *sessions) dropPeer(id *kademliaid.T) {
+	s.mux.Lock()
+	key, ok := s.peers[*id]
+	delete(s.peers, *id)
+	if ok {
+		delete(s.aeads, string(key))
+	}
+	s.mux.Unlock()
+}
+
+// aead returns the cipher shared with the owner of key. Only keys announced in pings have one,
+// so that messages with made up keys are dropped without any work.
+func (s *sessions) aead(key []byte) (cipher.AEAD, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	a, ok := s.aeads[string(key)]
+	return a, ok
+}
+
+func (s *sessions) newAEAD(key []byte) (cipher.AEAD, error) {
+	public, err := ecdh.X25519().NewPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := s.private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	// hash the secret together with both keys, in the same order on both ends
+	own := s.publicKey()
+	h := sha256.New()
+	h.Write(secret)
+	if bytes.Compare(own, key) < 0 {
+		h.Write(own)
+		h.Write(key)
+	} else {
+		h.Write(key)
+		h.Write(own)
+	}
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts b for the node with the given ID. b is returned as it is if we have no key for the node.
+func (nw *T) seal(to *kademliaid.T, b []byte) ([]byte, error) {
+	if nw.encryption == nil || to == nil {
+		return b, nil
+	}
+	a, ok := nw.encryption.aead(nw.encryption.peer(to))
+	if !ok {
+		return b, nil
+	}
+	sealed := make([]byte, encryptedHeaderSize, encryptedHeaderSize+len(b)+a.Overhead())
+	sealed[0] = frameEscape
+	sealed[1] = frameEncrypted
+	copy(sealed[2:], nw.encryption.publicKey())
+	nonce := sealed[2+encryptionKeySize:encryptedHeaderSize]
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	// the header is authenticated too
+	return a.Seal(sealed, nonce, b, sealed), nil
+}
+
+// open decrypts an encrypted message and returns it with the key of the sender.
+// Other messages are returned as they are, with a nil key.
+func (nw *T) open(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 || b[0] != frameEscape || b[1] != frameEncrypted {
+		return b, nil, nil
+	}
+	if nw.encryption == nil {
+		return nil, nil, errors.New("Encrypted message but we have no key")
+	}
+	if len(b) < encryptedHeaderSize {
+		return nil, nil, errors.New("Encrypted message is too short")
+	}
+	key := b[2:2+encryptionKeySize]
+	a, ok := nw.encryption.aead(key)
+	if !ok {
+		return nil, nil, errors.New("Encrypted with an unknown key")
+	}
+	plain, err := a.Open(nil, b[2+encryptionKeySize:encryptedHeaderSize], b[encryptedHeaderSize:], b[:encryptedHeaderSize])
+	if err != nil {
+		return nil, nil, err
+	}
+	return plain, key, nil
+}
+
+// checkEncryption makes sure that an RPC was encrypted with the key its sender announced,
+// and that nodes that have exchanged keys with us don't send anything but pings in the clear.
+func (nw *T) checkEncryption(header *RPCHeader, key []byte) error {
+	if nw.encryption == nil {
+		return nil
+	}
+	known := nw.encryption.peer(header.Sender.ID)
+	if key != nil {
+		if !bytes.Equal(key, known) {
+			return errors.New("RPC is encrypted with a key the sender didn't announce")
+		}
+		return nil
+	}
+	switch header.RPCType {
+	// a RELAY is read by the relay, the RPC inside is encrypted
+	case PING, PING_RESPONSE, ERROR, RELAY:
+		return nil
+	}
+	if known != nil {
+		return errors.New("RPC is not encrypted")
+	}
+	return nil
+}
+
+// capabilities returns the capabilities this node announces in pings
+func (nw *T) capabilities() uint64 {
+	capabilities := uint64(CAPABILITIES)
+	if nw.encryption != nil {
+		capabilities |= CAP_ENCRYPTION
+	}
+	if nw.options.Relay {
+		capabilities |= CAP_RELAY
+	}
+	if !nw.options.Compression {
+		capabilities &^= CAP_SNAPPY
+	}
+	return capabilities
+}
+
+// encryptionKey returns the X25519 key that is announced in pings, nil if the node doesn't encrypt
+func (nw *T) encryptionKey() []byte {
+	if nw.encryption == nil {
+		return nil
+	}
+	return nw.encryption.publicKey()
+}
+
+// needsKeyExchange is true if c has to be pinged before other RPCs are sent to it, so that they can be encrypted
+func (nw *T) needsKeyExchange(c *contact.T) bool {
+	if nw.encryption == nil || nw.encryption.peer(c.ID) != nil {
+		return false
+	}
+	capabilities, ok := nw.routingtable.GetCapabilities(c.ID)
+	// nodes without an identity don't encrypt
+	return !ok || capabilities&CAP_ENCRYPTION != 0
+}
@@ -0,0 +1,147 @@
+package kademlia
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+	"github.com/mjolnir92/kdfs/constants"
+	"github.com/mjolnir92/kdfs/contact"
+	"github.com/mjolnir92/kdfs/kademliaid"
+	"github.com/mjolnir92/kdfs/transport"
+)
+
+//Faults injected into the datagrams a node sends and receives, to test how lookups and republishing
+//cope with a bad network. The zero value injects none.
+type Faults struct {
+	//Probability that a datagram is lost, applied both when it is sent and when it is received
+	DropRate float64
+	//Probability that a datagram is sent twice
+	DuplicateRate float64
+	//Sent datagrams are delayed by Delay plus a uniformly distributed part of Jitter, which reorders them
+	Delay time.Duration
+	Jitter time.Duration
+	//Sets of nodes that can only talk to the nodes in the same set. Nodes that are in no set are not affected.
+	Partitions [][]kademliaid.T
+	//Answer FIND_NODE and FIND_VALUE with made up contacts closer to the target than any real node and never
+	//with a value, like a node that attacks lookups. The contacts have the address of this node.
+	Lie bool
+	//Seed of the random decisions, so that a run can be repeated. 0 seeds with the time.
+	Seed int64
+}
+
+// The faults a node injects, they can be changed while it runs
+type faults struct {
+	config Faults
+	// the index of the set in config.Partitions, by node ID
+	partition map[kademliaid.T]int
+	rand *rand.Rand
+	mux sync.Mutex
+}
+
+func newFaults(config Faults) *faults {
+	f := &faults{}
+	f.set(config)
+	return f
+}
+
+func (f *faults) set(config Faults) {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	partition := make(map[kademliaid.T]int)
+	for i, set := range config.Partitions {
+		for _, id := range set {
+			partition[id] = i
+		}
+	}
+	f.mux.Lock()
+	f.config = config
+	f.partition = partition
+	f.rand = rand.New(rand.NewSource(seed))
+	f.mux.Unlock()
+}
+
+//SetFaults changes the faults the node injects, e.g. to heal a partition
+func (t *T) SetFaults(config Faults) {
+	t.faults.set(config)
+}
+
+// chance returns true with probability p, must be called with mux held
+func (f *faults) chance(p float64) bool {
+	return p > 0 && f.rand.Float64() < p
+}
+
+// dropReceived tells whether a received datagram is lost
+func (f *faults) dropReceived() bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.chance(f.config.DropRate)
+}
+
+// partitioned tells whether the nodes a and b are in different sets of nodes
+func (f *faults) partitioned(a, b *kademliaid.T) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	i, ok := f.partition[*a]
+	j, ok2 := f.partition[*b]
+	return ok && ok2 && i != j
+}
+
+// lying tells whether the node answers lookups with lies
+func (f *faults) lying() bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.config.Lie
+}
+
+// lies returns K made up contacts for a lookup of target. They are the same every time, so that a lookup
+// that follows them ends once it has asked them all.
+func (nw *T) lies(target *kademliaid.T) []contact.T {
+	contacts := make([]contact.T, constants.K)
+	for i := range contacts {
+		id := *target
+		id[kademliaid.IDLength-1] ^= byte(i + 1)
+		contacts[i] = contact.New(&id, nw.me().Address)
+	}
+	return contacts
+}
+
+// writeDatagram sends b with tr, unless the faults lose it. It may be delayed or sent twice.
+func (nw *T) writeDatagram(tr transport.T, b []byte, raddr string) error {
+	f := nw.faults
+	f.mux.Lock()
+	if f.chance(f.config.DropRate) {
+		f.mux.Unlock()
+		return nil
+	}
+	copies := 1
+	if f.chance(f.config.DuplicateRate) {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = f.config.Delay
+		if f.config.Jitter > 0 {
+			delays[i] += time.Duration(f.rand.Int63n(int64(f.config.Jitter)))
+		}
+	}
+	f.mux.Unlock()
+
+	if copies == 1 && delays[0] == 0 {
+		return tr.WriteTo(b, raddr)
+	}
+	for _, d := range delays {
+		nw.clock.AfterFunc(d, func() {
+			err := tr.WriteTo(b, raddr)
+			if err != nil && err != transport.ErrClosed {
+				log.Printf("Failed to send delayed datagram: %v\n", err)
+			}
+		})
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package kademlia
+
+import (
+	"log"
+	"sync"
+	"hash/crc32"
+	"github.com/mjolnir92/kdfs/kademliaid"
+	"github.com/mjolnir92/kdfs/contact"
+	"github.com/mjolnir92/kdfs/constants"
+	"github.com/mjolnir92/kdfs/clock"
+)
+
+// Messages that don't fit in one datagram are sent as FRAGMENTs.
+// RPCID is the transaction ID of the fragmented message, Checksum is the CRC-32 of the whole message.
+type RPCFragment struct {
+	RPCType int
+	Version int
+	RPCID kademliaid.T
+	Sender contact.T
+	Index int
+	Count int
+	Checksum uint32
+	Data []byte
+}
+
+// Sent by the receiver of a fragmented message to ask for the fragments it is missing
+type RPCFragmentNack struct {
+	RPCType int
+	Version int
+	RPCID kademliaid.T
+	Sender contact.T
+	Missing []int
+}
+
+// A transfer is identified by the transaction ID of the message and the address of the other node
+type transferKey struct {
+	addr string
+	id kademliaid.T
+}
+
+// A message that is being reassembled
+type reassembly struct {
+	// codec of the fragments, the requests for missing fragments are sent with it
+	codec Codec
+	// the fragments that have arrived by index, a map so that a large Count costs nothing until they do
+	parts map[int][]byte
+	count int
+	received int
+	// host the message came from, empty for a response to one of our requests. Only the others are limited.
+	source string
+	checksum uint32
+	nacks int
+	timer clock.Timer
+}
+
+// A message that has been sent in fragments, kept so that lost fragments can be sent again
+type outgoingTransfer struct {
+	fragments [][]byte
+	timer clock.Timer
+}
+
+type transfers struct {
+	incoming map[transferKey]*reassembly
+	// reassemblies that are not responses, in total and by source
+	unsolicited int
+	sources map[string]int
+	outgoing map[transferKey]*outgoingTransfer
+	// recently sent responses, see cacheResponse. nil while the request is being handled, see handling
+	responses map[transferKey][]byte
+	// bytes of the responses
+	responsesSize int
+	mux sync.Mutex
+}
+
+func newTransfers() transfers {
+	return transfers{incoming: make(map[transferKey]*reassembly), sources: make(map[string]int), outgoing: make(map[transferKey]*outgoingTransfer), responses: make(map[transferKey][]byte)}
+}
+
+// reassemble starts reassembling a message, false if too many messages that are not responses are reassembled already.
+// Call with mux held.
+func (t *transfers) reassemble(key transferKey, r *reassembly) bool {
+	if r.source != "" {
+		if t.unsolicited >= constants.MAX_REASSEMBLIES || t.sources[r.source] >= constants.MAX_SOURCE_REASSEMBLIES {
+			return false
+		}
+		t.unsolicited++
+		t.sources[r.source]++
+	}
+	t.incoming[key] = r
+	return true
+}
+
+// removeIncoming stops reassembling a message. Call with mux held.
+func (t *transfers) removeIncoming(key transferKey, r *reassembly) {
+	r.timer.Stop()
+	delete(t.incoming, key)
+	if r.source != "" {
+		t.unsolicited--
+		t.sources[r.source]--
+		if t.sources[r.source] == 0 {
+			delete(t.sources, r.source)
+		}
+	}
+}
+
+// stop cancels all transfers, the timers would otherwise keep writing to a closed transport
+func (t *transfers) stop() {
+	t.mux.Lock()
+	for key, r := range t.incoming {
+		t.removeIncoming(key, r)
+	}
+	for key, out := range t.outgoing {
+		out.timer.Stop()
+		delete(t.outgoing, key)
+	}
+	t.mux.Unlock()
+}
+
+// writeTo sends b to raddr, splitting it into fragments if it doesn't fit in one datagram.
+// id is the transaction ID of the message.
+func (nw *T) writeTo(id kademliaid.T, b []byte, raddr string) error {
+	if to, relay, ok := splitRelayed(raddr); ok {
+		// a response to a request that came through our relay
+		return nw.sendRelayed(id, b, relay, kademliaid.T{}, to)
+	}
+	tr, err := nw.getTransport()
+	if err != nil {
+		return err
+	}
+	if len(b) <= constants.FRAGMENT_SIZE {
+		return nw.writeDatagram(tr, b, raddr)
+	}
+	fragments, err := nw.fragment(id, b)
+	if err != nil {
+		return err
+	}
+	key := transferKey{raddr, id}
+	nw.transfers.mux.Lock()
+	if old, ok := nw.transfers.outgoing[key]; ok {
+		old.timer.Stop()
+	}
+	out := &outgoingTransfer{fragments: fragments}
+	out.timer = nw.clock.AfterFunc(constants.TRANSFER_TIMEOUT, func() {
+		nw.transfers.mux.Lock()
+		if nw.transfers.outgoing[key] == out {
+			delete(nw.transfers.outgoing, key)
+		}
+		nw.transfers.mux.Unlock()
+	})
+	nw.transfers.outgoing[key] = out
+	nw.transfers.mux.Unlock()
+	for _, f := range fragments {
+		err = nw.writeDatagram(tr, f, raddr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fragment splits b into marshalled FRAGMENT messages, encoded with the same codec as b
+func (nw *T) fragment(id kademliaid.T, b []byte) ([][]byte, error) {
+	// the fragments of a signed message are not signed, the message is verified once it has been reassembled
+	payload, _, _ := unframe(b)
+	codec := detectCodec(payload)
+	if len(b) > 1 && b[0] == frameEscape && b[1] != frameSigned {
+		// can't tell the codec of an encrypted or compressed message, every node that does either understands msgpack
+		codec = MsgPack
+	}
+	count := (len(b) + constants.FRAGMENT_SIZE - 1) / constants.FRAGMENT_SIZE
+	checksum := crc32.ChecksumIEEE(b)
+	fragments := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * constants.FRAGMENT_SIZE
+		if end > len(b) {
+			end = len(b)
+		}
+		msg := RPCFragment{RPCType: FRAGMENT, Version: PROTOCOL_VERSION, RPCID: id, Sender: nw.me(), Index: i, Count: count, Checksum: checksum, Data: b[i*constants.FRAGMENT_SIZE:end]}
+		f, err := codec.Marshal(msg)
+		if err != nil {
+			log.Printf("Error marshalling fragment: %v\n", err)
+			return nil, err
+		}
+		fragments[i] = f
+	}
+	return fragments, nil
+}
+
+func (nw *T) fragmentReceived(codec Codec, b []byte, raddr string) {
+	var msg RPCFragment
+	err := codec.Unmarshal(b, &msg)
+	if err != nil {
+		log.Printf("Failed to unmarshal into struct")
+		return
+	}
+	if msg.Count <= 0 || msg.Index < 0 || msg.Index >= msg.Count || msg.Count > constants.MAX_MESSAGE_SIZE/constants.FRAGMENT_SIZE+1 {
+		log.Printf("Dropping fragment %v/%v from %v\n", msg.Index, msg.Count, raddr)
+		return
+	}
+	response := nw.notifyProgress(msg.RPCID)
+
+	key := transferKey{raddr, msg.RPCID}
+	nw.transfers.mux.Lock()
+	r, ok := nw.transfers.incoming[key]
+	if !ok {
+		r = &reassembly{codec: codec, parts: make(map[int][]byte), count: msg.Count, checksum: msg.Checksum}
+		if !response {
+			r.source = source(raddr)
+		}
+		// a request costs memory and a timer from its first fragment on, it is limited like the other requests
+		if !response && !nw.admission.admit(FRAGMENT, raddr) || !nw.transfers.reassemble(key, r) {
+			nw.transfers.mux.Unlock()
+			return
+		}
+		r.timer = nw.clock.AfterFunc(constants.FRAGMENT_TIMEOUT, func() {
+			nw.requestMissing(key, raddr)
+		})
+	}
+	if r.count != msg.Count || r.checksum != msg.Checksum || msg.Index < 0 || msg.Index >= r.count {
+		// a fragment that doesn't belong to this message
+		nw.transfers.mux.Unlock()
+		return
+	}
+	if _, ok := r.parts[msg.Index]; ok || len(msg.Data) == 0 && msg.Index != r.count-1 {
+		// duplicate, or an empty fragment, which only the last one can be
+		nw.transfers.mux.Unlock()
+		return
+	}
+	r.parts[msg.Index] = msg.Data
+	r.received++
+	// only count the requests for missing fragments that didn't lead anywhere
+	r.nacks = 0
+	if r.received < r.count {
+		r.timer.Reset(constants.FRAGMENT_TIMEOUT)
+		nw.transfers.mux.Unlock()
+		return
+	}
+	nw.transfers.removeIncoming(key, r)
+	nw.transfers.mux.Unlock()
+
+	var message []byte
+	for i := 0; i < r.count; i++ {
+		message = append(message, r.parts[i]...)
+	}
+	if crc32.ChecksumIEEE(message) != r.checksum {
+		log.Printf("Checksum mismatch in message from %v, dropping it\n", raddr)
+		return
+	}
+	nw.resolveRPC(message, raddr)
+}
+
+// requestMissing sends a FRAGMENT_NACK for the fragments of an incomplete message.
+// The message is given up after FRAGMENT_RETRIES attempts.
+func (nw *T) requestMissing(key transferKey, raddr string) {
+	nw.transfers.mux.Lock()
+	r, ok := nw.transfers.incoming[key]
+	if !ok {
+		nw.transfers.mux.Unlock()
+		return
+	}
+	if r.nacks >= constants.FRAGMENT_RETRIES {
+		nw.transfers.removeIncoming(key, r)
+		nw.transfers.mux.Unlock()
+		log.Printf("Giving up on message from %v, %v of %v fragments received\n", raddr, r.received, r.count)
+		return
+	}
+	r.nacks++
+	missing := []int{}
+	for i := 0; i < r.count && len(missing) < constants.MAX_NACK_FRAGMENTS; i++ {
+		if r.parts[i] == nil {
+			missing = append(missing, i)
+		}
+	}
+	r.timer.Reset(constants.FRAGMENT_TIMEOUT)
+	codec := r.codec
+	nw.transfers.mux.Unlock()
+
+	msg := RPCFragmentNack{RPCType: FRAGMENT_NACK, Version: PROTOCOL_VERSION, RPCID: key.id, Sender: nw.me(), Missing: missing}
+	b, err := codec.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshalling FragmentNack: %v\n", err)
+		return
+	}
+	err = nw.writeTo(key.id, b, raddr)
+	if err != nil {
+		log.Printf("Failed to request missing fragments: %v\n", err)
+	}
+}
+
+// fragmentNack sends the requested fragments again
+func (nw *T) fragmentNack(codec Codec, b []byte, raddr string) {
+	var msg RPCFragmentNack
+	err := codec.Unmarshal(b, &msg)
+	if err != nil {
+		log.Printf("Failed to unmarshal into struct")
+		return
+	}
+	key := transferKey{raddr, msg.RPCID}
+	nw.transfers.mux.Lock()
+	out, ok := nw.transfers.outgoing[key]
+	if !ok {
+		nw.transfers.mux.Unlock()
+		log.Printf("%v asked for fragments of a message we no longer have\n", raddr)
+		return
+	}
+	out.timer.Reset(constants.TRANSFER_TIMEOUT)
+	resend := [][]byte{}
+	for _, i := range msg.Missing {
+		if i >= 0 && i < len(out.fragments) {
+			resend = append(resend, out.fragments[i])
+		}
+	}
+	nw.transfers.mux.Unlock()
+
+	tr, err := nw.getTransport()
+	if err != nil {
+		return
+	}
+	for _, f := range resend {
+		err = nw.writeDatagram(tr, f, raddr)
+		if err != nil {
+			log.Printf("Failed to resend fragment: %v\n", err)
+			return
+		}
+	}
+}
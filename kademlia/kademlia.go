@@ -1,47 +1,152 @@
 package kademlia
 
 import (
-	"net"
-	"time"
-	"sort"
+	"log"
+	"context"
 	"sync"
 	"errors"
+	"math/rand"
 	"github.com/mjolnir92/kdfs/contact"
 	"github.com/mjolnir92/kdfs/routingtable"
 	"github.com/mjolnir92/kdfs/kademliaid"
 	"github.com/mjolnir92/kdfs/constants"
+	"github.com/mjolnir92/kdfs/clock"
 	"github.com/mjolnir92/kdfs/eventmanager"
 	"github.com/mjolnir92/kdfs/kvstore"
+	"github.com/mjolnir92/kdfs/transport"
+	"github.com/mjolnir92/kdfs/identity"
 )
 
-type Candidates struct {
-	c	[]contact.T
-	q	map[kademliaid.T]contact.T
-	r	map[kademliaid.T]contact.T
-	a	map[kademliaid.T]contact.T
-	mux	sync.Mutex
+//How a LookupData went
+type LookupStats struct {
+	//Nodes that were sent a FIND_VALUE
+	Queried int
+	//Hops to the node that had the value, 1 if the node knew it already. 0 if the value was not found.
+	Hops int
+	//Replicas that answered with the value, cached copies don't count. Only counted by quorum reads.
+	Replicas int
+	//Different versions of the value the replicas have, by Timestamp and Pin. More than 1 if they disagree.
+	Versions int
+	//Replicas that have another version than the one that was returned
+	Stale int
 }
 
-func (candidates *Candidates) CalcDistances(target *kademliaid.T) {
-	for i, _ := range candidates.c {
-		candidates.c[i].CalcDistance(target)
-	}
+//Options for a node. Start from DefaultOptions and change what you need.
+type Options struct {
+	//Where RPCs are sent and received, if nil it has to be set up by Listen
+	Transport transport.T
+	//Times an RPC is sent again before the contact is considered dead
+	Retries int
+	//Encoding of the RPCs this node sends. Responses are encoded like the request they answer.
+	Codec Codec
+	//Keypair the node signs its RPCs with, the ID of contactMe has to be derived from it.
+	//A node with an identity only accepts signed RPCs. If nil, RPCs are sent unsigned.
+	Identity *identity.T
+	//Crypto puzzles that the IDs of other nodes have to solve to be added to the routing table.
+	//The ID of contactMe has to solve the static puzzle, the dynamic one is solved by NewWithOptions.
+	Puzzle kademliaid.Puzzle
+	//Limits on the requests from other nodes
+	Limits Limits
+	//Relay RPCs for nodes that are not reachable, see relay.go
+	Relay bool
+	//Compress RPCs to nodes that support it, see compress.go
+	Compression bool
+	//Faults injected into the datagrams, for testing. See faults.go
+	Faults Faults
+	//Time of the node's timers and timestamps, the simulator runs nodes on a virtual clock
+	Clock clock.T
+	//Disjoint paths lookups take, no node is queried by more than one. More paths cost more RPCs
+	//but make it harder for lying nodes to lead a lookup astray. See lookup.go
+	Paths int
+	//Seed of the IDs the node makes up: RPC IDs, dial back probes and the targets of bucket refreshes.
+	//0 uses math/rand's own source, the simulator sets one so that its runs can be repeated.
+	Seed int64
+}
+
+func DefaultOptions() Options {
+	limits := Limits{SourceRate: constants.SOURCE_RATE, SourceBurst: constants.SOURCE_BURST, TypeRate: constants.TYPE_RATE, TypeBurst: constants.TYPE_BURST, MaxStores: constants.MAX_CONCURRENT_STORES}
+	return Options{Retries: constants.RETRIES, Codec: MsgPack, Limits: limits, Compression: true, Clock: clock.Real, Paths: constants.LOOKUP_PATHS}
 }
 
 type T struct {
+	options Options
 	eventmanager *eventmanager.T
 	kvstore *kvstore.T
 	routingtable *routingtable.T
 	contactMe *contact.T
-	conn *net.UDPConn
+	transport transport.T
+	// RPCs waiting for a response, by transaction ID
+	pending map[kademliaid.T]*pendingRPC
+	mux sync.Mutex
+	transfers transfers
+	// X25519 keys of the node and the nodes it has exchanged pings with, nil if the node has no identity
+	encryption *sessions
+	admission *admission
+	// set by Close, see begin
+	closed bool
+	// lookups, RPCs and requests in progress
+	inflight sync.WaitGroup
+	// Serve loops, they return once the transport is closed
+	serving sync.WaitGroup
+	// the address the peers saw our last ping arrive from, by their IP address, see nat.go
+	observed map[string]observation
+	// dial backs waiting for their ping, by probe
+	probes map[kademliaid.T]chan struct{}
+	relaying relaying
+	// the tokens we hand out and the ones we were given, see tokens.go
+	tokens *tokens
+	storeTokens storeTokens
+	faults *faults
+	clock clock.T
+	// source of newRandomID, nil for math/rand's
+	random *lockedRand
 }
 
+//Returned by RPCs and lookups once Close has been called
+var ErrClosed = errors.New("Node is closed")
+
 func New(contactMe *contact.T) *T{
+	return NewWithOptions(contactMe, DefaultOptions())
+}
+
+func NewWithOptions(contactMe *contact.T, options Options) *T {
 	t := &T{}
+	t.options = options
+	t.transport = options.Transport
+	t.clock = options.Clock
+	if t.clock == nil {
+		t.clock = clock.Real
+	}
 	t.contactMe = contactMe
-	t.eventmanager = eventmanager.New()
+	if options.Identity != nil {
+		// other nodes check the ID against the key
+		t.contactMe.PublicKey = options.Identity.PublicKey()
+		// the encryption keys are exchanged in signed pings, without an identity they can't be trusted
+		var err error
+		t.encryption, err = newSessions()
+		if err != nil {
+			log.Printf("Can't encrypt RPCs: %v\n", err)
+		}
+	}
+	t.eventmanager = eventmanager.NewWithClock(t.clock)
+	if !options.Puzzle.CheckDynamic(t.contactMe.ID, &t.contactMe.Nonce) {
+		t.contactMe.Nonce = options.Puzzle.Solve(t.contactMe.ID)
+	}
 	t.routingtable = routingtable.New(*t.contactMe, t.eventmanager, constants.K)
+	t.routingtable.SetPuzzle(options.Puzzle)
 	t.kvstore = kvstore.New()
+	t.pending = make(map[kademliaid.T]*pendingRPC)
+	t.observed = make(map[string]observation)
+	t.probes = make(map[kademliaid.T]chan struct{})
+	t.transfers = newTransfers()
+	t.admission = newAdmission(options.Limits)
+	t.relaying = newRelaying(t.clock)
+	t.tokens = newTokens(t.clock)
+	t.storeTokens = newStoreTokens(t.clock)
+	t.faults = newFaults(options.Faults)
+	if options.Seed != 0 {
+		t.random = &lockedRand{rand: rand.New(rand.NewSource(options.Seed))}
+	}
 
 	for i := 0; i < kademliaid.IDLength*8; i++{
 		f := func() {
@@ -52,10 +157,91 @@ func New(contactMe *contact.T) *T{
 	return t
 }
 
+//Creates a node that sends and receives RPCs on tr. Call Serve to start handling incoming RPCs.
+func NewWithTransport(contactMe *contact.T, tr transport.T) *T {
+	options := DefaultOptions()
+	options.Transport = tr
+	return NewWithOptions(contactMe, options)
+}
+
+//Close shuts the node down. New lookups and RPCs fail with ErrClosed and requests from other nodes are ignored.
+//The events are cancelled and the lookups, RPCs and requests in progress are waited for before the transport is closed.
+//If ctx is done first, the transport is closed anyway and ctx.Err() is returned.
+func (t *T) Close(ctx context.Context) error {
+	t.mux.Lock()
+	if t.closed {
+		t.mux.Unlock()
+		return nil
+	}
+	t.closed = true
+	t.mux.Unlock()
+	t.eventmanager.Close()
+
+	done := make(chan struct{})
+	go func() {
+		t.inflight.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	t.transfers.stop()
+	t.mux.Lock()
+	tr := t.transport
+	t.mux.Unlock()
+	if tr != nil {
+		closeErr := tr.Close()
+		if err == nil {
+			err = closeErr
+		}
+		t.serving.Wait()
+	}
+	return err
+}
+
+//Registers work that Close waits for, end has to be called when it is done.
+//Returns false if the node is closed, the work should not be started then.
+func (t *T) begin() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.closed {
+		return false
+	}
+	t.inflight.Add(1)
+	return true
+}
+
+func (t *T) end() {
+	t.inflight.Done()
+}
+
+//A math/rand source several goroutines can draw from
+type lockedRand struct {
+	rand *rand.Rand
+	mux sync.Mutex
+}
+
+func (r *lockedRand) Read(b []byte) (int, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.rand.Read(b)
+}
+
+// newRandomID returns a random ID from the source Options.Seed chose
+func (t *T) newRandomID() *kademliaid.T {
+	if t.random == nil {
+		return kademliaid.NewRandom()
+	}
+	return kademliaid.NewRandomFrom(t.random)
+}
+
 //This method refreshes the bucket corresponding to the index
 func (t *T) refreshBucket(index int) {
-	randomID := kademliaid.NewRandomCommonPrefix(*t.contactMe.ID, uint8(index))
-	contacts := t.LookupContact(randomID)
+	randomID := kademliaid.CommonPrefix(*t.newRandomID(), *t.contactMe.ID, uint8(index))
+	contacts, _ := t.LookupContact(context.Background(), randomID)
 	for _, c := range(contacts) {
 		t.routingtable.AddContact(c)
 	}
@@ -64,13 +250,17 @@ func (t *T) refreshBucket(index int) {
 //A kademlia node t can join the network as long as they know the address of a node already on the network
 //This method connects t to the rest of the network
 func (t *T) Join(address string) error {
+	if !t.begin() {
+		return ErrClosed
+	}
+	defer t.end()
 	//Create a contact with a dummy id. By pinging this contact we insert the real contact (with the real id) into our routingtable
 	contact := contact.New(kademliaid.New("0000000000000000000000000000000000000000"), address)
-	err := t.Ping(&contact)
+	err := t.Ping(context.Background(), &contact)
 	if err != nil {
 		return err
 	}
-	contacts := t.LookupContact(t.contactMe.ID)
+	contacts, _ := t.LookupContact(context.Background(), t.contactMe.ID)
 	for _, c := range(contacts) {
 		t.routingtable.AddContact(c)
 	}
@@ -82,298 +272,191 @@ func (t *T) Join(address string) error {
 		t.refreshBucket(i)
 		t.eventmanager.ResetEvent(*t.contactMe.ID, i, constants.BUCKET_REFRESH)
 	}
+	//Now that there are nodes to ask, find out whether we advertise an address they can reach, and check again every now and then in case the NAT changes
+	go t.CheckReachability()
+	f := func() {
+		t.CheckReachability()
+	}
+	t.eventmanager.InsertEvent(*t.contactMe.ID, constants.REACHABILITY, f, constants.REACHABILITY_CHECK)
 	return nil
 }
 
-// Issue FindNode rpc to target and update a list of candidates accordingly, maps of queried and replied nodes are also updated
-func (t *T) issueFindNode(node *contact.T, target *kademliaid.T, candidates *Candidates, wg *sync.WaitGroup) {
-	defer wg.Done()
-	res, err := t.FindNode(node, target)
-	candidates.mux.Lock()
-	candidates.q[*node.ID] = *node
-
-	// Remove already added nodes from result
-	tempRes := make([]contact.T, 0)
-	for _, r := range res {
-		if _, ok := candidates.a[*r.ID]; !ok {
-			tempRes = append(tempRes, r)
-		}
-	}
-	res = tempRes
+//Returns the K closest nodes to target. If ctx is done before the lookup finishes, no more nodes are asked
+//and ctx.Err() is returned.
+func (t *T) LookupContact(ctx context.Context, target *kademliaid.T) ([]contact.T, error) {
+	return t.lookupContact(ctx, target, nil)
+}
 
-	if err != nil {
-		// Replace candidates.c with slice excluding unresponsive node
-		temp := make([]contact.T, 0)
-		for i, c := range candidates.c {
-			if *c.ID != *node.ID {
-				temp = append(temp, candidates.c[i])
-			}
-		}
-		candidates.c = temp
-	} else {
-		candidates.c = append(candidates.c, res...)
-		for _, r := range res {
-			candidates.a[*r.ID] = r
-		}
-		candidates.CalcDistances(target)
-		sort.Sort(contact.ByDist(candidates.c))
-		candidates.r[*node.ID] = *node
-	}
-	candidates.mux.Unlock()
+//LookupContactTrace is LookupContact that records every query of the lookup, e.g. to find out why it went wrong.
+//The trace is returned with the error too.
+func (t *T) LookupContactTrace(ctx context.Context, target *kademliaid.T) ([]contact.T, Trace, error) {
+	tr := newTracer(t.clock, target)
+	contacts, err := t.lookupContact(ctx, target, tr)
+	return contacts, tr.get(), err
 }
 
-// Issue FindValue rpc to target and update a list of candidates accordingly, maps of queried and replied nodes are also updated. If a value is found it is passed to a provided channel
-func (t *T) issueFindValue(node *contact.T, target *kademliaid.T, candidates *Candidates, wg *sync.WaitGroup, ch chan kvstore.Value) {
-	defer wg.Done()
-	val, res, found, err := t.FindValue(node, target)
-	candidates.mux.Lock()
-	candidates.q[*node.ID] = *node
-
-	// Remove already added nodes from result
-	tempRes := make([]contact.T, 0)
-	for _, r := range res {
-		if _, ok := candidates.a[*r.ID]; !ok {
-			tempRes = append(tempRes, r)
-		}
+func (t *T) lookupContact(ctx context.Context, target *kademliaid.T, tr *tracer) ([]contact.T, error) {
+	if !t.begin() {
+		return nil, ErrClosed
 	}
-	res = tempRes
-
+	defer t.end()
+	query := func(ctx context.Context, node *contact.T) (lookupReply, error) {
+		contacts, err := t.FindNode(ctx, node, target)
+		return lookupReply{contacts: contacts}, err
+	}
+	l := t.newLookup(target, query, nil)
+	if tr != nil {
+		l.trace(tr)
+	}
+	_, _, err := l.run(ctx)
 	if err != nil {
-		// Replace candidates.c with slice excluding unresponsive node
-		temp := make([]contact.T, 0)
-		for i, c := range candidates.c {
-			if *c.ID != *node.ID {
-				temp = append(temp, candidates.c[i])
-			}
-		}
-		candidates.c = temp
-	} else {
-		if found {
-			ch <- val
-		} else {
-			candidates.c = append(candidates.c, res...)
-			for _, r := range res {
-				candidates.a[*r.ID] = r
-			}
-			candidates.CalcDistances(target)
-			sort.Sort(contact.ByDist(candidates.c))
-		}
-		candidates.r[*node.ID] = *node
+		return nil, err
 	}
-	candidates.mux.Unlock()
+	return l.closest(), nil
 }
 
-func (t *T) LookupContact(target *kademliaid.T) []contact.T {
-	candidates := Candidates{c: make([]contact.T, 0), q: make(map[kademliaid.T]contact.T), r: make(map[kademliaid.T]contact.T), a: make(map[kademliaid.T]contact.T)}
-	var wg sync.WaitGroup
+//Returns the value with the key target. If ctx is done before it is found, no more nodes are asked
+//and ctx.Err() is returned. The closest node asked that didn't have the value is sent a copy to cache.
+func (t *T) LookupData(ctx context.Context, target *kademliaid.T) (kvstore.Value, error) {
+	data, _, err := t.LookupDataStats(ctx, target)
+	return data, err
+}
 
-	// Query <ALPHA> closest known nodes
-	closestNodes := t.routingtable.FindClosestContacts(target, constants.ALPHA)
-	for _, node := range closestNodes {
-		wg.Add(1)
-		go t.issueFindNode(&node, target, &candidates, &wg)
-	}
-	wg.Wait()
-	// Repeat until no closer nodes are found
-	for {
-		aCount := 0
-		candidates.mux.Lock()
-		if len(candidates.c) == 0 {
-			candidates.mux.Unlock()
-			break
-		}
-		closestSeen := candidates.c[0]
-		for i, _ := range candidates.c {
-			if _, ok := candidates.q[*candidates.c[i].ID]; !ok {
-				wg.Add(1)
-				go t.issueFindNode(&candidates.c[i], target, &candidates, &wg)
-				aCount++
-			}
-			if aCount >= constants.ALPHA {
-				break
-			}
-			if i >= constants.K-1 {
-				break
-			}
-		}
-		candidates.mux.Unlock()
+//LookupDataStats is LookupData that also tells how the lookup went, e.g. for the simulator
+func (t *T) LookupDataStats(ctx context.Context, target *kademliaid.T) (kvstore.Value, LookupStats, error) {
+	return t.lookupData(ctx, target, 1, nil)
+}
 
-		//  Wait for responses
-		wg.Wait()
+//LookupDataQuorum is LookupData that goes on until r replicas have answered and returns the newest version they have,
+//e.g. after a Pin and an Unpin that raced. This node counts if it is a replica. The stats tell whether the replicas
+//disagreed. If the lookup ends before r replicas answered, the newest version is returned with ErrNoQuorum.
+func (t *T) LookupDataQuorum(ctx context.Context, target *kademliaid.T, r int) (kvstore.Value, LookupStats, error) {
+	return t.lookupData(ctx, target, r, nil)
+}
 
-		candidates.mux.Lock()
-		if len(candidates.c) == 0 {
-			candidates.mux.Unlock()
-			break
+//LookupDataTrace is LookupData that records every query of the lookup, e.g. to find out why a value wasn't found.
+//The trace is returned with the error too.
+func (t *T) LookupDataTrace(ctx context.Context, target *kademliaid.T) (kvstore.Value, Trace, error) {
+	tr := newTracer(t.clock, target)
+	data, _, err := t.lookupData(ctx, target, 1, tr)
+	return data, tr.get(), err
+}
+
+//Looks up the value with the key target until r replicas have answered, the first copy found will do if r is 1
+func (t *T) lookupData(ctx context.Context, target *kademliaid.T, r int, tr *tracer) (kvstore.Value, LookupStats, error) {
+	var data kvstore.Value
+	var stats LookupStats
+	if !t.begin() {
+		return data, stats, ErrClosed
+	}
+	defer t.end()
+	query := func(ctx context.Context, node *contact.T) (lookupReply, error) {
+		res, err := t.findValue(ctx, node, target)
+		if err != nil {
+			return lookupReply{}, err
 		}
-		if closestSeen.ID == candidates.c[0].ID {
-			candidates.mux.Unlock()
-			break
+		if len(res.Value.GetData()) > 0 {
+			return lookupReply{value: foundValue{res.Value, res.Cached}}, nil
 		}
-		candidates.mux.Unlock()
-	}
-
-	pendingReplies := true
-	// Query all K closest candidates that have not been queried until all have responded
-	for pendingReplies {
-		pendingReplies = false
-		candidates.mux.Lock()
-		for i, _ := range candidates.c {
-			if _, ok := candidates.r[*candidates.c[i].ID]; !ok {
-				wg.Add(1)
-				go t.issueFindNode(&candidates.c[i], target, &candidates, &wg)
-			}
-			if i >= constants.K-1 {
-				break
-			}
+		return lookupReply{contacts: t.admitted(res.Contacts)}, nil
+	}
+	q := newQuorum(r)
+	if local, ok := t.kvstore.Get(*target); ok && r > 1 {
+		q.add(t.me().ID, local)
+	}
+	found := func(reply *lookupReply) bool {
+		if reply.value == nil {
+			return false
 		}
-		candidates.mux.Unlock()
-
-		wg.Wait()
-
-		candidates.mux.Lock()
-		for i, _ := range candidates.c {
-			if _, ok := candidates.r[*candidates.c[i].ID]; !ok {
-				pendingReplies = true
-			}
-			if i >= constants.K-1 {
-				break
-			}
+		if r <= 1 {
+			return true
 		}
-		candidates.mux.Unlock()
+		v := reply.value.(foundValue)
+		return !v.cached && q.add(reply.from.ID, v.value)
 	}
-
-	candidates.mux.Lock()
-	defer candidates.mux.Unlock()
-	if len(candidates.c) < constants.K {
-		return candidates.c
+	l := t.newLookup(target, query, found)
+	if tr != nil {
+		l.trace(tr)
+	}
+	reply, ok, err := l.run(ctx)
+	stats.Queried = l.queried()
+	if r > 1 {
+		q.report(&stats)
 	}
-	return candidates.c[:constants.K]
+	if err != nil {
+		return data, stats, err
+	}
+	if !ok && stats.Replicas > 0 {
+		return q.newest(), stats, ErrNoQuorum
+	}
+	if !ok {
+		return data, stats, errors.New("Value not found")
+	}
+	stats.Hops = l.hops(&reply)
+	value := reply.value.(foundValue).value
+	if r > 1 {
+		value = q.newest()
+	}
+	if c, ok := l.closestAnswered(); ok {
+		// as in Kademlia, the closest node that didn't have the value caches it, so that lookups from
+		// elsewhere find it before they reach the nodes responsible for it
+		go t.cacheAt(c, value)
+	}
+	return value, stats, nil
 }
 
-func (t *T) LookupData(target *kademliaid.T) (kvstore.Value, error) {
-	var data kvstore.Value
-	ch := make(chan kvstore.Value)
-	candidates := Candidates{c: make([]contact.T, 0), q: make(map[kademliaid.T]contact.T), r: make(map[kademliaid.T]contact.T), a: make(map[kademliaid.T]contact.T)}
+//Has the node cache a value a lookup found
+func (t *T) cacheAt(c contact.T, value kvstore.Value) {
+	if !t.begin() {
+		return
+	}
+	defer t.end()
+	status, err := t.Cache(context.Background(), &c, &value)
+	if err != nil || (status != STORE_ACCEPTED && status != STORE_STALE) {
+		log.Printf("Node %v did not cache the value, status %v: %v\n", c.ID, status, err)
+	}
+}
 
-	// Wait for RPCs
+//Sends STORE RPCs to all the contacts in parallel. Returns the number of contacts that accepted the value.
+func (t *T) storeAt(ctx context.Context, contacts []contact.T, value *kvstore.Value) int {
 	var wg sync.WaitGroup
-	// Wait for lookup to terminate
-	var wgLookup sync.WaitGroup
-
-	// Start a routine for the lookup
-	wgLookup.Add(1)
-	go func() {
-		defer wgLookup.Done()
-
-		// Query <ALPHA> closest known nodes
-		closestNodes := t.routingtable.FindClosestContacts(target, constants.ALPHA)
-		for _, node := range closestNodes {
-			wg.Add(1)
-			// Call with i = -1 do denote that there is nothing to evict from candidates yet
-			go t.issueFindValue(&node, target, &candidates, &wg, ch)
-		}
-
-		wg.Wait()
-
-		// Repeat until no closer nodes are found
-		for {
-			aCount := 0
-			candidates.mux.Lock()
-			if len(candidates.c) == 0 {
-				candidates.mux.Unlock()
-				break
-			}
-			closestSeen := candidates.c[0]
-			for i, _ := range candidates.c {
-				if _, ok := candidates.q[*candidates.c[i].ID]; !ok {
-					wg.Add(1)
-					go t.issueFindValue(&candidates.c[i], target, &candidates, &wg, ch)
-					aCount++
-				}
-				if aCount >= constants.ALPHA {
-					break
-				}
-				if i >= constants.K-1 {
-					break
-				}
-			}
-			candidates.mux.Unlock()
-
-			//  Wait for responses
-			wg.Wait()
-
-			candidates.mux.Lock()
-			if len(candidates.c) == 0 {
-				candidates.mux.Unlock()
-				break
-			}
-			if closestSeen.ID == candidates.c[0].ID {
-				candidates.mux.Unlock()
-				break
-			}
-			candidates.mux.Unlock()
-		}
-
-		pendingReplies := true
-		// Query all K closest candidates that have not been queried until all have responded
-		for pendingReplies {
-			pendingReplies = false
-			candidates.mux.Lock()
-			for i, _ := range candidates.c {
-				if _, ok := candidates.r[*candidates.c[i].ID]; !ok {
-					wg.Add(1)
-					go t.issueFindValue(&candidates.c[i], target, &candidates, &wg, ch)
-				}
-				if i >= constants.K-1 {
-					break
-				}
-			}
-			candidates.mux.Unlock()
-
-			wg.Wait()
-
-			candidates.mux.Lock()
-			for i, _ := range candidates.c {
-				if _, ok := candidates.r[*candidates.c[i].ID]; !ok {
-					pendingReplies = true
-				}
-				if i >= constants.K-1 {
-					break
-				}
+	var mux sync.Mutex
+	accepted := 0
+	for i := 0; i < len(contacts); i++ {
+		wg.Add(1)
+		go func(c *contact.T) {
+			defer wg.Done()
+			status, err := t.Store(ctx, c, value)
+			if err == nil && status == STORE_ACCEPTED {
+				mux.Lock()
+				accepted++
+				mux.Unlock()
 			}
-			candidates.mux.Unlock()
-		}
-	}()
-
-	// Routine signaling that the lookup has terminated
-	terminated := make(chan struct{})
-	go func() {
-		wgLookup.Wait()
-		close(terminated)
-	}()
-
-	// Wait for either value to be found of lookup to terminate
-	select {
-	case <-terminated:
-		// Do nothing, select ends
-	case data := <-ch:
-		// Value was found
-		return data, nil
+		}(&contacts[i])
 	}
-
-	// Value was not found
-	return data, errors.New("Value not found")
+	wg.Wait()
+	return accepted
 }
 
-func (t *T) KademliaStore(data []byte)  kademliaid.T {
+//Stores data on the K closest nodes. Returns the key of the data and the number of nodes that confirmed storing it.
+//If ctx is done before the nodes confirmed, ctx.Err() is returned and the data is not republished by this node.
+func (t *T) KademliaStore(ctx context.Context, data []byte) (kademliaid.T, int, error) {
 	id := kademliaid.NewHash(data)
-	contacts := t.LookupContact(id)
+	if !t.begin() {
+		return *id, 0, ErrClosed
+	}
+	defer t.end()
+	contacts, err := t.LookupContact(ctx, id)
+	if err != nil {
+		return *id, 0, err
+	}
 	//Defaults to the new file being unpinned
 	data_val := kvstore.NewValue(false, data)
+	data_val.Timestamp = t.clock.Now()
 
-	for i := 0; i < len(contacts); i++ {
-		go t.Store(&contacts[i], &data_val)
+	replicas := t.storeAt(ctx, contacts, &data_val)
+	if ctx.Err() != nil {
+		return *id, replicas, ctx.Err()
 	}
 	//Add republish event that updates the time on the key-value pair
 	f := func() {
@@ -381,69 +464,88 @@ func (t *T) KademliaStore(data []byte)  kademliaid.T {
 		value, ok := t.kvstore.Get(*id)
 		if !ok {
 			var err error
-			value, err = t.LookupData(id)
+			value, err = t.LookupData(context.Background(), id)
 			if err != nil {
 				return
 			}
 		}
-		value.Timestamp = time.Now()
+		value.Timestamp = t.clock.Now()
 
-		contacts := t.LookupContact(id)
+		contacts, _ := t.LookupContact(context.Background(), id)
 		for i := 0; i < len(contacts); i++ {
-			go t.Store(&contacts[i], &value)
+			go t.Store(context.Background(), &contacts[i], &value)
 		}
 	}
 	t.eventmanager.InsertEvent(*id, constants.PUBLISH, f, constants.PUBLISH_TIME)
-	return *id
+	return *id, replicas, nil
 }
 
-func (t *T) Cat(id kademliaid.T) []byte {
+//Returns the data with the key id, from this node if it has it or a copy in its cache. The error is ctx.Err() if ctx ended the lookup.
+func (t *T) Cat(ctx context.Context, id kademliaid.T) ([]byte, error) {
+	if !t.begin() {
+		return nil, ErrClosed
+	}
+	defer t.end()
 	value, ok := t.kvstore.Get(id)
+	if !ok {
+		value, ok = t.kvstore.GetCached(id)
+	}
 	if !ok {
 		var err error
-		value, err = t.LookupData(&id)
+		value, err = t.LookupData(ctx, &id)
 		if err != nil {
-			return nil
+			return nil, err
 		}
 	}
-	return value.GetData()
+	return value.GetData(), nil
 }
 
 //Updates the timestamp and sets the Pin field to true
-func (t *T) Pin(id kademliaid.T) {
+//Returns the number of nodes that confirmed storing the pinned value
+func (t *T) Pin(ctx context.Context, id kademliaid.T) (int, error) {
+	if !t.begin() {
+		return 0, ErrClosed
+	}
+	defer t.end()
 	//If this node doesn't have the file, do LookupData to find it
 	value, ok := t.kvstore.Get(id)
 	if !ok {
 		var err error
-		value, err = t.LookupData(&id)
+		value, err = t.LookupData(ctx, &id)
 		if err != nil {
-			return
+			return 0, err
 		}
 	}
-	value.Timestamp = time.Now()
+	value.Timestamp = t.clock.Now()
 	value.Pin = true
 
-	contacts := t.LookupContact(&id)
-	for i := 0; i < len(contacts); i++ {
-		go t.Store(&contacts[i], &value)
+	contacts, err := t.LookupContact(ctx, &id)
+	if err != nil {
+		return 0, err
 	}
+	return t.storeAt(ctx, contacts, &value), ctx.Err()
 }
 
 //Similar to Pin with the exception that the Pin field is set to false
-func (t *T) Unpin(id kademliaid.T) {
+func (t *T) Unpin(ctx context.Context, id kademliaid.T) (int, error) {
+	if !t.begin() {
+		return 0, ErrClosed
+	}
+	defer t.end()
 	value, ok := t.kvstore.Get(id)
 	if !ok {
 		var err error
-		value, err = t.LookupData(&id)
+		value, err = t.LookupData(ctx, &id)
 		if err != nil {
-			return
+			return 0, err
 		}
 	}
-	value.Timestamp = time.Now()
+	value.Timestamp = t.clock.Now()
 	value.Pin = false
 
-	contacts := t.LookupContact(&id)
-	for i := 0; i < len(contacts); i++ {
-		go t.Store(&contacts[i], &value)
+	contacts, err := t.LookupContact(ctx, &id)
+	if err != nil {
+		return 0, err
 	}
+	return t.storeAt(ctx, contacts, &value), ctx.Err()
 }
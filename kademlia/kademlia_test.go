@@ -1,14 +1,21 @@
 package kademlia
 
 import (
+	"context"
+	"fmt"
+	"sync"
+	"sort"
+	"errors"
 	"bytes"
 	"strconv"
 	"time"
 	"testing"
+	"github.com/mjolnir92/kdfs/clock"
 	"github.com/mjolnir92/kdfs/kademliaid"
 	"github.com/mjolnir92/kdfs/contact"
 	"github.com/mjolnir92/kdfs/constants"
 	"github.com/mjolnir92/kdfs/kvstore"
+	"github.com/mjolnir92/kdfs/transport"
 )
 
 func TestLookupContact(t *testing.T) {
@@ -35,7 +42,7 @@ func TestLookupContact(t *testing.T) {
 	}
 
 	target := kademliaid.New("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF")
-	contacts := nw_kademlia1.LookupContact(target)
+	contacts, _ := nw_kademlia1.LookupContact(context.Background(), target)
 	for _, c := range contacts {
 		if c.ID == target {
 			t.Error("LookupContact did not return the correct contacts")
@@ -68,9 +75,9 @@ func TestLookupData(t *testing.T) {
 
 	testData := []byte("my test data")
 	testData2 := []byte("should not exist")
-	nw_kademlia2.KademliaStore(testData)
+	nw_kademlia2.KademliaStore(context.Background(), testData)
 	time.Sleep(50 * time.Millisecond)
-	data, err := nw_kademlia1.LookupData(kademliaid.NewHash(testData))
+	data, err := nw_kademlia1.LookupData(context.Background(), kademliaid.NewHash(testData))
 	if err != nil {
 		t.Error("LookupData failed: ", err)
 	} else {
@@ -78,7 +85,7 @@ func TestLookupData(t *testing.T) {
 			t.Error("LookupData failed: Wrong data returned")
 		}
 	}
-	data, err = nw_kademlia1.LookupData(kademliaid.NewHash(testData2))
+	data, err = nw_kademlia1.LookupData(context.Background(), kademliaid.NewHash(testData2))
 	if err == nil {
 		t.Error("Requested data should not exist")
 	}
@@ -99,89 +106,411 @@ func TestCat(t *testing.T) {
 	nw_kademlia2.Join(address1)
 
 	testData := []byte("my test data")
-	nw_kademlia2.KademliaStore(testData)
+	nw_kademlia2.KademliaStore(context.Background(), testData)
 	time.Sleep(50 * time.Millisecond)
 	id := kademliaid.NewHash(testData)
-	data := nw_kademlia1.Cat(*id)
+	data, _ := nw_kademlia1.Cat(context.Background(), *id)
 	if bytes.Compare(data, testData) != 0 {
 		t.Error("TestCat failed, wrong data")
 	}
 }
 
 func TestPinUnpin(t *testing.T) {
-	address1 := "localhost:12700"
-	ct_kademlia1 := contact.New(kademliaid.New("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"), address1)
-	nw_kademlia1 := New(&ct_kademlia1)
-	go nw_kademlia1.Listen(address1)
-	time.Sleep(50 * time.Millisecond)
-
-	address2 := "localhost:12701"
-	ct_kademlia2 := contact.New(kademliaid.New("0000000000000000000000000000000000000000"), address2)
-	nw_kademlia2 := New(&ct_kademlia2)
-	go nw_kademlia2.Listen(address2)
-	time.Sleep(50 * time.Millisecond)
-	nw_kademlia2.Join(address1)
-	time.Sleep(50 * time.Millisecond)
-
-	for i := 0; i<20; i++ {
-		address := "localhost:"+strconv.Itoa(12710+i)
-		ct := contact.New(kademliaid.NewRandom(), address)
-		nw := New(&ct)
-		go nw.Listen(address)
-		time.Sleep(50*time.Millisecond)
-		nw.Join(address1)
-	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewVirtual(start)
+	nodes := startVirtualNodes(t, c, 2)
+	nw_kademlia1, nw_kademlia2 := nodes[0], nodes[1]
 
 	testData := []byte("my test data")
 	id := kademliaid.NewHash(testData)
-	nw_kademlia2.KademliaStore(testData)
-	time.Sleep(50 * time.Millisecond)
+	nw_kademlia2.KademliaStore(context.Background(), testData)
+	// the publisher would keep the data alive, only the pin should
+	nw_kademlia2.eventmanager.DeleteEvent(*id, constants.PUBLISH)
+	// the pinned version replaces the stored one if it is newer
+	c.RunUntil(start.Add(time.Second), time.Second)
 
-	nw_kademlia2.Pin(*id)
-	time.Sleep(constants.EXPIRE_TIME)
-	data := nw_kademlia1.Cat(*id)
+	nw_kademlia2.Pin(context.Background(), *id)
+	c.RunUntil(start.Add(constants.EXPIRE_TIME+time.Minute), time.Second)
+	data, _ := nw_kademlia1.Cat(context.Background(), *id)
 	if bytes.Compare(data, testData) != 0 {
 		t.Error("TestPinUnpin failed, Data did not remain after pinning")
 	}
 
-	nw_kademlia2.Unpin(*id)
-	time.Sleep(2* constants.EXPIRE_TIME)
-	data = nw_kademlia1.Cat(*id)
+	nw_kademlia2.Unpin(context.Background(), *id)
+	c.RunUntil(c.Now().Add(2*constants.EXPIRE_TIME), time.Second)
+	data, _ = nw_kademlia1.Cat(context.Background(), *id)
 	if bytes.Compare(data, testData) == 0 {
 		t.Error("TestPinUnpin failed, data stayed after unpin")
 	}
 }
 
 func TestExpire(t *testing.T) {
-	address1 := "localhost:12800"
-	ct_kademlia1 := contact.New(kademliaid.New("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"), address1)
-	nw_kademlia1 := New(&ct_kademlia1)
-	go nw_kademlia1.Listen(address1)
-	time.Sleep(50 * time.Millisecond)
-
-	address2 := "localhost:12801"
-	ct_kademlia2 := contact.New(kademliaid.New("0000000000000000000000000000000000000000"), address2)
-	nw_kademlia2 := New(&ct_kademlia2)
-	go nw_kademlia2.Listen(address2)
-	time.Sleep(50 * time.Millisecond)
-	nw_kademlia2.Join(address1)
-	time.Sleep(50 * time.Millisecond)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewVirtual(start)
+	nodes := startVirtualNodes(t, c, 2)
+	nw_kademlia1, nw_kademlia2 := nodes[0], nodes[1]
+	ct_kademlia2 := nw_kademlia2.me()
 
 	testData := []byte("my test data")
 	val := kvstore.NewValue(false, testData)
+	// it expires EXPIRE_TIME after its timestamp
+	val.Timestamp = start
 	id := kademliaid.NewHash(testData)
-	nw_kademlia1.Store(&ct_kademlia2, &val)
+	nw_kademlia1.Store(context.Background(), &ct_kademlia2, &val)
 	nw_kademlia1.eventmanager.DeleteEvent(*id, constants.PUBLISH)
-	time.Sleep(50 * time.Millisecond)
 	if _, ok := nw_kademlia2.kvstore.Get(*id); !ok {
 		t.Error("TestExpire failed, value not stored")
 	}
 
-	time.Sleep(constants.EXPIRE_TIME)
+	c.RunUntil(start.Add(constants.EXPIRE_TIME+time.Minute), time.Second)
 	if _, ok := nw_kademlia2.kvstore.Get(*id); ok {
 		t.Error("TestExpire failed, value not stored")
 	}
 	if _, ok := nw_kademlia1.kvstore.Get(*id); ok {
 		t.Error("TestExpire failed, value not stored")
 	}
-}
\ No newline at end of file
+}
+
+// startVirtualNodes starts count nodes like startMemoryNodes, with their timers on c
+func startVirtualNodes(t *testing.T, c *clock.Virtual, count int) []*T {
+	network := transport.NewNetwork()
+	nodes := make([]*T, count)
+	for i := 0; i < count; i++ {
+		address := "node" + strconv.Itoa(i)
+		tr, err := network.Listen(address)
+		if err != nil {
+			t.Fatal("Could not listen on the memory network:", err)
+		}
+		ct := contact.New(kademliaid.NewRandom(), address)
+		options := DefaultOptions()
+		options.Transport = tr
+		options.Clock = c
+		// the rate limits run on real time, which hardly passes on c
+		options.Limits = Limits{}
+		nodes[i] = NewWithOptions(&ct, options)
+		go nodes[i].Serve()
+		if i > 0 {
+			err = nodes[i].Join(nodes[0].contactMe.Address)
+			if err != nil {
+				t.Fatal("Join failed:", err)
+			}
+		}
+	}
+	return nodes
+}
+
+// startMemoryNodes starts count nodes on an in-memory network and joins them through the first one
+func startMemoryNodes(t *testing.T, network *transport.Network, count int) []*T {
+	nodes := make([]*T, count)
+	for i := 0; i < count; i++ {
+		address := "node" + strconv.Itoa(i)
+		tr, err := network.Listen(address)
+		if err != nil {
+			t.Fatal("Could not listen on the memory network:", err)
+		}
+		ct := contact.New(kademliaid.NewRandom(), address)
+		nodes[i] = NewWithTransport(&ct, tr)
+		go nodes[i].Serve()
+		if i > 0 {
+			err = nodes[i].Join(nodes[0].contactMe.Address)
+			if err != nil {
+				t.Fatal("Join failed:", err)
+			}
+		}
+	}
+	return nodes
+}
+
+func TestMemoryNetwork(t *testing.T) {
+	nodes := startMemoryNodes(t, transport.NewNetwork(), 200)
+
+	t.Run("LookupContact", func(t *testing.T) {
+		target := kademliaid.NewRandom()
+		all := make([]contact.T, len(nodes))
+		for i, nw := range nodes {
+			all[i] = *nw.contactMe
+			all[i].CalcDistance(target)
+		}
+		sort.Sort(contact.ByDist(all))
+		got, _ := nodes[len(nodes)-1].LookupContact(context.Background(), target)
+		if len(got) != constants.K {
+			t.Fatalf("LookupContact returned %v contacts, expected %v", len(got), constants.K)
+		}
+		// all but the looking node itself should be among the K closest
+		expected := make(map[kademliaid.T]bool)
+		for _, c := range all[:constants.K+1] {
+			expected[*c.ID] = true
+		}
+		for _, c := range got {
+			if !expected[*c.ID] {
+				t.Errorf("LookupContact returned %v which is not one of the closest nodes", c.String())
+			}
+		}
+	})
+	t.Run("LookupData", func(t *testing.T) {
+		testData := []byte("stored on the memory network")
+		id, replicas, _ := nodes[1].KademliaStore(context.Background(), testData)
+		if replicas != constants.K {
+			t.Errorf("KademliaStore was confirmed by %v nodes, expected %v", replicas, constants.K)
+		}
+		var data kvstore.Value
+		var err error
+		for i := 0; i < 50; i++ {
+			data, err = nodes[len(nodes)-1].LookupData(context.Background(), &id)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Error("LookupData failed: ", err)
+		} else if !bytes.Equal(data.GetData(), testData) {
+			t.Error("LookupData failed: Wrong data returned")
+		}
+	})
+}
+
+func TestFaults(t *testing.T) {
+	nodes := startMemoryNodes(t, transport.NewNetwork(), 30)
+	for i, nw := range nodes {
+		nw.SetFaults(Faults{DropRate: 0.05, DuplicateRate: 0.05, Delay: time.Millisecond, Jitter: 5 * time.Millisecond, Seed: int64(i + 1)})
+	}
+
+	testData := []byte("stored on a lossy network")
+	id, replicas, _ := nodes[1].KademliaStore(context.Background(), testData)
+	if replicas == 0 {
+		t.Fatal("No node confirmed the KademliaStore")
+	}
+	data, err := nodes[len(nodes)-1].LookupData(context.Background(), &id)
+	if err != nil {
+		t.Fatal("LookupData failed: ", err)
+	}
+	if !bytes.Equal(data.GetData(), testData) {
+		t.Error("LookupData failed: Wrong data returned")
+	}
+}
+
+// lookupContact returns a contact for the lookup tests, with an ID that starts with the byte b
+func lookupContact(b string) contact.T {
+	return contact.New(kademliaid.New(b+"00000000000000000000000000000000000000"), "node"+b)
+}
+
+func TestLookupInFlight(t *testing.T) {
+	target := kademliaid.New("0000000000000000000000000000000000000000")
+	slow := lookupContact("FF")
+	fast := lookupContact("F0")
+	var learned []contact.T
+	for i := 1; i <= 6; i++ {
+		learned = append(learned, lookupContact("0"+strconv.Itoa(i)))
+	}
+	// fails to answer and has to be dropped
+	dead := lookupContact("07")
+	release := make(chan struct{})
+	asked := make(chan struct{}, len(learned))
+	query := func(ctx context.Context, node *contact.T) (lookupReply, error) {
+		switch node.Address {
+		case slow.Address:
+			<-release
+			return lookupReply{}, nil
+		case fast.Address:
+			return lookupReply{contacts: append([]contact.T{dead}, learned...)}, nil
+		case dead.Address:
+			return lookupReply{}, errors.New("RPC timed out")
+		}
+		asked <- struct{}{}
+		return lookupReply{contacts: []contact.T{fast, slow}}, nil
+	}
+	l := newLookup(target, []contact.T{slow, fast}, query, nil)
+	done := make(chan struct{})
+	go func() {
+		l.run(context.Background())
+		close(done)
+	}()
+	// the slow node must not hold up the queries to the nodes learned from the fast one
+	for range learned {
+		select {
+		case <-asked:
+		case <-time.After(5 * time.Second):
+			t.Fatal("The lookup waited for the slow node")
+		}
+	}
+	select {
+	case <-done:
+		t.Fatal("The lookup ended before the slow node answered")
+	default:
+	}
+	close(release)
+	<-done
+	closest := l.closest()
+	expected := append(append([]contact.T(nil), learned...), fast, slow)
+	if len(closest) != len(expected) {
+		t.Fatalf("Expected %v contacts, got %v", len(expected), len(closest))
+	}
+	for i := range expected {
+		if *closest[i].ID != *expected[i].ID {
+			t.Errorf("Contact %v is %v, expected %v", i, closest[i].String(), expected[i].String())
+		}
+	}
+}
+
+func TestLookupDone(t *testing.T) {
+	target := kademliaid.New("0000000000000000000000000000000000000000")
+	a := lookupContact("80")
+	b := lookupContact("40")
+	c := lookupContact("20")
+	query := func(ctx context.Context, node *contact.T) (lookupReply, error) {
+		switch node.Address {
+		case a.Address:
+			return lookupReply{contacts: []contact.T{b}}, nil
+		case b.Address:
+			return lookupReply{contacts: []contact.T{c}}, nil
+		case c.Address:
+			return lookupReply{value: "found"}, nil
+		}
+		return lookupReply{}, nil
+	}
+	found := func(reply *lookupReply) bool {
+		return reply.value != nil
+	}
+	l := newLookup(target, []contact.T{a}, query, found)
+	reply, ok, _ := l.run(context.Background())
+	if !ok || reply.value != "found" {
+		t.Fatal("The lookup didn't end with the value")
+	}
+	if *reply.from.ID != *c.ID {
+		t.Error("The value came from", reply.from.String())
+	}
+	if hops := l.hops[*reply.from.ID] + 1; hops != 3 {
+		t.Error("Expected 3 hops, got", hops)
+	}
+}
+
+func TestDisjointLookup(t *testing.T) {
+	target := kademliaid.New("0000000000000000000000000000000000000000")
+	liar := lookupContact("10")
+	honest := lookupContact("20")
+	holder := lookupContact("08")
+	// closer than any real node, all at the address of the liar
+	var lies []contact.T
+	for i := 1; i <= constants.K; i++ {
+		lies = append(lies, contact.New(kademliaid.New(fmt.Sprintf("00%02x000000000000000000000000000000000000", i)), liar.Address))
+	}
+	for _, paths := range []int{1, 2} {
+		var mux sync.Mutex
+		queried := make(map[kademliaid.T]int)
+		lied := make(chan struct{}, len(lies)+1)
+		query := func(ctx context.Context, node *contact.T) (lookupReply, error) {
+			mux.Lock()
+			queried[*node.ID]++
+			mux.Unlock()
+			switch node.Address {
+			case liar.Address:
+				lied <- struct{}{}
+				return lookupReply{contacts: lies}, nil
+			case honest.Address:
+				// answers after the lies have been followed
+				for range lies {
+					<-lied
+				}
+				return lookupReply{contacts: []contact.T{holder, liar}}, nil
+			}
+			return lookupReply{value: "found"}, nil
+		}
+		found := func(reply *lookupReply) bool {
+			return reply.value != nil
+		}
+		l := newDisjointLookup(target, []contact.T{liar, honest}, paths, query, found)
+		_, ok, err := l.run(context.Background())
+		if err != nil {
+			t.Fatal("The lookup failed:", err)
+		}
+		if paths == 1 && ok {
+			t.Error("The lies didn't lead the lookup over one path astray")
+		}
+		if paths == 2 && !ok {
+			t.Error("The path that didn't ask the liar didn't find the value")
+		}
+		for id, n := range queried {
+			if n > 1 {
+				t.Errorf("%v was queried %v times over %v paths", id.String(), n, paths)
+			}
+		}
+	}
+}
+
+func TestLookupTrace(t *testing.T) {
+	target := kademliaid.New("0000000000000000000000000000000000000000")
+	a := lookupContact("80")
+	b := lookupContact("40")
+	dead := lookupContact("30")
+	c := lookupContact("20")
+	tr := newTracer(clock.Real, target)
+	query := func(ctx context.Context, node *contact.T) (lookupReply, error) {
+		switch node.Address {
+		case a.Address:
+			time.Sleep(5 * time.Millisecond)
+			return lookupReply{contacts: []contact.T{b, dead}}, nil
+		case b.Address:
+			return lookupReply{contacts: []contact.T{c}}, nil
+		case dead.Address:
+			return lookupReply{}, errors.New("timed out")
+		}
+		// c answers after the others were traced, queries still in flight when the lookup ends are not
+		for len(tr.get().Steps) < 3 {
+			time.Sleep(time.Millisecond)
+		}
+		return lookupReply{value: "found"}, nil
+	}
+	found := func(reply *lookupReply) bool {
+		return reply.value != nil
+	}
+	l := newDisjointLookup(target, []contact.T{a}, 1, query, found)
+	l.trace(tr)
+	if _, ok, _ := l.run(context.Background()); !ok {
+		t.Fatal("The lookup didn't find the value")
+	}
+	trace := tr.get()
+	if trace.Target != *target || len(trace.Steps) != 4 {
+		t.Fatalf("Expected 4 steps for %v, got %v", target.String(), trace)
+	}
+	steps := make(map[string]TraceStep)
+	for _, step := range trace.Steps {
+		steps[step.Contact.Address] = step
+	}
+	if s := steps[a.Address]; s.Round != 1 || len(s.Contacts) != 2 || s.RTT < 5*time.Millisecond || s.Distance != *a.ID {
+		t.Error("The first query was not traced right:", s)
+	}
+	if s := steps[b.Address]; s.Round != 2 || s.Err != nil || s.Found {
+		t.Error("The second query was not traced right:", s)
+	}
+	if s := steps[dead.Address]; s.Round != 2 || s.Err == nil {
+		t.Error("The failed query was not traced right:", s)
+	}
+	if s := steps[c.Address]; s.Round != 3 || !s.Found || trace.Steps[3].Contact.Address != c.Address {
+		t.Error("The query that found the value was not traced last:", s)
+	}
+}
+
+func TestBindThenJoin(t *testing.T) {
+	ct1 := contact.New(kademliaid.NewRandom(), "localhost:12900")
+	nw1 := New(&ct1)
+	if err := nw1.Bind(ct1.Address); err != nil {
+		t.Fatal("Bind failed:", err)
+	}
+	go nw1.Serve()
+	defer nw1.Close(context.Background())
+	ct2 := contact.New(kademliaid.NewRandom(), "localhost:12901")
+	nw2 := New(&ct2)
+	if err := nw2.Bind(ct2.Address); err != nil {
+		t.Fatal("Bind failed:", err)
+	}
+	go nw2.Serve()
+	defer nw2.Close(context.Background())
+	// right after binding, without waiting for Serve to start
+	if err := nw2.Join(ct1.Address); err != nil {
+		t.Error("Join failed:", err)
+	}
+	if _, ok := nw2.routingtable.GetContact(ct1.ID); !ok {
+		t.Error("The node joined through was not added to the routing table")
+	}
+}
@@ -0,0 +1,348 @@
+package kademlia
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+	"github.com/mjolnir92/kdfs/constants"
+	"github.com/mjolnir92/kdfs/contact"
+	"github.com/mjolnir92/kdfs/kademliaid"
+)
+
+//What a node answered during a lookup
+type lookupReply struct {
+	//The node that answered
+	from contact.T
+	//Contacts the node knows close to the target
+	contacts []contact.T
+	//Anything else the node answered, e.g. the value of a FIND_VALUE
+	value interface{}
+}
+
+//Asks node about the target of a lookup, e.g. with a FIND_NODE. Called from its own goroutine.
+type lookupQuery func(ctx context.Context, node *contact.T) (lookupReply, error)
+
+//Tells whether a reply finishes the lookup. Called for one reply at a time, so it may count replies without locking.
+type lookupDone func(reply *lookupReply) bool
+
+//An iterative lookup. It keeps ALPHA queries in flight to the closest candidates that haven't been asked yet,
+//a new one is started as soon as one returns, and ends when the K closest candidates have all answered
+//or done accepts a reply. Candidates that fail to answer are dropped. The lookup also ends when its context is done,
+//the queries still in flight when it ends are cancelled.
+//The lookup state is only touched by the goroutine that runs it, the queries only see copies of the contacts.
+type lookup struct {
+	target *kademliaid.T
+	query lookupQuery
+	done lookupDone
+	//Candidates that haven't failed, closest first
+	candidates []contact.T
+	//Every contact the lookup has seen, so that none is added twice
+	seen map[kademliaid.T]bool
+	queried map[kademliaid.T]bool
+	//Nodes that answered without a value, e.g. those that didn't have the value of a FIND_VALUE
+	answered []contact.T
+	//Hops it took to learn about each contact, 0 for those the lookup started with
+	hops map[kademliaid.T]int
+	//Shared with the other paths of a disjoint lookup, nil if there are none
+	claims *lookupClaims
+	//Index of the path in its disjoint lookup
+	path int
+	//Records the queries if the lookup is traced, nil if not
+	tracer *tracer
+}
+
+//The nodes claimed by the paths of a disjoint lookup, a node is only queried by the path that claimed it first
+type lookupClaims struct {
+	owner map[kademliaid.T]*lookup
+	mux sync.Mutex
+}
+
+func newLookup(target *kademliaid.T, start []contact.T, query lookupQuery, done lookupDone) *lookup {
+	l := &lookup{target: target, query: query, done: done, seen: make(map[kademliaid.T]bool), queried: make(map[kademliaid.T]bool), hops: make(map[kademliaid.T]int)}
+	l.add(start, 0)
+	return l
+}
+
+//Starts a lookup from the K closest contacts in the routing table, over Options.Paths disjoint paths
+func (t *T) newLookup(target *kademliaid.T, query lookupQuery, done lookupDone) *disjointLookup {
+	return newDisjointLookup(target, t.routingtable.FindClosestContacts(target, constants.K), t.options.Paths, query, done)
+}
+
+// add adds the contacts that haven't been seen yet as candidates, learned in the given hops
+func (l *lookup) add(contacts []contact.T, hops int) {
+	added := false
+	for _, c := range contacts {
+		if c.ID == nil || l.seen[*c.ID] {
+			continue
+		}
+		l.seen[*c.ID] = true
+		l.hops[*c.ID] = hops
+		c.CalcDistance(l.target)
+		l.candidates = append(l.candidates, c)
+		added = true
+	}
+	if added {
+		sort.Sort(contact.ByDist(l.candidates))
+	}
+}
+
+// remove drops a candidate that failed to answer
+func (l *lookup) remove(id *kademliaid.T) {
+	for i, c := range l.candidates {
+		if *c.ID == *id {
+			l.candidates = append(l.candidates[:i], l.candidates[i+1:]...)
+			return
+		}
+	}
+}
+
+// claim claims the node with ID id for this path, false if another path has already
+func (l *lookup) claim(id *kademliaid.T) bool {
+	if l.claims == nil {
+		return true
+	}
+	l.claims.mux.Lock()
+	defer l.claims.mux.Unlock()
+	owner, ok := l.claims.owner[*id]
+	if !ok {
+		l.claims.owner[*id] = l
+		return true
+	}
+	return owner == l
+}
+
+// next returns the closest of the K closest candidates that hasn't been queried, false if there is none.
+// Candidates that another path has claimed are dropped, they are that path's to ask.
+func (l *lookup) next() (contact.T, bool) {
+	for i := 0; i < len(l.candidates) && i < constants.K; {
+		c := l.candidates[i]
+		if l.queried[*c.ID] {
+			i++
+			continue
+		}
+		if !l.claim(c.ID) {
+			l.candidates = append(l.candidates[:i], l.candidates[i+1:]...)
+			continue
+		}
+		return c, true
+	}
+	return contact.T{}, false
+}
+
+type lookupResult struct {
+	reply lookupReply
+	err error
+}
+
+//Runs the lookup. Returns the reply that done accepted, false if the lookup ended without one.
+//If ctx ended the lookup, ctx.Err() is returned.
+func (l *lookup) run(ctx context.Context) (lookupReply, bool, error) {
+	queries, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// buffered for all the queries that can be in flight, those still running when the lookup is done don't block
+	results := make(chan lookupResult, constants.ALPHA)
+	inflight := 0
+	for {
+		for inflight < constants.ALPHA && ctx.Err() == nil {
+			node, ok := l.next()
+			if !ok {
+				break
+			}
+			l.queried[*node.ID] = true
+			inflight++
+			go func(node contact.T, round int) {
+				var start time.Time
+				if l.tracer != nil {
+					start = l.tracer.clock.Now()
+				}
+				reply, err := l.query(queries, &node)
+				reply.from = node
+				if l.tracer != nil {
+					l.tracer.record(l.path, round, start, &reply, err)
+				}
+				results <- lookupResult{reply, err}
+			}(node, l.hops[*node.ID]+1)
+		}
+		if ctx.Err() != nil {
+			return lookupReply{}, false, ctx.Err()
+		}
+		if inflight == 0 {
+			return lookupReply{}, false, nil
+		}
+		var res lookupResult
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			return lookupReply{}, false, ctx.Err()
+		}
+		inflight--
+		from := res.reply.from
+		if res.err != nil {
+			l.remove(from.ID)
+			continue
+		}
+		if l.done != nil && l.done(&res.reply) {
+			return res.reply, true, nil
+		}
+		if res.reply.value == nil {
+			l.answered = append(l.answered, from)
+		}
+		l.add(res.reply.contacts, l.hops[*from.ID]+1)
+	}
+}
+
+//Returns the K closest candidates. After run they have all answered, unless done ended the lookup early.
+func (l *lookup) closest() []contact.T {
+	if len(l.candidates) < constants.K {
+		return l.candidates
+	}
+	return l.candidates[:constants.K]
+}
+
+//A lookup over several disjoint paths, as in S/Kademlia. The contacts it starts with are dealt out to the paths,
+//which run at the same time and never query the same node, so that a node that lies about closer contacts
+//can only steer the paths that ask it. The lookup ends when all paths have, or one of them finds what done accepts.
+type disjointLookup struct {
+	paths []*lookup
+	claims *lookupClaims
+	//done is called by all paths, one at a time
+	mux sync.Mutex
+}
+
+func newDisjointLookup(target *kademliaid.T, start []contact.T, paths int, query lookupQuery, done lookupDone) *disjointLookup {
+	if paths < 1 {
+		paths = 1
+	}
+	d := &disjointLookup{claims: &lookupClaims{owner: make(map[kademliaid.T]*lookup)}}
+	if done != nil {
+		done = d.serialize(done)
+	}
+	sorted := append([]contact.T(nil), start...)
+	for i := range sorted {
+		sorted[i].CalcDistance(target)
+	}
+	sort.Sort(contact.ByDist(sorted))
+	// every path gets some of the closest contacts
+	dealt := make([][]contact.T, paths)
+	for i, c := range sorted {
+		dealt[i%paths] = append(dealt[i%paths], c)
+	}
+	for i := range dealt {
+		l := newLookup(target, dealt[i], query, done)
+		l.claims = d.claims
+		l.path = i
+		d.paths = append(d.paths, l)
+	}
+	return d
+}
+
+// trace has the paths record their queries with tr
+func (d *disjointLookup) trace(tr *tracer) {
+	for _, l := range d.paths {
+		l.tracer = tr
+	}
+}
+
+// serialize returns done guarded by the mutex of the lookup
+func (d *disjointLookup) serialize(done lookupDone) lookupDone {
+	return func(reply *lookupReply) bool {
+		d.mux.Lock()
+		defer d.mux.Unlock()
+		return done(reply)
+	}
+}
+
+type pathResult struct {
+	reply lookupReply
+	ok bool
+	err error
+}
+
+//Runs the paths. Returns the reply that done accepted, false if no path found one.
+//If ctx ended the lookup, ctx.Err() is returned.
+func (d *disjointLookup) run(ctx context.Context) (lookupReply, bool, error) {
+	if len(d.paths) == 1 {
+		return d.paths[0].run(ctx)
+	}
+	paths, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan pathResult, len(d.paths))
+	for _, l := range d.paths {
+		go func(l *lookup) {
+			reply, ok, err := l.run(paths)
+			results <- pathResult{reply, ok, err}
+		}(l)
+	}
+	var found pathResult
+	for range d.paths {
+		res := <-results
+		if res.ok && !found.ok {
+			found = res
+			// the other paths end as soon as they see it, they are waited for so that their state can be read
+			cancel()
+		}
+	}
+	if found.ok {
+		return found.reply, true, nil
+	}
+	return lookupReply{}, false, ctx.Err()
+}
+
+//Returns up to K contacts the paths found, taking the closest of each path in turn, so that a path that was led
+//astray by lying nodes can't crowd out the contacts of the others. With one path these are its K closest.
+func (d *disjointLookup) closest() []contact.T {
+	var closest []contact.T
+	added := make(map[kademliaid.T]bool)
+	for i := 0; len(closest) < constants.K; i++ {
+		more := false
+		for _, l := range d.paths {
+			if i >= len(l.candidates) {
+				continue
+			}
+			more = true
+			c := l.candidates[i]
+			if !added[*c.ID] && len(closest) < constants.K {
+				added[*c.ID] = true
+				closest = append(closest, c)
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return closest
+}
+
+//Returns how many nodes the paths queried
+func (d *disjointLookup) queried() int {
+	n := 0
+	for _, l := range d.paths {
+		n += len(l.queried)
+	}
+	return n
+}
+
+//Returns the hops it took to reach the node that sent reply
+func (d *disjointLookup) hops(reply *lookupReply) int {
+	d.claims.mux.Lock()
+	owner, ok := d.claims.owner[*reply.from.ID]
+	d.claims.mux.Unlock()
+	if !ok {
+		owner = d.paths[0]
+	}
+	return owner.hops[*reply.from.ID] + 1
+}
+
+//Returns the closest node that answered without a value, false if none did
+func (d *disjointLookup) closestAnswered() (contact.T, bool) {
+	var closest contact.T
+	for _, l := range d.paths {
+		for _, c := range l.answered {
+			if closest.ID == nil || c.Less(&closest) {
+				closest = c
+			}
+		}
+	}
+	return closest, closest.ID != nil
+}
@@ -0,0 +1,300 @@
+package kademlia
+
+import (
+	"context"
+	"log"
+	"sort"
+	"errors"
+	"time"
+	"github.com/mjolnir92/kdfs/kademliaid"
+	"github.com/mjolnir92/kdfs/contact"
+	"github.com/mjolnir92/kdfs/constants"
+	"github.com/mjolnir92/kdfs/clock"
+)
+
+// A node behind NAT advertises an address other nodes can't reach. PING_RESPONSE tells the pinging node the
+// address its ping arrived from, and a DIAL_BACK has another node ping us there: NAT only lets that ping in
+// if the address is publicly reachable, since we never sent anything to that node.
+//
+//	A --DIAL_BACK--> B --DIAL_BACK(Target: A at the address B saw)--> C --PING(Probe)--> A
+
+//What a node found out about how the other nodes see it
+type Reachability struct {
+	//The address most peers saw our pings arrive from, empty if no peer has reported one
+	Observed string
+	//Peers that reported Observed
+	Votes int
+	//A dial back was accepted, Reachable tells how it went. Without one nothing is known about Reachable.
+	Tested bool
+	//A node we never sent anything to reached us on Observed
+	Reachable bool
+	//Address of the relay we advertise because we are not reachable, empty if we don't use one
+	Relay string
+}
+
+// me returns a copy of contactMe, which changes when the node finds out its public address
+func (nw *T) me() contact.T {
+	nw.mux.Lock()
+	defer nw.mux.Unlock()
+	return *nw.contactMe
+}
+
+//An address a peer saw our ping arrive from
+type observation struct {
+	address string
+	at time.Time
+}
+
+// observe records the address peer saw our ping arrive from. Each IP address has one vote, so that a host can't
+// outvote the others with many IDs. Votes expire after OBSERVATION_TTL, of more than MAX_OBSERVERS the oldest goes.
+func (nw *T) observe(peer *contact.T, address string) {
+	if address == "" {
+		return
+	}
+	source := sourceHost(peer.Address)
+	now := nw.clock.Now()
+	nw.mux.Lock()
+	defer nw.mux.Unlock()
+	oldest := ""
+	for s, o := range nw.observed {
+		if now.Sub(o.at) > constants.OBSERVATION_TTL {
+			delete(nw.observed, s)
+		} else if oldest == "" || o.at.Before(nw.observed[oldest].at) {
+			oldest = s
+		}
+	}
+	if _, ok := nw.observed[source]; !ok && len(nw.observed) >= constants.MAX_OBSERVERS {
+		delete(nw.observed, oldest)
+	}
+	nw.observed[source] = observation{address: address, at: now}
+}
+
+//Returns the address most peers saw our pings arrive from and how many peers did, "" if nobody reported one
+func (nw *T) ObservedAddress() (string, int) {
+	now := nw.clock.Now()
+	nw.mux.Lock()
+	votes := make(map[string]int)
+	for _, o := range nw.observed {
+		if now.Sub(o.at) <= constants.OBSERVATION_TTL {
+			votes[o.address]++
+		}
+	}
+	nw.mux.Unlock()
+	addresses := make([]string, 0, len(votes))
+	for address := range votes {
+		addresses = append(addresses, address)
+	}
+	// sorted so that a tie is decided the same way every time
+	sort.Strings(addresses)
+	best := ""
+	for _, address := range addresses {
+		if best == "" || votes[address] > votes[best] {
+			best = address
+		}
+	}
+	return best, votes[best]
+}
+
+//Asks c to have another node ping us on the address c sees us on. Returns true if the ping arrived within constants.PROBE_TIMEOUT.
+func (nw *T) DialBack(ctx context.Context, c *contact.T) (bool, error) {
+	probe := *nw.newRandomID()
+	arrived := make(chan struct{})
+	nw.mux.Lock()
+	nw.probes[probe] = arrived
+	nw.mux.Unlock()
+	defer func() {
+		nw.mux.Lock()
+		delete(nw.probes, probe)
+		nw.mux.Unlock()
+	}()
+	msg := RPCDialBack{RPCType: DIAL_BACK, Version: PROTOCOL_VERSION, RPCID: *nw.newRandomID(), Sender: nw.me(), Probe: probe}
+	var res RPCDialBackResponse
+	err := nw.rpc(ctx, c, msg.RPCID, msg, &res)
+	if err != nil {
+		return false, err
+	}
+	switch res.Status {
+	case DIAL_BACK_NO_PEER:
+		return false, errors.New("Node has nobody to dial back from")
+	case DIAL_BACK_REFUSED:
+		return false, errors.New("The node that was to dial back refused")
+	}
+	select {
+	case <-arrived:
+		return true, nil
+	case <-clock.After(nw.clock, constants.PROBE_TIMEOUT):
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// probeArrived is called for every PING with a probe, returns false if it isn't one of ours
+func (nw *T) probeArrived(probe kademliaid.T) bool {
+	nw.mux.Lock()
+	defer nw.mux.Unlock()
+	arrived, ok := nw.probes[probe]
+	if ok {
+		delete(nw.probes, probe)
+		close(arrived)
+	}
+	return ok
+}
+
+// dialBackResponse handles a DIAL_BACK. Without a Target it comes from the node that wants to be probed and is passed on
+// to another node, with the address it arrived from as the target. With a Target the node pings it once, if the
+// request came from a node in its routing table.
+func (nw *T) dialBackResponse(codec Codec, b []byte, raddr string) {
+	var msg RPCDialBack
+	err := codec.Unmarshal(b, &msg)
+	if err != nil {
+		log.Printf("Failed to unmarshal into struct")
+		return
+	}
+	status := DIAL_BACK_ACCEPTED
+	if _, _, relayed := splitRelayed(raddr); relayed {
+		// we are behind NAT ourselves, we can't tell how the sender is seen
+		status = DIAL_BACK_NO_PEER
+	} else if msg.Target.ID == nil {
+		// only the address the request came from is probed, so that nodes can't be used to ping somebody else
+		target := msg.Sender
+		target.Address = raddr
+		target.Addrs = nil
+		if a, ok := contact.ParseAddr(raddr); ok {
+			target.Addrs = contact.Addrs{a}
+		}
+		helper, ok := nw.dialBackHelper(msg.Sender.ID)
+		// Close waits for the dial back to be passed on
+		if ok && nw.begin() {
+			forward := RPCDialBack{RPCType: DIAL_BACK, Version: PROTOCOL_VERSION, RPCID: *nw.newRandomID(), Sender: nw.me(), Probe: msg.Probe, Target: target}
+			// the sender waits for the status of the helper, so that it knows whether a probe is coming at all
+			nw.handling(msg.RPCID, raddr)
+			go func() {
+				defer nw.end()
+				defer nw.handled(msg.RPCID, raddr)
+				var res RPCDialBackResponse
+				status := DIAL_BACK_NO_PEER
+				err := nw.rpc(context.Background(), &helper, forward.RPCID, forward, &res)
+				if err != nil {
+					log.Printf("Failed to pass on dial back to %v: %v\n", helper.Address, err)
+				} else {
+					status = res.Status
+				}
+				nw.dialBackStatus(codec, &msg, status, raddr)
+			}()
+			return
+		}
+		status = DIAL_BACK_NO_PEER
+	} else if !nw.knownSender(&msg.Sender, raddr) {
+		// otherwise anybody could have us ping any address
+		status = DIAL_BACK_REFUSED
+	} else {
+		// a single ping, not through rpc(): it isn't retried, the target is not added to the routing table
+		// and it is not evicted if it isn't reachable
+		target := msg.Target
+		ping := RPCPing{RPCType: PING, Version: PROTOCOL_VERSION, RPCID: *nw.newRandomID(), Sender: nw.me(), Capabilities: nw.capabilities(), EncryptionKey: nw.encryptionKey(), Probe: msg.Probe}
+		b, err := nw.marshal(MsgPack, ping)
+		if err == nil {
+			err = nw.send(&target, ping.RPCID, b, 0)
+		}
+		if err != nil {
+			log.Printf("Failed to dial back to %v: %v\n", target.Address, err)
+		}
+	}
+	nw.dialBackStatus(codec, &msg, status, raddr)
+}
+
+// dialBackStatus responds to a DIAL_BACK with status
+func (nw *T) dialBackStatus(codec Codec, msg *RPCDialBack, status int, raddr string) {
+	response := RPCDialBackResponse{RPCType: DIAL_BACK_RESPONSE, Version: PROTOCOL_VERSION, RPCID: msg.RPCID, Sender: nw.me(), Status: status}
+	err := nw.respond(codec, msg.Sender.ID, msg.RPCID, response, raddr)
+	if err != nil {
+		log.Printf("Failed to respond to dial back: %v\n", err)
+	}
+}
+
+// knownSender tells whether the sender of a request from raddr is a node in our routing table
+func (nw *T) knownSender(sender *contact.T, raddr string) bool {
+	known, ok := nw.routingtable.GetContact(sender.ID)
+	return ok && sourceMatches(&known, raddr)
+}
+
+// dialBackHelper picks a node that can ping the node with ID id, other than that node itself
+func (nw *T) dialBackHelper(id *kademliaid.T) (contact.T, bool) {
+	for _, c := range nw.routingtable.FindClosestContacts(id, constants.K) {
+		capabilities, ok := nw.routingtable.GetCapabilities(c.ID)
+		if !c.ID.Equals(id) && ok && capabilities&CAP_DIAL_BACK != 0 {
+			return c, true
+		}
+	}
+	return contact.T{}, false
+}
+
+//Pings a few of the closest nodes to learn the address they see us on and has one of them dial back to it.
+//If the address is reachable and differs from the one we advertise, the node advertises it from now on.
+//If it is not, the node registers with a relay, if there is one among the nodes it knows. Nothing changes if no
+//dial back could be tested.
+func (nw *T) CheckReachability() Reachability {
+	var r Reachability
+	if !nw.begin() {
+		return r
+	}
+	defer nw.end()
+	me := nw.me()
+	peers := nw.routingtable.FindClosestContacts(me.ID, constants.REACHABILITY_PEERS)
+	for i := range peers {
+		nw.Ping(context.Background(), &peers[i])
+	}
+	r.Observed, r.Votes = nw.ObservedAddress()
+	if r.Observed == "" {
+		return r
+	}
+	for i := range peers {
+		capabilities, _ := nw.routingtable.GetCapabilities(peers[i].ID)
+		if capabilities&CAP_DIAL_BACK == 0 {
+			continue
+		}
+		reachable, err := nw.DialBack(context.Background(), &peers[i])
+		if err != nil {
+			continue
+		}
+		r.Tested = true
+		r.Reachable = reachable
+		break
+	}
+	if r.Reachable && me.Address != r.Observed {
+		log.Printf("Advertising %v instead of %v, it is what other nodes see\n", r.Observed, me.Address)
+		nw.stopRelay()
+		nw.setAddress(r.Observed)
+	}
+	// a check that didn't get a dial back going tells nothing, a reachable node would only detour through a relay
+	if r.Tested && !r.Reachable && nw.relaying.getRelay() == nil {
+		nw.findRelay()
+	}
+	if relay := nw.relaying.getRelay(); relay != nil {
+		r.Relay = relay.Address
+	}
+	return r
+}
+
+// setAddress makes address the one contactMe advertises. It replaces the address of the same family in Addrs.
+func (nw *T) setAddress(address string) {
+	nw.mux.Lock()
+	defer nw.mux.Unlock()
+	wasRelayed := nw.contactMe.Relayed
+	nw.contactMe.Address = address
+	nw.contactMe.Relayed = false
+	a, ok := contact.ParseAddr(address)
+	if !ok {
+		nw.contactMe.Addrs = nil
+		return
+	}
+	addrs := contact.Addrs{a}
+	for _, old := range nw.contactMe.Addrs {
+		// the addresses of a relay are not ours
+		if !wasRelayed && old.Addr().Is4() != a.Addr().Is4() {
+			addrs = append(addrs, old)
+		}
+	}
+	nw.contactMe.Addrs = addrs
+}
@@ -1,15 +1,18 @@
 package kademlia
 
 import (
-	"net"
+	"context"
+	"fmt"
 	"log"
 	"time"
-	"bufio"
+	"errors"
 	"github.com/mjolnir92/kdfs/kademliaid"
 	"github.com/mjolnir92/kdfs/contact"
 	"github.com/mjolnir92/kdfs/kvstore"
 	"github.com/mjolnir92/kdfs/constants"
-	"github.com/vmihailenco/msgpack"
+	"github.com/mjolnir92/kdfs/clock"
+	"github.com/mjolnir92/kdfs/transport"
+	"github.com/mjolnir92/kdfs/rtt"
 )
 
 const (
@@ -20,105 +23,389 @@ const (
 	FIND_VALUE = 4
 	FIND_VALUE_RESPONSE = 5
 	STORE = 6
+	FRAGMENT = 7
+	FRAGMENT_NACK = 8
+	STORE_RESPONSE = 9
+	ERROR = 10
+	DIAL_BACK = 11
+	DIAL_BACK_RESPONSE = 12
+	RELAY = 13
+	RELAY_REGISTER = 14
+	RELAY_REGISTER_RESPONSE = 15
 )
 
+// Nodes handle messages with versions from MIN_PROTOCOL_VERSION up to PROTOCOL_VERSION.
+// Other messages are answered with an ERROR with code ERROR_UNSUPPORTED_VERSION.
+const (
+	PROTOCOL_VERSION = 1
+	MIN_PROTOCOL_VERSION = 1
+)
+
+// Capabilities are exchanged in PING and PING_RESPONSE, each bit is a feature the node supports
+const (
+	CAP_FRAGMENT uint64 = 1 << iota
+	CAP_STORE_RESPONSE
+	CAP_PROTOBUF
+	// only nodes with an identity encrypt, it is not part of CAPABILITIES
+	CAP_ENCRYPTION
+	CAP_DIAL_BACK
+	// only nodes started as relays relay, it is not part of CAPABILITIES
+	CAP_RELAY
+	// snappy compressed messages, see compress.go
+	CAP_SNAPPY
+)
+
+// The capabilities of this version
+const CAPABILITIES = CAP_FRAGMENT | CAP_STORE_RESPONSE | CAP_PROTOBUF | CAP_DIAL_BACK | CAP_SNAPPY
+
+// Codes of an ERROR
+const (
+	ERROR_UNSUPPORTED_VERSION = 1
+)
+
+// Status of a STORE_RESPONSE
+const (
+	STORE_ACCEPTED = 0
+	// the value was not valid
+	STORE_REJECTED = 1
+	// the node already has the same or a newer version of the value
+	STORE_STALE = 2
+	// the node has no room for the value
+	STORE_OVER_QUOTA = 3
+	// the token is missing, expired or was given to another address
+	STORE_BAD_TOKEN = 4
+)
+
+// Status of a DIAL_BACK_RESPONSE
+const (
+	// the node passed the request on or sent the ping
+	DIAL_BACK_ACCEPTED = 0
+	// the node knows nobody else who could ping the sender
+	DIAL_BACK_NO_PEER = 1
+	// the request named a target but came from a node that is not in our routing table
+	DIAL_BACK_REFUSED = 2
+)
+
+// RPCID is a random transaction ID chosen by the caller. The responder copies it
+// into the response so that Listen can hand the response to the goroutine waiting for it.
 type RPCHeader struct {
 	RPCType int
+	Version int
+	RPCID kademliaid.T
 	Sender contact.T
 }
 
+// EncryptionKey is the X25519 key that RPCs to the sender are encrypted with, see encrypt.go
+// Probe is only set in pings sent for a DIAL_BACK, see nat.go
 type RPCPing struct {
 	RPCType int
+	Version int
+	RPCID kademliaid.T
 	Sender contact.T
+	Capabilities uint64
+	EncryptionKey []byte
+	Probe kademliaid.T
 }
 
+// ObservedAddress is the address the ping arrived from, which is not the sender's address if there is NAT in between
 type RPCPingResponse struct {
 	RPCType int
+	Version int
+	RPCID kademliaid.T
 	Sender contact.T
+	Capabilities uint64
+	EncryptionKey []byte
+	ObservedAddress string
+}
+
+// Target is empty when the node that wants to be probed sends it, and is set when it is passed on
+type RPCDialBack struct {
+	RPCType int
+	Version int
+	RPCID kademliaid.T
+	Sender contact.T
+	Probe kademliaid.T
+	Target contact.T
+}
+
+type RPCDialBackResponse struct {
+	RPCType int
+	Version int
+	RPCID kademliaid.T
+	Sender contact.T
+	Status int
+}
+
+// Data is a marshalled RPC for the node with ID Target, or a response for Address when Target is empty. See relay.go.
+type RPCRelay struct {
+	RPCType int
+	Version int
+	RPCID kademliaid.T
+	Sender contact.T
+	Target kademliaid.T
+	Address string
+	Data []byte
+}
+
+type RPCRelayRegister struct {
+	RPCType int
+	Version int
+	RPCID kademliaid.T
+	Sender contact.T
+}
+
+type RPCRelayRegisterResponse struct {
+	RPCType int
+	Version int
+	RPCID kademliaid.T
+	Sender contact.T
+	Status int
 }
 
 type RPCFindNode struct {
 	RPCType int
+	Version int
+	RPCID kademliaid.T
 	Sender contact.T
 	FindID kademliaid.T
 }
 
 type RPCFindNodeResponse struct {
 	RPCType int
+	Version int
+	RPCID kademliaid.T
 	Sender contact.T
 	Contacts []contact.T
+	// needed to STORE at the sender, see tokens.go
+	Token []byte
 }
 
 type RPCFindValue struct {
 	RPCType int
+	Version int
+	RPCID kademliaid.T
 	Sender contact.T
 	FindID kademliaid.T
 }
 
 type RPCFindValueResponse struct {
 	RPCType int
+	Version int
+	RPCID kademliaid.T
 	Sender contact.T
 	Value kvstore.Value
 	Contacts []contact.T
+	Token []byte
+	// the value is a copy from the cache of the node, not a replica it is responsible for
+	Cached bool
 }
 
 type RPCStore struct {
 	RPCType int
+	Version int
+	RPCID kademliaid.T
 	Sender contact.T
 	Value kvstore.Value
+	// from a FIND_NODE or FIND_VALUE response of the receiver
+	Token []byte
+	// the value is a copy for the receiver's cache, found by a lookup that passed the receiver
+	Cache bool
+}
+
+type RPCStoreResponse struct {
+	RPCType int
+	Version int
+	RPCID kademliaid.T
+	Sender contact.T
+	Status int
 }
 
+// RemoteError is returned by an RPC that was answered with an ERROR
+type RemoteError struct {
+	Code int
+	MinVersion int
+	MaxVersion int
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	if e.Code == ERROR_UNSUPPORTED_VERSION {
+		return fmt.Sprintf("%v, the node supports versions %v to %v", e.Message, e.MinVersion, e.MaxVersion)
+	}
+	return e.Message
+}
+
+// Sent instead of a response when a request can't be handled.
+// For ERROR_UNSUPPORTED_VERSION, MinVersion and MaxVersion are the versions the node can handle.
+type RPCError struct {
+	RPCType int
+	Version int
+	RPCID kademliaid.T
+	Sender contact.T
+	Code int
+	MinVersion int
+	MaxVersion int
+	Message string
+}
+
+// Listen opens a UDP socket on address and handles the RPCs that arrive on it
 func (nw *T) Listen(address string) {
-	b := make([]byte, 2048)
-	laddr, err := net.ResolveUDPAddr("udp", address)
+	err := nw.Bind(address)
+	if err == ErrClosed {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Error listening on %v: %v\n", address, err)
+	}
+	nw.Serve()
+}
+
+// ListenDualStack listens on an IPv4 and an IPv6 address, e.g. 0.0.0.0:1200 and [::]:1200, and serves RPCs until the node is closed
+func (nw *T) ListenDualStack(address4 string, address6 string) {
+	err := nw.BindDualStack(address4, address6)
+	if err == ErrClosed {
+		return
+	}
 	if err != nil {
-		log.Fatalf("Error listening on %v: %v\n", laddr, err)
+		log.Fatalf("Error listening on %v and %v: %v\n", address4, address6, err)
 	}
-	conn, err := net.ListenUDP("udp", laddr)
+	nw.Serve()
+}
+
+// Bind opens a UDP socket on address without handling what arrives on it, that is up to Serve.
+// RPCs can be sent once it returns, e.g. to Join before serving in another goroutine.
+func (nw *T) Bind(address string) error {
+	tr, err := transport.ListenUDP(address)
 	if err != nil {
-		log.Fatalf("Error listening on %v: %v\n", laddr, err)
+		return err
 	}
-	nw.conn = conn
+	return nw.bind(tr)
+}
+
+// BindDualStack is Bind for an IPv4 and an IPv6 address, see ListenDualStack
+func (nw *T) BindDualStack(address4 string, address6 string) error {
+	tr, err := transport.ListenDualUDP(address4, address6)
+	if err != nil {
+		return err
+	}
+	return nw.bind(tr)
+}
+
+func (nw *T) bind(tr transport.T) error {
+	nw.mux.Lock()
+	defer nw.mux.Unlock()
+	if nw.closed {
+		tr.Close()
+		return ErrClosed
+	}
+	nw.transport = tr
+	// a node that advertises a host name also advertises the IP it is bound to, host names are not resolved
+	// when checking where a request came from
+	if len(nw.contactMe.Addrs) == 0 {
+		if a, ok := contact.ParseAddr(tr.LocalAddr()); ok && !a.Addr().IsUnspecified() {
+			nw.contactMe.Addrs = contact.Addrs{a}
+		}
+	}
+	return nil
+}
+
+// Serve handles the RPCs that arrive on the node's transport. It returns when the transport is closed.
+func (nw *T) Serve() {
+	tr, err := nw.getTransport()
+	if err != nil {
+		log.Printf("Can't serve: %v\n", err)
+		return
+	}
+	nw.mux.Lock()
+	if nw.closed {
+		nw.mux.Unlock()
+		return
+	}
+	nw.serving.Add(1)
+	nw.mux.Unlock()
+	defer nw.serving.Done()
+	b := make([]byte, constants.MAX_DATAGRAM_SIZE)
 	for {
-		_, raddr, err := conn.ReadFromUDP(b)
+		n, raddr, err := tr.ReadFrom(b)
+		if err == transport.ErrClosed {
+			return
+		}
 		if err != nil {
-			log.Printf("Error reading UDP: %v", err)
+			log.Printf("Error reading from transport: %v", err)
+			continue
+		}
+		if nw.faults.dropReceived() {
 			continue
 		}
-		nw.resolveRPC(b, raddr)
+		// the buffer is reused for the next datagram, responses are passed on to other goroutines
+		message := make([]byte, n)
+		copy(message, b[:n])
+		nw.resolveRPC(message, raddr)
 	}
-	// unreachable
 }
 
-func (nw *T) send(c *contact.T, msg []byte) (*net.UDPConn, error) {
-	// TODO: contact should probably store the resolved address already
-	// right now it's a string (who wrote this sample code?!)
-	raddr, err := net.ResolveUDPAddr("udp", c.Address)
-	if err != nil {
-		return nil, err
-		log.Printf("Could not resolve address %v: %v", c.Address, err)
+func (nw *T) getTransport() (transport.T, error) {
+	nw.mux.Lock()
+	defer nw.mux.Unlock()
+	if nw.transport == nil {
+		return nil, errors.New("Not listening on any address")
 	}
-	conn, err := net.DialUDP("udp", nil, raddr)
-	if err != nil {
-		log.Printf("Error dialing %v: %v\n", raddr, err)
-		// TODO: do we need to close conn here too? might depend on the error
-		return nil, err
+	return nw.transport, nil
+}
+
+// addrsFor returns the addresses to try c on, in order. The address c was last heard from comes first,
+// followed by its other addresses of the families we listen on. Contacts without IP addresses are sent to Address.
+func (nw *T) addrsFor(c *contact.T) []string {
+	var addrs []string
+	me := nw.me()
+	last, ok := nw.routingtable.GetReachable(c.ID)
+	if ok && c.Addrs.Contains(last) {
+		addrs = append(addrs, last.String())
 	}
-	_, err = conn.Write(msg)
-	if err != nil {
-		conn.Close()
-		return nil, err
+	for _, a := range c.Addrs {
+		// a node without IP addresses of its own, e.g. on an in-memory transport, tries them all
+		reachable := len(me.Addrs) == 0 || me.Addrs.HasFamily(a)
+		if reachable && !(ok && a == last) {
+			addrs = append(addrs, a.String())
+		}
+	}
+	if len(addrs) == 0 {
+		return []string{c.Address}
+	}
+	return addrs
+}
+
+// send writes msg to the contact from the listening transport, so that the response arrives on the address we advertise.
+// The attempts go round the addresses of the contact, so that a retry uses the other family if the first one fails.
+// A relayed contact's addresses are those of its relay, which is asked to pass msg on.
+func (nw *T) send(c *contact.T, id kademliaid.T, msg []byte, attempt int) error {
+	if nw.faults.partitioned(nw.contactMe.ID, c.ID) {
+		// lost like any other datagram
+		return nil
+	}
+	addrs := nw.addrsFor(c)
+	if c.Relayed {
+		return nw.sendRelayed(id, msg, addrs[attempt%len(addrs)], *c.ID, "")
 	}
-	return conn, nil
+	return nw.writeTo(id, msg, addrs[attempt%len(addrs)])
 }
 
-func (nw *T) respond(msg interface{}, raddr *net.UDPAddr) error {
-	b, err := msgpack.Marshal(msg)
+// respond sends a response encoded with the codec the request arrived in.
+// The response is encrypted for the node with ID to, unless to is nil.
+func (nw *T) respond(codec Codec, to *kademliaid.T, id kademliaid.T, msg interface{}, raddr string) error {
+	b, err := nw.marshal(codec, msg)
+	if err == nil {
+		b, err = nw.seal(to, nw.compress(to, b))
+	}
 	if err != nil {
 		log.Printf("Error marshalling response: %v\n", err)
 		return err
 	}
-	_, err = nw.conn.WriteTo(b, raddr)
+	nw.cacheResponse(id, b, raddr)
+	if nw.faults.partitioned(nw.contactMe.ID, to) {
+		return nil
+	}
+	err = nw.writeTo(id, b, raddr)
 	if err != nil {
 		log.Printf("Error writing response: %v\n", err)
 		return err
@@ -126,84 +413,306 @@ func (nw *T) respond(msg interface{}, raddr *net.UDPAddr) error {
 	return nil
 }
 
-func (nw *T) receive(conn *net.UDPConn) ([]byte, error) {
-	// TODO: make this buffer size configurable somewhere
-	p := make([]byte, 2048)
-	conn.SetReadDeadline(time.Now().Add(constants.TIMEOUT))
-	_, err := bufio.NewReader(conn).Read(p)
+// Responses are kept for a while so that a request that is sent again gets the same response
+// instead of being handled twice. A STORE would be reported as stale the second time.
+// Responses that don't fit into RESPONSE_CACHE_SIZE any more are not kept, their requests are handled again.
+func (nw *T) cacheResponse(id kademliaid.T, b []byte, raddr string) {
+	key := transferKey{raddr, id}
+	nw.transfers.mux.Lock()
+	if nw.transfers.responsesSize+len(b) > constants.RESPONSE_CACHE_SIZE {
+		nw.transfers.mux.Unlock()
+		return
+	}
+	nw.transfers.responses[key] = b
+	nw.transfers.responsesSize += len(b)
+	nw.transfers.mux.Unlock()
+	nw.clock.AfterFunc(constants.TRANSFER_TIMEOUT, func() {
+		nw.transfers.mux.Lock()
+		delete(nw.transfers.responses, key)
+		nw.transfers.responsesSize -= len(b)
+		nw.transfers.mux.Unlock()
+	})
+}
+
+// handling marks a request that is handled in its own goroutine, so that it isn't handled a second time
+// if it is sent again before the response. Call handled when it is done.
+func (nw *T) handling(id kademliaid.T, raddr string) {
+	nw.transfers.mux.Lock()
+	nw.transfers.responses[transferKey{raddr, id}] = nil
+	nw.transfers.mux.Unlock()
+}
+
+// handled removes the mark of handling if no response was kept, the request is handled again if it is sent again
+func (nw *T) handled(id kademliaid.T, raddr string) {
+	key := transferKey{raddr, id}
+	nw.transfers.mux.Lock()
+	if b, ok := nw.transfers.responses[key]; ok && b == nil {
+		delete(nw.transfers.responses, key)
+	}
+	nw.transfers.mux.Unlock()
+}
+
+// resendResponse sends the cached response again if the request has already been handled.
+// Also true while the request is still being handled, the response follows when it is done.
+func (nw *T) resendResponse(id kademliaid.T, raddr string) bool {
+	nw.transfers.mux.Lock()
+	b, ok := nw.transfers.responses[transferKey{raddr, id}]
+	nw.transfers.mux.Unlock()
+	if !ok || b == nil {
+		return ok
+	}
+	err := nw.writeTo(id, b, raddr)
 	if err != nil {
-		return nil, err
+		log.Printf("Error writing response: %v\n", err)
+	}
+	return true
+}
+
+// A pendingRPC is an rpc waiting for its response.
+// progress is signalled while fragments of the response are arriving, so that large responses don't time out.
+type pendingRPC struct {
+	response chan []byte
+	progress chan struct{}
+}
+
+// await waits for the response. Returns nil if nothing arrived within timeout or ctx is done.
+func (p *pendingRPC) await(ctx context.Context, c clock.T, timeout time.Duration) []byte {
+	timer := c.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case rb := <-p.response:
+			return rb
+		case <-p.progress:
+			// a fragmented response is still arriving
+			timer.Reset(timeout)
+		case <-timer.C():
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// addPending registers a transaction ID and returns where its response will be delivered
+func (nw *T) addPending(id kademliaid.T) *pendingRPC {
+	p := &pendingRPC{response: make(chan []byte, 1), progress: make(chan struct{}, 1)}
+	nw.mux.Lock()
+	nw.pending[id] = p
+	nw.mux.Unlock()
+	return p
+}
+
+func (nw *T) removePending(id kademliaid.T) {
+	nw.mux.Lock()
+	delete(nw.pending, id)
+	nw.mux.Unlock()
+}
+
+// dispatchResponse passes a response to the rpc waiting for it. Returns false if nobody is waiting.
+func (nw *T) dispatchResponse(header *RPCHeader, message []byte) bool {
+	nw.mux.Lock()
+	defer nw.mux.Unlock()
+	p, ok := nw.pending[header.RPCID]
+	if !ok {
+		return false
+	}
+	select {
+	case p.response <- message:
+	default:
+		// a response was already delivered, this one is a duplicate
 	}
-	return p, nil
+	return true
 }
 
-func (nw *T) rpc(c *contact.T, msg interface{}, response interface{}) (error) {
-	header, err := nw.rpcNoRefresh(c, msg, response)
+// notifyProgress tells the rpc waiting for id, if any, that part of its response has arrived.
+// Returns false if no rpc waits for id.
+func (nw *T) notifyProgress(id kademliaid.T) bool {
+	nw.mux.Lock()
+	defer nw.mux.Unlock()
+	p, ok := nw.pending[id]
+	if !ok {
+		return false
+	}
+	select {
+	case p.progress <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+//Sends an rpc and adds the node that answered to the routingtable. A node that doesn't answer is evicted,
+//unless ctx ended the rpc before it could.
+func (nw *T) rpc(ctx context.Context, c *contact.T, id kademliaid.T, msg interface{}, response interface{}) (error) {
+	if _, ping := msg.(RPCPing); !ping && nw.needsKeyExchange(c) {
+		// the encryption keys are exchanged in pings
+		err := nw.Ping(ctx, c)
+		if err != nil {
+			return err
+		}
+	}
+	estimate := nw.rttEstimate(c)
+	header, err := nw.rpcNoRefresh(ctx, c, id, estimate, msg, response)
+	if err != nil && err == ctx.Err() {
+		// the node may well be alive, we stopped waiting for it
+		return err
+	}
 	if err != nil {
+		if nw.encryption != nil {
+			// the node may have restarted with a new key
+			nw.encryption.dropPeer(c.ID)
+		}
 		nw.routingtable.EvictAndReplace(*c)
 		return err
 	}
+	if c.PublicKey != nil && *header.Sender.ID != *c.ID {
+		// the response is signed by some other node, the contact is not at this address
+		nw.routingtable.EvictAndReplace(*c)
+		return errors.New("RPC was answered by another node")
+	}
+	// the estimate stays with the contact if it is new to the routing table
+	header.Sender.RTT = estimate
 	nw.routingtable.AddContact(header.Sender)
 	return nil
 }
 
+// rttEstimate returns the round trip time estimate for c, which is kept with the contact in the routing table
+func (nw *T) rttEstimate(c *contact.T) *rtt.T {
+	if c.RTT != nil {
+		return c.RTT
+	}
+	known, ok := nw.routingtable.GetContact(c.ID)
+	if ok && known.RTT != nil {
+		return known.RTT
+	}
+	return rtt.New()
+}
+
 //Sends an rpc without updating the routingtable of this node.
-func (nw *T) rpcNoRefresh(c *contact.T, msg interface{}, response interface{}) (*RPCHeader, error) {
-	b, err := msgpack.Marshal(msg)
-	if err != nil {
-		log.Printf("Error marshalling FindNode RPC: %v\n", err)
-		return nil, err
+//id has to be the RPCID of msg, it is used to match the response to this call.
+//The RPC is sent again up to Options.Retries times, doubling the timeout every time.
+//If ctx is done before the response arrives, the RPC is given up and ctx.Err() returned.
+func (nw *T) rpcNoRefresh(ctx context.Context, c *contact.T, id kademliaid.T, estimate *rtt.T, msg interface{}, response interface{}) (*RPCHeader, error) {
+	if !nw.begin() {
+		return nil, ErrClosed
 	}
-	conn, err := nw.send(c, b)
-	if err != nil {
-		return nil, err
+	defer nw.end()
+	b, err := nw.marshal(nw.codecFor(c), msg)
+	if _, ping := msg.(RPCPing); !ping && err == nil {
+		b, err = nw.seal(c.ID, nw.compress(c.ID, b))
 	}
-	defer conn.Close()
-	rb, err := nw.receive(conn)
 	if err != nil {
+		log.Printf("Error marshalling RPC: %v\n", err)
 		return nil, err
 	}
-	err = msgpack.Unmarshal(rb, response)
-	if err != nil {
-		return nil, err
+	p := nw.addPending(id)
+	defer nw.removePending(id)
+	var rb []byte
+	for attempt := 0; attempt <= nw.options.Retries && rb == nil; attempt++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		sent := nw.clock.Now()
+		err = nw.send(c, id, b, attempt)
+		if err != nil {
+			return nil, err
+		}
+		timeout := estimate.Timeout() << uint(attempt)
+		if timeout > constants.MAX_TIMEOUT {
+			timeout = constants.MAX_TIMEOUT
+		}
+		rb = p.await(ctx, nw.clock, timeout)
+		// Karn's algorithm: after a retry we can't tell which attempt the response belongs to
+		if rb != nil && attempt == 0 {
+			estimate.Update(clock.Since(nw.clock, sent))
+		}
+	}
+	if rb == nil && ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
+	if rb == nil {
+		return nil, errors.New("RPC timed out")
+	}
+	// the node may not use the same codec as us
+	codec := detectCodec(rb)
 	// TODO: avoid unmarshalling twice somehow
-	// this one is only used to update our routing table
+	// the header is used to update our routing table
 	var header RPCHeader
-	err = msgpack.Unmarshal(rb, &header)
+	err = codec.Unmarshal(rb, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.RPCType == ERROR {
+		var e RPCError
+		err = codec.Unmarshal(rb, &e)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &RemoteError{Code: e.Code, MinVersion: e.MinVersion, MaxVersion: e.MaxVersion, Message: e.Message}
+	}
+	err = codec.Unmarshal(rb, response)
 	if err != nil {
 		return nil, err
 	}
 	return &header, nil
 }
 
-func (nw *T) Ping(c *contact.T) error {
-	msg := RPCPing{RPCType: PING, Sender: *nw.contactMe}
+// codecFor returns the codec to send requests to c with.
+// Options.Codec is used unless we know that c doesn't support it.
+func (nw *T) codecFor(c *contact.T) Codec {
+	if nw.options.Codec != Protobuf {
+		return nw.options.Codec
+	}
+	capabilities, ok := nw.routingtable.GetCapabilities(c.ID)
+	if ok && capabilities&CAP_PROTOBUF == 0 {
+		return MsgPack
+	}
+	return nw.options.Codec
+}
+
+func (nw *T) Ping(ctx context.Context, c *contact.T) error {
+	msg := RPCPing{RPCType: PING, Version: PROTOCOL_VERSION, RPCID: *nw.newRandomID(), Sender: nw.me(), Capabilities: nw.capabilities(), EncryptionKey: nw.encryptionKey()}
 	var res RPCPingResponse
-	err := nw.rpc(c, msg, &res)
+	err := nw.rpc(ctx, c, msg.RPCID, msg, &res)
 	if err != nil {
 		return err
 	}
 	// routing table is updated as a side effect of receiving the response
+	nw.routingtable.SetCapabilities(res.Sender.ID, res.Capabilities)
+	nw.observe(c, res.ObservedAddress)
+	if nw.encryption != nil {
+		// the response was signed, so the key belongs to the node
+		nw.encryption.setPeer(res.Sender.ID, res.EncryptionKey)
+	}
 	return nil
 }
 
-func (nw *T) FindNode(c *contact.T, findID *kademliaid.T) ([]contact.T, error) {
-	msg := RPCFindNode{RPCType: FIND_NODE, Sender: *nw.contactMe, FindID: *findID}
+func (nw *T) FindNode(ctx context.Context, c *contact.T, findID *kademliaid.T) ([]contact.T, error) {
+	msg := RPCFindNode{RPCType: FIND_NODE, Version: PROTOCOL_VERSION, RPCID: *nw.newRandomID(), Sender: nw.me(), FindID: *findID}
 	var res RPCFindNodeResponse
-	err := nw.rpc(c, msg, &res)
+	err := nw.rpc(ctx, c, msg.RPCID, msg, &res)
 	if err != nil {
 		return nil, err
 	}
-	return res.Contacts, nil
+	nw.storeTokens.put(*c.ID, res.Token)
+	return nw.admitted(res.Contacts), nil
+}
+
+// admitted removes the contacts that don't solve the puzzles, so that lookups don't follow them
+func (nw *T) admitted(contacts []contact.T) []contact.T {
+	ok := make([]contact.T, 0, len(contacts))
+	for _, c := range contacts {
+		if nw.routingtable.Admits(c) {
+			ok = append(ok, c)
+		}
+	}
+	return ok
 }
 
 // FindValue returns the value if it was found or some []contacts if it wasn't.
 // The third return value is a bool that is true if the value was found.
-func (nw *T) FindValue(c *contact.T, findID *kademliaid.T) (kvstore.Value, []contact.T, bool, error) {
-	msg := RPCFindValue{RPCType: FIND_VALUE, Sender: *nw.contactMe, FindID: *findID}
-	var res RPCFindValueResponse
-	err := nw.rpc(c, msg, &res)
+func (nw *T) FindValue(ctx context.Context, c *contact.T, findID *kademliaid.T) (kvstore.Value, []contact.T, bool, error) {
+	res, err := nw.findValue(ctx, c, findID)
 	if err != nil {
 		var v kvstore.Value
 		return v, nil, false, err
@@ -211,134 +720,387 @@ func (nw *T) FindValue(c *contact.T, findID *kademliaid.T) (kvstore.Value, []con
 	if len(res.Value.GetData()) == 0 {
 		// node did not have the key
 		var v kvstore.Value
-		return v, res.Contacts, false, nil
+		return v, nw.admitted(res.Contacts), false, nil
 	}
 	return res.Value, nil, true, nil
 }
 
-func (nw *T) Store(c *contact.T, val *kvstore.Value) error {
-	msg := RPCStore{RPCType: STORE, Sender: *nw.contactMe, Value: *val}
-	// not using rpc() since this rpc doesn't need a response
-	b, err := msgpack.Marshal(msg)
+// findValue returns the response of the node, with contacts that are not admitted to the routing table left in
+func (nw *T) findValue(ctx context.Context, c *contact.T, findID *kademliaid.T) (RPCFindValueResponse, error) {
+	msg := RPCFindValue{RPCType: FIND_VALUE, Version: PROTOCOL_VERSION, RPCID: *nw.newRandomID(), Sender: nw.me(), FindID: *findID}
+	var res RPCFindValueResponse
+	err := nw.rpc(ctx, c, msg.RPCID, msg, &res)
 	if err != nil {
-		log.Printf("Error marshalling Store RPC: %v\n", err)
-		return err
+		return res, err
+	}
+	nw.storeTokens.put(*c.ID, res.Token)
+	return res, nil
+}
+
+// Store returns the status the node responded with, STORE_ACCEPTED if the value was stored.
+// The node wants a token from a FIND_NODE or FIND_VALUE response. A lookup usually got one already,
+// otherwise a FIND_NODE is sent first.
+func (nw *T) Store(ctx context.Context, c *contact.T, val *kvstore.Value) (int, error) {
+	return nw.storeOrCache(ctx, c, val, false)
+}
+
+// Cache asks the node to keep a copy of the value in its cache, like Store does for values the node is responsible for.
+// The copy expires sooner the further the node is from the key and is never republished.
+func (nw *T) Cache(ctx context.Context, c *contact.T, val *kvstore.Value) (int, error) {
+	return nw.storeOrCache(ctx, c, val, true)
+}
+
+func (nw *T) storeOrCache(ctx context.Context, c *contact.T, val *kvstore.Value, cache bool) (int, error) {
+	status, err := nw.store(ctx, c, val, cache)
+	if err == nil && status == STORE_BAD_TOKEN {
+		// the token expired, or the node restarted
+		nw.storeTokens.forget(*c.ID)
+		status, err = nw.store(ctx, c, val, cache)
 	}
-	conn, err := nw.send(c, b)
+	return status, err
+}
+
+func (nw *T) store(ctx context.Context, c *contact.T, val *kvstore.Value, cache bool) (int, error) {
+	token := nw.storeTokens.get(*c.ID)
+	if token == nil {
+		_, err := nw.FindNode(ctx, c, kademliaid.NewHash(val.GetData()))
+		if err != nil {
+			return STORE_REJECTED, err
+		}
+		token = nw.storeTokens.get(*c.ID)
+	}
+	msg := RPCStore{RPCType: STORE, Version: PROTOCOL_VERSION, RPCID: *nw.newRandomID(), Sender: nw.me(), Value: *val, Token: token, Cache: cache}
+	var res RPCStoreResponse
+	err := nw.rpc(ctx, c, msg.RPCID, msg, &res)
 	if err != nil {
-		return err
+		return STORE_REJECTED, err
 	}
-	conn.Close()
-	return nil
+	return res.Status, nil
 }
 
-func (nw *T) resolveRPC(message []byte, raddr *net.UDPAddr) {
+func (nw *T) resolveRPC(message []byte, raddr string) {
+	message, encryptionKey, err := nw.open(message)
+	if err != nil {
+		log.Printf("Unable to decrypt message from %v: %v\n", raddr, err)
+		return
+	}
+	// the type of a compressed message is only known once it is decompressed, which takes more work.
+	// Not logged, a flood would fill the log.
+	if compressed(message) && !nw.admission.admitSource(raddr) {
+		return
+	}
+	message, err = decompress(message)
+	if err != nil {
+		log.Printf("Unable to decompress message from %v: %v\n", raddr, err)
+		return
+	}
+	message, signature, err := unframe(message)
+	if err != nil {
+		log.Printf("Unable to unpack message from %v: %v\n", raddr, err)
+		return
+	}
 	// We have to unmarshal the rest of the message after we know what type it is
 	// TODO: find a way to unmarshal to the right type immediately
+	codec := detectCodec(message)
 	var header RPCHeader
-	err := msgpack.Unmarshal(message, &header)
+	err = codec.Unmarshal(message, &header)
 	if err != nil {
 		log.Printf("Unable to unpack message from %v: %v\n", raddr, err)
 		return
 	}
+	if header.Version < MIN_PROTOCOL_VERSION || header.Version > PROTOCOL_VERSION {
+		// the rest of the message may not look like we expect, only answer requests so that two nodes can't keep erroring at each other
+		switch header.RPCType {
+		case PING, FIND_NODE, FIND_VALUE, STORE, DIAL_BACK, RELAY_REGISTER:
+			nw.unsupportedVersion(codec, &header, raddr)
+		}
+		return
+	}
+	if nw.faults.partitioned(nw.contactMe.ID, header.Sender.ID) {
+		return
+	}
+	switch header.RPCType {
+	case FRAGMENT:
+		// the routing table is updated once the whole message has arrived
+		nw.fragmentReceived(codec, message, raddr)
+		return
+	case FRAGMENT_NACK:
+		nw.fragmentNack(codec, message, raddr)
+		return
+	}
+	switch header.RPCType {
+	case PING, FIND_NODE, FIND_VALUE, STORE, DIAL_BACK, RELAY, RELAY_REGISTER:
+		// checked before the signature, which takes more work. Not logged, a flood would fill the log.
+		if !nw.admission.admit(header.RPCType, raddr) {
+			return
+		}
+	}
+	err = nw.verify(&header, message, signature)
+	if err == nil {
+		err = nw.checkEncryption(&header, encryptionKey)
+	}
+	if err != nil {
+		log.Printf("Dropping RPC from %v: %v\n", raddr, err)
+		return
+	}
+	if a, ok := contact.ParseAddr(raddr); ok && header.Sender.Addrs.Contains(a) {
+		// the sender listens on this address and it works, requests to it will be sent there first
+		nw.routingtable.SetReachable(header.Sender.ID, a)
+	}
+	switch header.RPCType {
+	case PING_RESPONSE, FIND_NODE_RESPONSE, FIND_VALUE_RESPONSE, STORE_RESPONSE, DIAL_BACK_RESPONSE, RELAY_REGISTER_RESPONSE, ERROR:
+		// the routing table is updated by rpc() once the response has been handled
+		if !nw.dispatchResponse(&header, message) {
+			log.Printf("Dropping response from %v, no matching request\n", raddr)
+		}
+		return
+	}
+	// requests are ignored once the node is closing, responses are still needed by the RPCs in progress
+	if !nw.begin() {
+		return
+	}
+	defer nw.end()
+	if header.RPCType == RELAY {
+		// the routing table is updated when the RPC inside is handled
+		nw.relayReceived(codec, message, raddr)
+		return
+	}
+	if nw.resendResponse(header.RPCID, raddr) {
+		// the request was sent again, our response must have been lost
+		return
+	}
 	switch header.RPCType {
 	case PING:
-		nw.pingResponse(raddr)
+		nw.pingResponse(codec, message, raddr)
 	case FIND_NODE:
-		nw.findNodeResponse(message, raddr)
+		nw.findNodeResponse(codec, message, raddr)
 	case FIND_VALUE:
-		nw.findValueResponse(message, raddr)
+		nw.findValueResponse(codec, message, raddr)
+	case DIAL_BACK:
+		nw.dialBackResponse(codec, message, raddr)
+	case RELAY_REGISTER:
+		nw.relayRegisterResponse(codec, message, raddr)
 	case STORE:
-		nw.storeResponse(message)
+		// stores of large values take a while, the other requests don't have to wait for them
+		if !nw.begin() {
+			return
+		}
+		if !nw.admission.acquireStore() {
+			nw.end()
+			return
+		}
+		nw.handling(header.RPCID, raddr)
+		go func() {
+			defer nw.end()
+			defer nw.admission.releaseStore()
+			defer nw.handled(header.RPCID, raddr)
+			nw.storeResponse(codec, message, raddr)
+			nw.addSender(&header.Sender, raddr)
+		}()
+		return
 	default:
 		log.Printf("Unknown RPC: %v\n", header.RPCType)
 		// garbage message, don't update routing table
 		return
 	}
-	nw.routingtable.AddContact(header.Sender)
+	nw.addSender(&header.Sender, raddr)
 }
 
-func (nw *T) storeResponse(b []byte) {
+// addSender adds the sender of a request from raddr to the routing table, if the request came from an address it advertises
+func (nw *T) addSender(sender *contact.T, raddr string) {
+	if !sourceMatches(sender, raddr) {
+		log.Printf("Not adding %v to the routing table, its request came from %v\n", sender.Address, raddr)
+		return
+	}
+	nw.routingtable.AddContact(*sender)
+}
+
+func (nw *T) unsupportedVersion(codec Codec, header *RPCHeader, raddr string) {
+	msg := RPCError{RPCType: ERROR, Version: PROTOCOL_VERSION, RPCID: header.RPCID, Sender: nw.me(), Code: ERROR_UNSUPPORTED_VERSION, MinVersion: MIN_PROTOCOL_VERSION, MaxVersion: PROTOCOL_VERSION, Message: "Unsupported protocol version"}
+	err := nw.respond(codec, nil, header.RPCID, msg, raddr)
+	if err != nil {
+		log.Printf("Failed to respond with error: %v\n", err)
+	}
+}
+
+func (nw *T) storeResponse(codec Codec, b []byte, raddr string) {
 	var msg RPCStore
-	err := msgpack.Unmarshal(b, &msg)
+	err := codec.Unmarshal(b, &msg)
 	if err != nil {
 		log.Printf("Failed to unmarshal into struct")
 		return
 	}
-	
-	id := kademliaid.NewHash(msg.Value.GetData())
+	status := STORE_BAD_TOKEN
+	if nw.tokens.valid(msg.Token, raddr) {
+		if msg.Cache {
+			status = nw.cacheValue(msg.Value)
+		} else {
+			status = nw.storeValue(msg.Value)
+		}
+	}
+	response := RPCStoreResponse{RPCType: STORE_RESPONSE, Version: PROTOCOL_VERSION, RPCID: msg.RPCID, Sender: nw.me(), Status: status}
+	err = nw.respond(codec, msg.Sender.ID, msg.RPCID, response, raddr)
+	if err != nil {
+		log.Printf("Failed to respond to store: %v\n", err)
+	}
+}
+
+// storeValue stores a value sent by another node and schedules its republishing and expiry
+func (nw *T) storeValue(value kvstore.Value) int {
+	if len(value.GetData()) == 0 {
+		return STORE_REJECTED
+	}
+
+	id := kademliaid.NewHash(value.GetData())
 	repub := func() {
-		contacts := nw.LookupContact(id)
+		contacts, _ := nw.LookupContact(context.Background(), id)
 		for i := 0; i < len(contacts); i++ {
-			go nw.Store(&contacts[i], &msg.Value)
+			go nw.Store(context.Background(), &contacts[i], &value)
 		}
 	}
 	expire := func() {
 		nw.eventmanager.DeleteEvent(*id, constants.REPUBLISH)
-		nw.kvstore.Remove(msg.Value)
+		nw.kvstore.Remove(value)
 		nw.eventmanager.DeleteEvent(*id, constants.EXPIRE) //removes some garbage
 	}
 
-	//msg.Value will only be inserted if the timestamp is newer
-	ok := nw.kvstore.Store(msg.Value)
-	if ok {
-		if msg.Value.GetPin() == true {
-			nw.eventmanager.DeleteEvent(*id, constants.EXPIRE)
-			nw.eventmanager.InsertEvent(*id, constants.REPUBLISH, repub, constants.REPUBLISH_TIME)
-		} else {
-			expireDate := msg.Value.Timestamp.Add(constants.EXPIRE_TIME)
-			untilExpireDate := time.Until(expireDate)
-			nw.eventmanager.InsertEvent(*id, constants.EXPIRE, expire, untilExpireDate)
-			nw.eventmanager.InsertEvent(*id, constants.REPUBLISH, repub, constants.REPUBLISH_TIME)
+	//value will only be inserted if the timestamp is newer
+	err := nw.kvstore.Store(value)
+	switch err {
+	case kvstore.ErrStale:
+		return STORE_STALE
+	case kvstore.ErrOverQuota:
+		return STORE_OVER_QUOTA
+	}
+	if value.GetPin() == true {
+		nw.eventmanager.DeleteEvent(*id, constants.EXPIRE)
+		nw.eventmanager.InsertEvent(*id, constants.REPUBLISH, repub, constants.REPUBLISH_TIME)
+	} else {
+		expireDate := value.Timestamp.Add(constants.EXPIRE_TIME)
+		untilExpireDate := expireDate.Sub(nw.clock.Now())
+		nw.eventmanager.InsertEvent(*id, constants.EXPIRE, expire, untilExpireDate)
+		nw.eventmanager.InsertEvent(*id, constants.REPUBLISH, repub, constants.REPUBLISH_TIME)
+	}
+	return STORE_ACCEPTED
+}
+
+// cacheValue keeps a copy of a value that a lookup found, and schedules its expiry
+func (nw *T) cacheValue(value kvstore.Value) int {
+	if len(value.GetData()) == 0 {
+		return STORE_REJECTED
+	}
+
+	id := kademliaid.NewHash(value.GetData())
+	expire := func() {
+		nw.kvstore.RemoveCached(value)
+		nw.eventmanager.DeleteEvent(*id, constants.CACHE_EXPIRE)
+	}
+
+	err := nw.kvstore.StoreCached(value)
+	switch err {
+	case kvstore.ErrStale:
+		return STORE_STALE
+	case kvstore.ErrOverQuota:
+		return STORE_OVER_QUOTA
+	}
+	nw.eventmanager.DeleteEvent(*id, constants.CACHE_EXPIRE)
+	nw.eventmanager.InsertEvent(*id, constants.CACHE_EXPIRE, expire, nw.cacheExpiry(id))
+	return STORE_ACCEPTED
+}
+
+// cacheExpiry returns how long a copy of the value with the given key is cached: CACHE_EXPIRE_TIME halved for every
+// contact we know that is closer to the key than us, so that copies far from the key, which lookups seldom pass, go first
+func (nw *T) cacheExpiry(key *kademliaid.T) time.Duration {
+	me := nw.me()
+	distance := me.ID.CalcDistance(key)
+	expiry := constants.CACHE_EXPIRE_TIME
+	for _, c := range nw.routingtable.FindKClosestContacts(key) {
+		if c.ID.CalcDistance(key).Less(distance) {
+			expiry /= 2
 		}
 	}
+	if expiry < constants.MIN_CACHE_EXPIRE_TIME {
+		return constants.MIN_CACHE_EXPIRE_TIME
+	}
+	return expiry
 }
 
-func (nw *T) pingResponse(raddr *net.UDPAddr) {
-	msg := RPCPingResponse{RPCType: PING_RESPONSE, Sender: *nw.contactMe}
-	err := nw.respond(msg, raddr)
+func (nw *T) pingResponse(codec Codec, b []byte, raddr string) {
+	var ping RPCPing
+	err := codec.Unmarshal(b, &ping)
 	if err != nil {
-		log.Println("Failed to respond to ping: %v\n", err)
+		log.Printf("Failed to unmarshal into struct")
+		return
+	}
+	nw.routingtable.SetCapabilities(ping.Sender.ID, ping.Capabilities)
+	if nw.encryption != nil {
+		nw.encryption.setPeer(ping.Sender.ID, ping.EncryptionKey)
+	}
+	if ping.Probe != (kademliaid.T{}) && nw.probeArrived(ping.Probe) {
+		log.Printf("Dial back from %v arrived, we are reachable\n", raddr)
+		// the helper sent it without waiting for a response, it would only drop one
+		return
+	}
+	msg := RPCPingResponse{RPCType: PING_RESPONSE, Version: PROTOCOL_VERSION, RPCID: ping.RPCID, Sender: nw.me(), Capabilities: nw.capabilities(), EncryptionKey: nw.encryptionKey()}
+	if _, _, relayed := splitRelayed(raddr); !relayed {
+		// the address of a relayed ping is the relay's
+		msg.ObservedAddress = raddr
+	}
+	err = nw.respond(codec, nil, ping.RPCID, msg, raddr)
+	if err != nil {
+		log.Printf("Failed to respond to ping: %v\n", err)
 	}
 }
 
-func (nw *T) findValueResponse(b []byte, raddr *net.UDPAddr) {
+func (nw *T) findValueResponse(codec Codec, b []byte, raddr string) {
 	var msg RPCFindValue
-	err := msgpack.Unmarshal(b, &msg)
+	err := codec.Unmarshal(b, &msg)
 	if err != nil {
 		log.Printf("Failed to unmarshal into struct")
 		return
 	}
 	val, ok := nw.kvstore.Get(msg.FindID)
-	if ok {
+	cached := false
+	if !ok {
+		val, ok = nw.kvstore.GetCached(msg.FindID)
+		cached = ok
+	}
+	lying := nw.faults.lying()
+	if ok && !lying {
 		contacts := []contact.T{}
-		msg := RPCFindValueResponse{RPCType: FIND_VALUE_RESPONSE, Sender: *nw.contactMe, Value: val, Contacts: contacts}
-		err := nw.respond(msg, raddr)
+		response := RPCFindValueResponse{RPCType: FIND_VALUE_RESPONSE, Version: PROTOCOL_VERSION, RPCID: msg.RPCID, Sender: nw.me(), Value: val, Contacts: contacts, Token: nw.tokens.token(raddr), Cached: cached}
+		err := nw.respond(codec, msg.Sender.ID, msg.RPCID, response, raddr)
 		if err != nil {
-			log.Println("Failed to respond with value: %v\n", err)
+			log.Printf("Failed to respond with value: %v\n", err)
 		}
 	} else {
 		// if we can't find it, treat it like a FindNode RPC
 		contacts := nw.routingtable.FindKClosestContacts(&msg.FindID)
-		response := RPCFindValueResponse{RPCType: FIND_VALUE_RESPONSE, Sender: *nw.contactMe, Contacts: contacts}
-		err = nw.respond(response, raddr)
+		if lying {
+			contacts = nw.lies(&msg.FindID)
+		}
+		response := RPCFindValueResponse{RPCType: FIND_VALUE_RESPONSE, Version: PROTOCOL_VERSION, RPCID: msg.RPCID, Sender: nw.me(), Contacts: contacts, Token: nw.tokens.token(raddr)}
+		err = nw.respond(codec, msg.Sender.ID, msg.RPCID, response, raddr)
 		if err != nil {
-			log.Println("Failed to respond with contacts: %v\n", err)
+			log.Printf("Failed to respond with contacts: %v\n", err)
 		}
 	}
 }
 
-func (nw *T) findNodeResponse(b []byte, raddr *net.UDPAddr) {
+func (nw *T) findNodeResponse(codec Codec, b []byte, raddr string) {
 	var msg RPCFindNode
-	err := msgpack.Unmarshal(b, &msg)
+	err := codec.Unmarshal(b, &msg)
 	if err != nil {
 		log.Printf("Failed to unmarshal into struct")
 		return
 	}
 	contacts := nw.routingtable.FindKClosestContacts(&msg.FindID)
-	response := RPCFindNodeResponse{RPCType: FIND_NODE_RESPONSE, Sender: *nw.contactMe, Contacts: contacts}
-	err = nw.respond(response, raddr)
+	if nw.faults.lying() {
+		contacts = nw.lies(&msg.FindID)
+	}
+	response := RPCFindNodeResponse{RPCType: FIND_NODE_RESPONSE, Version: PROTOCOL_VERSION, RPCID: msg.RPCID, Sender: nw.me(), Contacts: contacts, Token: nw.tokens.token(raddr)}
+	err = nw.respond(codec, msg.Sender.ID, msg.RPCID, response, raddr)
 	if err != nil {
-		log.Println("Failed to respond with contacts: %v\n", err)
+		log.Printf("Failed to respond with contacts: %v\n", err)
 	}
 }
@@ -2,13 +2,25 @@ package kademlia
 
 import (
 	"log"
+	"fmt"
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
 	"bytes"
+	"encoding/binary"
 	"testing"
 	"time"
 	"github.com/mjolnir92/kdfs/kademliaid"
 	"github.com/mjolnir92/kdfs/contact"
 	"github.com/mjolnir92/kdfs/kvstore"
+	"github.com/mjolnir92/kdfs/constants"
+	"github.com/mjolnir92/kdfs/transport"
+	"github.com/mjolnir92/kdfs/rtt"
+	"github.com/mjolnir92/kdfs/clock"
+	"github.com/mjolnir92/kdfs/identity"
 	"github.com/vmihailenco/msgpack"
+	"github.com/golang/snappy"
 )
 
 func TestRPCs(t *testing.T) {
@@ -23,11 +35,14 @@ func TestRPCs(t *testing.T) {
 	nw_server := New(&ct_server)
 	nw_server.routingtable.AddContact(ct_client)
 	go nw_server.Listen("localhost:12300")
-	// TODO: clean up the Listen goroutine
+	// responses are sent back to the socket the client listens on
+	go nw_client.Listen("localhost:12310")
+	defer nw_server.Close(context.Background())
+	defer nw_client.Close(context.Background())
 	// Wait a bit so the server is ready
 	time.Sleep(50 * time.Millisecond)
 	t.Run("Ping", func(t *testing.T) {
-		err := nw_client.Ping(&ct_server)
+		err := nw_client.Ping(context.Background(), &ct_server)
 		if err != nil {
 			t.Error("Ping returned an error:", err)
 		}
@@ -37,8 +52,48 @@ func TestRPCs(t *testing.T) {
 			t.Error("Server was not added to routing table after Ping")
 		}
 	})
+	t.Run("ConcurrentPing", func(t *testing.T) {
+		// all RPCs share the client's socket, every response has to find its way back to the right caller
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			go func() {
+				errs <- nw_client.Ping(context.Background(), &ct_server)
+			}()
+		}
+		for i := 0; i < 10; i++ {
+			if err := <-errs; err != nil {
+				t.Error("Concurrent Ping returned an error:", err)
+			}
+		}
+		if len(nw_client.pending) != 0 {
+			t.Error("Pending requests were not removed after the responses arrived")
+		}
+	})
+	t.Run("Capabilities", func(t *testing.T) {
+		// the capabilities are exchanged on PING and PING_RESPONSE
+		caps, ok := nw_client.routingtable.GetCapabilities(id_server)
+		if !ok || caps != CAPABILITIES {
+			t.Errorf("Client doesn't know the server's capabilities, got %v %v\n", caps, ok)
+		}
+		caps, ok = nw_server.routingtable.GetCapabilities(id_client)
+		if !ok || caps != CAPABILITIES {
+			t.Errorf("Server doesn't know the client's capabilities, got %v %v\n", caps, ok)
+		}
+	})
+	t.Run("UnsupportedVersion", func(t *testing.T) {
+		msg := RPCPing{RPCType: PING, Version: PROTOCOL_VERSION + 1, RPCID: *kademliaid.NewRandom(), Sender: ct_client}
+		var res RPCPingResponse
+		_, err := nw_client.rpcNoRefresh(context.Background(), &ct_server, msg.RPCID, rtt.New(), msg, &res)
+		remote, ok := err.(*RemoteError)
+		if !ok {
+			t.Fatal("Expected an error from the server, got", err)
+		}
+		if remote.Code != ERROR_UNSUPPORTED_VERSION || remote.MinVersion != MIN_PROTOCOL_VERSION || remote.MaxVersion != PROTOCOL_VERSION {
+			t.Errorf("Unexpected error from the server: %+v\n", remote)
+		}
+	})
 	t.Run("FindNode", func(t *testing.T) {
-		contacts, err := nw_client.FindNode(&ct_server, id_client)
+		contacts, err := nw_client.FindNode(context.Background(), &ct_server, id_client)
 		if err != nil {
 			t.Error("FindNode returned an error:", err)
 		}
@@ -52,7 +107,7 @@ func TestRPCs(t *testing.T) {
 		stored_val := kvstore.NewValue(true, []byte{255,128,0})
 		id_val := kademliaid.NewHash(stored_val.GetData())
 		// value is not yet stored on the server
-		value, contacts, gotData, err := nw_client.FindValue(&ct_server, id_val)
+		value, contacts, gotData, err := nw_client.FindValue(context.Background(), &ct_server, id_val)
 		if err != nil {
 			t.Error("FindValue returned an error:", err)
 		}
@@ -69,7 +124,7 @@ func TestRPCs(t *testing.T) {
 		// value is stored on the server
 		log.Println("now starting real findvalue test")
 		nw_server.kvstore.Store(stored_val)
-		value, contacts, gotData, err = nw_client.FindValue(&ct_server, id_val)
+		value, contacts, gotData, err = nw_client.FindValue(context.Background(), &ct_server, id_val)
 		if err != nil {
 			t.Error("FindValue returned an error:", err)
 		} else if gotData != true {
@@ -84,15 +139,55 @@ func TestRPCs(t *testing.T) {
 		if _, ok := nw_server.kvstore.Get(*id_val); ok {
 			t.Error("Test setup for Store is flawed: the value was already stored on server.")
 		}
-		nw_client.Store(&ct_server, &stored_val)
-		// Wait so server has a chance to process the RPC
-		time.Sleep(50 * time.Millisecond)
+		status, err := nw_client.Store(context.Background(), &ct_server, &stored_val)
+		if err != nil {
+			t.Error("Store returned an error:", err)
+		} else if status != STORE_ACCEPTED {
+			t.Error("Store was not accepted, status", status)
+		}
 		val, ok := nw_server.kvstore.Get(*id_val)
 		if !ok {
 			t.Error("The key was not stored after Store RPC")
 		} else if val.GetPin() != stored_val.GetPin() {
 			t.Error("The stored value has the wrong pin state")
 		}
+		// storing the same version again should be reported as stale
+		status, err = nw_client.Store(context.Background(), &ct_server, &stored_val)
+		if err != nil {
+			t.Error("Store returned an error:", err)
+		} else if status != STORE_STALE {
+			t.Error("Storing the same value twice should be stale, status", status)
+		}
+		empty := kvstore.NewValue(false, []byte{})
+		status, err = nw_client.Store(context.Background(), &ct_server, &empty)
+		if err != nil {
+			t.Error("Store returned an error:", err)
+		} else if status != STORE_REJECTED {
+			t.Error("Storing an empty value should be rejected, status", status)
+		}
+	})
+	t.Run("LargeValue", func(t *testing.T) {
+		// a value this size has to be sent in fragments both when it is stored and when it is found
+		data := make([]byte, 3*1024*1024)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		stored_val := kvstore.NewValue(false, data)
+		id_val := kademliaid.NewHash(data)
+		status, err := nw_client.Store(context.Background(), &ct_server, &stored_val)
+		if err != nil {
+			t.Fatal("Store returned an error:", err)
+		} else if status != STORE_ACCEPTED {
+			t.Fatal("Store was not accepted, status", status)
+		}
+		value, _, gotData, err := nw_client.FindValue(context.Background(), &ct_server, id_val)
+		if err != nil {
+			t.Error("FindValue returned an error:", err)
+		} else if !gotData {
+			t.Error("Large value was not found")
+		} else if !bytes.Equal(value.GetData(), data) {
+			t.Error("Large value was corrupted in transfer")
+		}
 	})
 }
 
@@ -124,3 +219,1270 @@ func TestMarshal(t *testing.T) {
 		}
 	}
 }
+
+// lossyTransport drops the first datagram written to each address
+type lossyTransport struct {
+	transport.T
+	seen map[string]bool
+	mux sync.Mutex
+}
+
+func (l *lossyTransport) WriteTo(b []byte, address string) error {
+	l.mux.Lock()
+	first := !l.seen[address]
+	l.seen[address] = true
+	l.mux.Unlock()
+	if first {
+		return nil
+	}
+	return l.T.WriteTo(b, address)
+}
+
+// reset makes the transport lose the next datagram to each address again
+func (l *lossyTransport) reset() {
+	l.mux.Lock()
+	l.seen = make(map[string]bool)
+	l.mux.Unlock()
+}
+
+func TestRetry(t *testing.T) {
+	network := transport.NewNetwork()
+	tr_client, _ := network.Listen("client")
+	tr_server, _ := network.Listen("server")
+	ct_client := contact.New(kademliaid.New("1000000000000000000000000000000000000000"), "client")
+	ct_server := contact.New(kademliaid.New("0000000000000000000000000000000000000000"), "server")
+	lossy_client := &lossyTransport{T: tr_client, seen: make(map[string]bool)}
+	nw_client := NewWithTransport(&ct_client, lossy_client)
+	// the server loses its first response, the client has to send the request again
+	lossy_server := &lossyTransport{T: tr_server, seen: make(map[string]bool)}
+	nw_server := NewWithTransport(&ct_server, lossy_server)
+	go nw_client.Serve()
+	go nw_server.Serve()
+
+	val := kvstore.NewValue(false, []byte("sent twice"))
+	// the token for the STORE, after that the first datagrams are lost again
+	_, err := nw_client.FindNode(context.Background(), &ct_server, kademliaid.NewHash(val.GetData()))
+	if err != nil {
+		t.Fatal("FindNode failed although it was retried:", err)
+	}
+	lossy_client.reset()
+	lossy_server.reset()
+	status, err := nw_client.Store(context.Background(), &ct_server, &val)
+	if err != nil {
+		t.Fatal("Store failed although it was retried:", err)
+	}
+	if status != STORE_ACCEPTED {
+		t.Error("The retried Store should get the response to the first attempt, got status", status)
+	}
+	got, ok := nw_client.routingtable.GetContact(ct_server.ID)
+	if !ok {
+		t.Fatal("Server was not added to the routing table")
+	}
+	if _, _, samples := got.RTT.Stats(); samples != 0 {
+		t.Error("A retried RPC should not be used to estimate the round trip time")
+	}
+	err = nw_client.Ping(context.Background(), &ct_server)
+	if err != nil {
+		t.Fatal("Ping failed:", err)
+	}
+	if _, _, samples := got.RTT.Stats(); samples != 1 {
+		t.Error("The round trip time estimate was not updated, samples:", samples)
+	}
+}
+
+func TestProtobuf(t *testing.T) {
+	sender := contact.New(kademliaid.New("1000000000000000000000000000000000000000"), "10.0.0.1:1200")
+	other := contact.New(kademliaid.NewRandom(), "localhost:12310")
+	val := kvstore.NewValue(true, []byte{255, 240, 0})
+	expected := RPCFindValueResponse{RPCType: FIND_VALUE_RESPONSE, Version: PROTOCOL_VERSION, RPCID: *kademliaid.NewRandom(), Sender: sender, Value: val, Contacts: []contact.T{sender, other}}
+	b, err := Protobuf.Marshal(expected)
+	if err != nil {
+		t.Fatal("Marshal failed:", err)
+	}
+	if detectCodec(b) != Protobuf {
+		t.Error("The protobuf message was not recognized")
+	}
+	mb, _ := MsgPack.Marshal(expected)
+	if detectCodec(mb) != MsgPack {
+		t.Error("The msgpack message was not recognized")
+	}
+	if len(b) >= len(mb) {
+		t.Errorf("The protobuf message (%v bytes) should be smaller than the msgpack one (%v bytes)", len(b), len(mb))
+	}
+	var got RPCFindValueResponse
+	err = Protobuf.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatal("Unmarshal failed:", err)
+	}
+	if got.RPCType != expected.RPCType || got.Version != expected.Version || got.RPCID != expected.RPCID || *got.Sender.ID != *sender.ID || got.Sender.Address != sender.Address {
+		t.Errorf("Header was not decoded correctly.\nexpected\n%v\ngot\n%v\n", expected, got)
+	}
+	if !got.Value.Timestamp.Equal(val.Timestamp) || got.Value.Pin != val.Pin || !bytes.Equal(got.Value.Data, val.Data) {
+		t.Errorf("Value was not decoded correctly.\nexpected\n%v\ngot\n%v\n", val, got.Value)
+	}
+	if len(got.Contacts) != 2 || got.Contacts[1].Address != other.Address || *got.Contacts[1].ID != *other.ID {
+		t.Errorf("Contacts were not decoded correctly: %v", got.Contacts)
+	}
+	// PING is type 0 and still has to be recognized
+	ping, _ := Protobuf.Marshal(RPCPing{RPCType: PING, Sender: sender})
+	var header RPCHeader
+	if detectCodec(ping) != Protobuf || Protobuf.Unmarshal(ping, &header) != nil || header.RPCType != PING {
+		t.Error("PING was not encoded correctly")
+	}
+	cache, _ := Protobuf.Marshal(RPCStore{RPCType: STORE, Sender: sender, Value: val, Token: []byte{1, 2}, Cache: true})
+	var store RPCStore
+	if Protobuf.Unmarshal(cache, &store) != nil || !store.Cache || !bytes.Equal(store.Token, []byte{1, 2}) {
+		t.Error("STORE to a cache was not encoded correctly")
+	}
+	cached, _ := Protobuf.Marshal(RPCFindValueResponse{RPCType: FIND_VALUE_RESPONSE, Sender: sender, Value: val, Cached: true})
+	var response RPCFindValueResponse
+	if Protobuf.Unmarshal(cached, &response) != nil || !response.Cached {
+		t.Error("A cached FIND_VALUE_RESPONSE was not encoded correctly")
+	}
+
+	// a node that sends protobuf can talk to one that sends msgpack
+	network := transport.NewNetwork()
+	tr_client, _ := network.Listen("client")
+	tr_server, _ := network.Listen("server")
+	ct_client := contact.New(kademliaid.New("1000000000000000000000000000000000000000"), "client")
+	ct_server := contact.New(kademliaid.New("0000000000000000000000000000000000000000"), "server")
+	options := DefaultOptions()
+	options.Transport = tr_client
+	options.Codec = Protobuf
+	nw_client := NewWithOptions(&ct_client, options)
+	nw_server := NewWithTransport(&ct_server, tr_server)
+	go nw_client.Serve()
+	go nw_server.Serve()
+	large := kvstore.NewValue(false, bytes.Repeat([]byte("protobuf"), 10000))
+	status, err := nw_client.Store(context.Background(), &ct_server, &large)
+	if err != nil || status != STORE_ACCEPTED {
+		t.Fatal("Store over protobuf failed:", status, err)
+	}
+	value, _, found, err := nw_client.FindValue(context.Background(), &ct_server, kademliaid.NewHash(large.Data))
+	if err != nil || !found || !bytes.Equal(value.Data, large.Data) {
+		t.Error("FindValue over protobuf failed:", err)
+	}
+	contacts, err := nw_client.FindNode(context.Background(), &ct_server, ct_client.ID)
+	if err != nil || len(contacts) == 0 || *contacts[0].ID != *ct_client.ID {
+		t.Error("FindNode over protobuf failed:", err)
+	}
+}
+
+func TestSignedRPCs(t *testing.T) {
+	network := transport.NewNetwork()
+	// signedNode starts a node with a new identity at address, its ID is derived from the key
+	signedNode := func(address string, codec Codec) (*T, contact.T) {
+		ident, _ := identity.New()
+		tr, _ := network.Listen(address)
+		ct := contact.New(ident.ID(), address)
+		options := DefaultOptions()
+		options.Transport = tr
+		options.Codec = codec
+		options.Identity = ident
+		// a rejected RPC is never answered, don't wait for it more than once
+		options.Retries = 0
+		nw := NewWithOptions(&ct, options)
+		go nw.Serve()
+		return nw, ct
+	}
+	nw_alice, ct_alice := signedNode("alice", MsgPack)
+	nw_bob, ct_bob := signedNode("bob", Protobuf)
+	_, ct_carol := signedNode("carol", MsgPack)
+
+	err := nw_alice.Ping(context.Background(), &ct_bob)
+	if err != nil {
+		t.Fatal("Ping between signed nodes failed:", err)
+	}
+	got, ok := nw_bob.routingtable.GetContact(ct_alice.ID)
+	if !ok || !bytes.Equal(got.PublicKey, ct_alice.PublicKey) {
+		t.Error("The public key was not sent with the contact")
+	}
+	// the signed message is fragmented and verified after it has been reassembled
+	large := kvstore.NewValue(false, bytes.Repeat([]byte("signed"), 10000))
+	status, err := nw_bob.Store(context.Background(), &ct_alice, &large)
+	if err != nil || status != STORE_ACCEPTED {
+		t.Error("Signed Store of a large value failed:", status, err)
+	}
+
+	// a node without an identity can't talk to a node that requires signatures
+	tr_mallory, _ := network.Listen("mallory")
+	ct_mallory := contact.New(kademliaid.NewRandom(), "mallory")
+	options := DefaultOptions()
+	options.Transport = tr_mallory
+	options.Retries = 0
+	nw_mallory := NewWithOptions(&ct_mallory, options)
+	go nw_mallory.Serve()
+	if nw_mallory.Ping(context.Background(), &ct_alice) == nil {
+		t.Error("An unsigned Ping was answered")
+	}
+
+	// a node can't claim an ID that is not derived from its key
+	ident, _ := identity.New()
+	tr_eve, _ := network.Listen("eve")
+	ct_eve := contact.New(ct_bob.ID, "eve")
+	options.Transport = tr_eve
+	options.Identity = ident
+	nw_eve := NewWithOptions(&ct_eve, options)
+	go nw_eve.Serve()
+	if nw_eve.Ping(context.Background(), &ct_alice) == nil {
+		t.Error("A Ping with a stolen ID was answered")
+	}
+
+	// the response has to be signed by the node we meant to contact
+	impostor := ct_bob
+	impostor.Address = ct_carol.Address
+	if nw_alice.Ping(context.Background(), &impostor) == nil {
+		t.Error("A response from another node was accepted")
+	}
+}
+
+func TestPuzzleContacts(t *testing.T) {
+	network := transport.NewNetwork()
+	puzzle := kademliaid.Puzzle{Static: 4, Dynamic: 8}
+	node := func(address string, ident *identity.T) (*T, contact.T) {
+		tr, _ := network.Listen(address)
+		ct := contact.New(ident.ID(), address)
+		options := DefaultOptions()
+		options.Transport = tr
+		options.Identity = ident
+		options.Puzzle = puzzle
+		nw := NewWithOptions(&ct, options)
+		go nw.Serve()
+		return nw, ct
+	}
+	ident, _ := identity.NewWithPuzzle(puzzle)
+	nw_alice, ct_alice := node("alice", ident)
+	if !puzzle.Check(ct_alice.ID, &ct_alice.Nonce) {
+		t.Fatal("The node did not solve the dynamic puzzle")
+	}
+	ident, _ = identity.NewWithPuzzle(puzzle)
+	nw_bob, ct_bob := node("bob", ident)
+	// find a key whose ID doesn't solve the static puzzle
+	ident, _ = identity.New()
+	for puzzle.CheckStatic(ident.ID()) {
+		ident, _ = identity.New()
+	}
+	_, ct_mallory := node("mallory", ident)
+
+	if err := nw_alice.Ping(context.Background(), &ct_bob); err != nil {
+		t.Fatal("Ping failed:", err)
+	}
+	if _, ok := nw_alice.routingtable.GetContact(ct_bob.ID); !ok {
+		t.Error("A contact that solves the puzzles was not added")
+	}
+	if _, ok := nw_bob.routingtable.GetContact(ct_alice.ID); !ok {
+		t.Error("A contact that solves the puzzles was not added by the responder")
+	}
+	// the RPC itself works, the node just doesn't make it into the routing table
+	if err := nw_alice.Ping(context.Background(), &ct_mallory); err != nil {
+		t.Fatal("Ping failed:", err)
+	}
+	if _, ok := nw_alice.routingtable.GetContact(ct_mallory.ID); ok {
+		t.Error("A contact that doesn't solve the static puzzle was added")
+	}
+	// and lookups don't follow it
+	nw_bob.routingtable.SetPuzzle(kademliaid.Puzzle{})
+	nw_bob.routingtable.AddContact(ct_mallory)
+	contacts, err := nw_alice.FindNode(context.Background(), &ct_bob, ct_mallory.ID)
+	if err != nil {
+		t.Fatal("FindNode failed:", err)
+	}
+	for _, c := range contacts {
+		if *c.ID == *ct_mallory.ID {
+			t.Error("FindNode returned a contact that doesn't solve the puzzles")
+		}
+	}
+}
+
+// recordingTransport keeps a copy of every datagram that is sent
+type recordingTransport struct {
+	transport.T
+	sent [][]byte
+	// where each of sent went
+	to []string
+	mux sync.Mutex
+}
+
+func (r *recordingTransport) WriteTo(b []byte, address string) error {
+	r.mux.Lock()
+	r.sent = append(r.sent, append([]byte(nil), b...))
+	r.to = append(r.to, address)
+	r.mux.Unlock()
+	return r.T.WriteTo(b, address)
+}
+
+func TestEncryption(t *testing.T) {
+	network := transport.NewNetwork()
+	node := func(address string) (*T, contact.T, *recordingTransport) {
+		ident, _ := identity.New()
+		tr, _ := network.Listen(address)
+		rec := &recordingTransport{T: tr}
+		ct := contact.New(ident.ID(), address)
+		options := DefaultOptions()
+		options.Transport = rec
+		options.Identity = ident
+		nw := NewWithOptions(&ct, options)
+		go nw.Serve()
+		return nw, ct, rec
+	}
+	nw_alice, ct_alice, rec_alice := node("alice")
+	nw_bob, ct_bob, rec_bob := node("bob")
+
+	// the keys are exchanged before the first store
+	secret := bytes.Repeat([]byte("top secret "), 1000)
+	val := kvstore.NewValue(false, secret)
+	status, err := nw_alice.Store(context.Background(), &ct_bob, &val)
+	if err != nil || status != STORE_ACCEPTED {
+		t.Fatal("Encrypted Store failed:", status, err)
+	}
+	if nw_alice.encryption.peer(ct_bob.ID) == nil || nw_bob.encryption.peer(ct_alice.ID) == nil {
+		t.Error("The encryption keys were not exchanged")
+	}
+	value, _, found, err := nw_alice.FindValue(context.Background(), &ct_bob, kademliaid.NewHash(secret))
+	if err != nil || !found || !bytes.Equal(value.Data, secret) {
+		t.Error("Encrypted FindValue failed:", err)
+	}
+	for _, rec := range []*recordingTransport{rec_alice, rec_bob} {
+		rec.mux.Lock()
+		for _, b := range rec.sent {
+			if bytes.Contains(b, []byte("top secret")) {
+				t.Error("The value was sent in the clear")
+				break
+			}
+		}
+		rec.mux.Unlock()
+	}
+
+	// a node that restarts gets a new key, the keys are exchanged again after the first failed RPC
+	nw_bob.encryption, _ = newSessions()
+	nw_alice.options.Retries = 0
+	if _, _, _, err = nw_alice.FindValue(context.Background(), &ct_bob, kademliaid.NewHash(secret)); err == nil {
+		t.Error("An RPC encrypted with an old key was answered")
+	}
+	_, _, found, err = nw_alice.FindValue(context.Background(), &ct_bob, kademliaid.NewHash(secret))
+	if err != nil || !found {
+		t.Error("The keys were not exchanged again:", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	network := transport.NewNetwork()
+	tr_client, _ := network.Listen("client")
+	tr_server, _ := network.Listen("server")
+	ct_client := contact.New(kademliaid.New("1000000000000000000000000000000000000000"), "client")
+	ct_server := contact.New(kademliaid.New("0000000000000000000000000000000000000000"), "server")
+	options := DefaultOptions()
+	options.Transport = tr_client
+	// a dropped request is never answered, don't wait for it more than once
+	options.Retries = 0
+	nw_client := NewWithOptions(&ct_client, options)
+	options = DefaultOptions()
+	options.Transport = tr_server
+	options.Limits.SourceRate = 0.001
+	options.Limits.SourceBurst = 3
+	nw_server := NewWithOptions(&ct_server, options)
+	go nw_client.Serve()
+	go nw_server.Serve()
+
+	for i := 0; i < 3; i++ {
+		if err := nw_client.Ping(context.Background(), &ct_server); err != nil {
+			t.Fatal("A ping within the burst failed:", err)
+		}
+	}
+	if nw_client.Ping(context.Background(), &ct_server) == nil {
+		t.Error("A ping over the limit was answered")
+	}
+	if stats := nw_server.Stats(); stats.DroppedSource != 1 {
+		t.Error("Expected 1 request dropped because of its source, got", stats.DroppedSource)
+	}
+
+	a := newAdmission(Limits{TypeRate: 0.001, TypeBurst: 1, MaxStores: 1})
+	if !a.admit(FIND_NODE, "10.0.0.1:1200") || !a.admit(STORE, "10.0.0.2:1200") {
+		t.Error("The first request of each type should be admitted")
+	}
+	if a.admit(FIND_NODE, "10.0.0.3:1200") {
+		t.Error("A request over the limit of its type was admitted")
+	}
+	if !a.acquireStore() || a.acquireStore() {
+		t.Error("Only one store should be handled at a time")
+	}
+	a.releaseStore()
+	if !a.acquireStore() {
+		t.Error("The store slot was not released")
+	}
+	if a.stats.DroppedType["FIND_NODE"] != 1 || a.stats.DroppedStore != 1 {
+		t.Errorf("Wrong counters of dropped requests: %+v\n", a.stats)
+	}
+}
+
+func TestClose(t *testing.T) {
+	address_client := "localhost:12320"
+	address_server := "localhost:12330"
+	ct_client := contact.New(kademliaid.New("1000000000000000000000000000000000000000"), address_client)
+	ct_server := contact.New(kademliaid.New("0000000000000000000000000000000000000000"), address_server)
+	nw_client := New(&ct_client)
+	nw_server := New(&ct_server)
+	go nw_server.Listen(address_server)
+	served := make(chan struct{})
+	go func() {
+		nw_client.Listen(address_client)
+		close(served)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := nw_client.Ping(context.Background(), &ct_server); err != nil {
+		t.Fatal("TestClose failed, Ping returned an error:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := nw_client.Close(ctx); err != nil {
+		t.Error("TestClose failed, Close returned an error:", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Error("TestClose failed, Listen did not return")
+	}
+	if err := nw_client.Ping(context.Background(), &ct_server); !errors.Is(err, ErrClosed) {
+		t.Error("TestClose failed, expected ErrClosed from Ping, got", err)
+	}
+	if contacts, err := nw_client.LookupContact(context.Background(), ct_server.ID); contacts != nil || !errors.Is(err, ErrClosed) {
+		t.Error("TestClose failed, a closed node should not look up contacts")
+	}
+	if err := nw_client.Close(ctx); err != nil {
+		t.Error("TestClose failed, closing twice returned an error:", err)
+	}
+	// the port is free again, a restarted node can listen on it
+	nw_restarted := New(&ct_client)
+	go nw_restarted.Listen(address_client)
+	time.Sleep(50 * time.Millisecond)
+	if err := nw_restarted.Ping(context.Background(), &ct_server); err != nil {
+		t.Error("TestClose failed, Ping from the restarted node returned an error:", err)
+	}
+	nw_restarted.Close(ctx)
+	nw_server.Close(ctx)
+}
+
+func TestCloseWaitsForRPCs(t *testing.T) {
+	network := transport.NewNetwork()
+	tr_client, _ := network.Listen("client")
+	// nothing listens on "server", the ping is never answered
+	ct_client := contact.New(kademliaid.New("1000000000000000000000000000000000000000"), "client")
+	ct_server := contact.New(kademliaid.New("0000000000000000000000000000000000000000"), "server")
+	options := DefaultOptions()
+	options.Transport = tr_client
+	options.Retries = 0
+	nw_client := NewWithOptions(&ct_client, options)
+	go nw_client.Serve()
+	done := make(chan error, 1)
+	go func() {
+		done <- nw_client.Ping(context.Background(), &ct_server)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// Close gives up on the ping when the context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := nw_client.Close(ctx); err != context.DeadlineExceeded {
+		t.Error("TestCloseWaitsForRPCs failed, expected the deadline to be exceeded, got", err)
+	}
+	if err := <-done; err == nil {
+		t.Error("TestCloseWaitsForRPCs failed, the unanswered ping succeeded")
+	}
+}
+
+func TestAddrs(t *testing.T) {
+	addrs := contact.Addrs{netip.MustParseAddrPort("10.0.0.1:1200"), netip.MustParseAddrPort("[2001:db8::1]:1200")}
+	sender := contact.NewWithAddrs(kademliaid.New("1000000000000000000000000000000000000000"), addrs)
+	for _, codec := range []Codec{MsgPack, Protobuf} {
+		b, err := codec.Marshal(RPCPing{RPCType: PING, Version: PROTOCOL_VERSION, Sender: sender})
+		if err != nil {
+			t.Fatal("Marshal failed:", err)
+		}
+		var got RPCPing
+		err = codec.Unmarshal(b, &got)
+		if err != nil {
+			t.Fatal("Unmarshal failed:", err)
+		}
+		if got.Sender.Address != sender.Address || len(got.Sender.Addrs) != 2 || got.Sender.Addrs[0] != addrs[0] || got.Sender.Addrs[1] != addrs[1] {
+			t.Errorf("Addresses were not decoded correctly, expected %v %v, got %v %v", sender.Address, sender.Addrs, got.Sender.Address, got.Sender.Addrs)
+		}
+	}
+
+	// a node that only has IPv4 doesn't try the IPv6 address
+	me := contact.New(kademliaid.New("0000000000000000000000000000000000000000"), "10.0.0.2:1200")
+	nw := New(&me)
+	if got := nw.addrsFor(&sender); len(got) != 1 || got[0] != "10.0.0.1:1200" {
+		t.Error("Expected only the IPv4 address, got", got)
+	}
+	// a dual stack node tries the address the contact was last heard from first
+	me = contact.NewWithAddrs(me.ID, contact.Addrs{netip.MustParseAddrPort("10.0.0.2:1200"), netip.MustParseAddrPort("[2001:db8::2]:1200")})
+	nw = New(&me)
+	if got := nw.addrsFor(&sender); len(got) != 2 || got[0] != "10.0.0.1:1200" {
+		t.Error("Expected both addresses in the advertised order, got", got)
+	}
+	nw.routingtable.SetReachable(sender.ID, addrs[1])
+	if got := nw.addrsFor(&sender); len(got) != 2 || got[0] != "[2001:db8::1]:1200" || got[1] != "10.0.0.1:1200" {
+		t.Error("Expected the IPv6 address first, got", got)
+	}
+	// contacts without IP addresses are sent to their address as before
+	named := contact.New(kademliaid.NewRandom(), "localhost:1200")
+	if got := nw.addrsFor(&named); len(got) != 1 || got[0] != "localhost:1200" {
+		t.Error("Expected the host name, got", got)
+	}
+}
+
+// natTransport drops datagrams from addresses nothing was sent to, like NAT does
+type natTransport struct {
+	transport.T
+	contacted map[string]bool
+	mux sync.Mutex
+}
+
+func (n *natTransport) WriteTo(b []byte, address string) error {
+	n.mux.Lock()
+	n.contacted[address] = true
+	n.mux.Unlock()
+	return n.T.WriteTo(b, address)
+}
+
+func (n *natTransport) ReadFrom(b []byte) (int, string, error) {
+	for {
+		size, from, err := n.T.ReadFrom(b)
+		n.mux.Lock()
+		ok := n.contacted[from]
+		n.mux.Unlock()
+		if err != nil || ok {
+			return size, from, err
+		}
+	}
+}
+
+func TestReachability(t *testing.T) {
+	network := transport.NewNetwork()
+	node := func(address string, advertised string, nat bool) (*T, contact.T) {
+		var tr transport.T
+		tr, _ = network.Listen(address)
+		if nat {
+			tr = &natTransport{T: tr, contacted: make(map[string]bool)}
+		}
+		ct := contact.New(kademliaid.NewRandom(), advertised)
+		nw := NewWithTransport(&ct, tr)
+		go nw.Serve()
+		return nw, ct
+	}
+	nw_bob, ct_bob := node("bob", "bob", false)
+	nw_carol, _ := node("carol", "carol", false)
+	defer nw_bob.Close(context.Background())
+	defer nw_carol.Close(context.Background())
+	// bob asks carol to dial back, so he has to know that she can
+	if err := nw_carol.Ping(context.Background(), &ct_bob); err != nil {
+		t.Fatal("Ping failed:", err)
+	}
+
+	// alice advertises a private address, but everybody can reach her on the one bob sees
+	nw_alice, _ := node("alice", "10.0.0.1:1200", false)
+	defer nw_alice.Close(context.Background())
+	if err := nw_alice.Ping(context.Background(), &ct_bob); err != nil {
+		t.Fatal("Ping failed:", err)
+	}
+	if observed, votes := nw_alice.ObservedAddress(); observed != "alice" || votes != 1 {
+		t.Errorf("Expected bob to observe alice, got %v with %v votes", observed, votes)
+	}
+	r := nw_alice.CheckReachability()
+	if r.Observed != "alice" || !r.Tested || !r.Reachable {
+		t.Error("Expected alice to be reachable, got", r)
+	}
+	if me := nw_alice.me(); me.Address != "alice" {
+		t.Error("Expected alice to advertise the observed address, got", me.Address)
+	}
+
+	// dave is behind NAT, carol's ping doesn't get through
+	nw_dave, _ := node("dave", "10.0.0.2:1200", true)
+	defer nw_dave.Close(context.Background())
+	if err := nw_dave.Ping(context.Background(), &ct_bob); err != nil {
+		t.Fatal("Ping through NAT failed:", err)
+	}
+	r = nw_dave.CheckReachability()
+	if r.Observed != "dave" || !r.Tested || r.Reachable {
+		t.Error("Expected dave not to be reachable, got", r)
+	}
+	if me := nw_dave.me(); me.Address != "10.0.0.2:1200" {
+		t.Error("An unreachable address should not be advertised, got", me.Address)
+	}
+
+	// eve is not in carol's routing table, carol doesn't ping the target she names
+	nw_eve, _ := node("eve", "eve", false)
+	defer nw_eve.Close(context.Background())
+	ct_carol, _ := nw_bob.routingtable.GetContact(nw_carol.me().ID)
+	msg := RPCDialBack{RPCType: DIAL_BACK, Version: PROTOCOL_VERSION, RPCID: *kademliaid.NewRandom(), Sender: nw_eve.me(), Probe: *kademliaid.NewRandom(), Target: ct_bob}
+	var res RPCDialBackResponse
+	if err := nw_eve.rpc(context.Background(), &ct_carol, msg.RPCID, msg, &res); err != nil {
+		t.Fatal("Dial back failed:", err)
+	}
+	if res.Status != DIAL_BACK_REFUSED {
+		t.Error("A dial back with a target from an unknown node was not refused, status", res.Status)
+	}
+
+	// carol doesn't add grace, who advertises an address she isn't on, so she refuses what grace passes on.
+	// eve hears of the refusal instead of waiting for a probe that never comes.
+	nw_grace, ct_grace := node("grace", "10.0.0.3:1200", false)
+	defer nw_grace.Close(context.Background())
+	if err := nw_grace.Ping(context.Background(), &ct_carol); err != nil {
+		t.Fatal("Ping failed:", err)
+	}
+	ct_grace = contact.New(ct_grace.ID, "grace")
+	if _, err := nw_eve.DialBack(context.Background(), &ct_grace); err == nil {
+		t.Error("Expected the refusal of the helper to reach eve")
+	}
+}
+
+func TestRelay(t *testing.T) {
+	network := transport.NewNetwork()
+	node := func(address string, relay bool, nat bool) (*T, contact.T) {
+		var tr transport.T
+		tr, _ = network.Listen(address)
+		if nat {
+			tr = &natTransport{T: tr, contacted: make(map[string]bool)}
+		}
+		ident, _ := identity.New()
+		ct := contact.New(ident.ID(), address)
+		options := DefaultOptions()
+		options.Transport = tr
+		options.Identity = ident
+		options.Relay = relay
+		nw := NewWithOptions(&ct, options)
+		go nw.Serve()
+		return nw, ct
+	}
+	nw_relay, ct_relay := node("relay", true, false)
+	nw_alice, ct_alice := node("alice", false, false)
+	nw_nat, _ := node("nat", false, true)
+	defer nw_relay.Close(context.Background())
+	defer nw_alice.Close(context.Background())
+	defer nw_nat.Close(context.Background())
+
+	if err := nw_nat.UseRelay(&ct_alice); err == nil {
+		t.Error("A node that doesn't relay accepted the registration")
+	}
+	if err := nw_nat.UseRelay(&ct_relay); err != nil {
+		t.Fatal("UseRelay failed:", err)
+	}
+	ct_nat := nw_nat.me()
+	if !ct_nat.Relayed || ct_nat.Address != "relay" {
+		t.Fatal("Expected the relay to be advertised, got", ct_nat)
+	}
+	// alice can't reach the node directly, everything goes through the relay
+	if err := nw_alice.Ping(context.Background(), &ct_nat); err != nil {
+		t.Fatal("Ping through the relay failed:", err)
+	}
+	got, ok := nw_alice.routingtable.GetContact(ct_nat.ID)
+	if !ok || !got.Relayed {
+		t.Error("The relayed contact was not added to the routing table:", got)
+	}
+	// large enough to be fragmented on both hops, and encrypted for the node behind NAT
+	val := kvstore.NewValue(false, bytes.Repeat([]byte("relayed "), 1000))
+	status, err := nw_alice.Store(context.Background(), &ct_nat, &val)
+	if err != nil || status != STORE_ACCEPTED {
+		t.Fatal("Store through the relay failed:", status, err)
+	}
+	value, _, found, err := nw_alice.FindValue(context.Background(), &ct_nat, kademliaid.NewHash(val.Data))
+	if err != nil || !found || !bytes.Equal(value.Data, val.Data) {
+		t.Error("FindValue through the relay failed:", found, err)
+	}
+}
+
+func TestRelayReflection(t *testing.T) {
+	network := transport.NewNetwork()
+	tr, _ := network.Listen("relay")
+	rec := &recordingTransport{T: tr}
+	for _, address := range []string{"alice", "nat", "victim"} {
+		network.Listen(address)
+	}
+	ct := contact.New(kademliaid.NewRandom(), "relay")
+	options := DefaultOptions()
+	options.Transport = rec
+	options.Relay = true
+	nw := NewWithOptions(&ct, options)
+	defer nw.Close(context.Background())
+	client := contact.New(kademliaid.NewRandom(), "nat")
+	if !nw.relaying.register(*client.ID, "nat") {
+		t.Fatal("The registration was refused")
+	}
+	relay := func(msg RPCRelay, raddr string) []string {
+		b, _ := MsgPack.Marshal(msg)
+		rec.mux.Lock()
+		rec.to = nil
+		rec.mux.Unlock()
+		nw.relayReceived(MsgPack, b, raddr)
+		rec.mux.Lock()
+		defer rec.mux.Unlock()
+		return rec.to
+	}
+	// the client has us send whatever it likes to an address nobody asked us about
+	attack := RPCRelay{RPCType: RELAY, Version: PROTOCOL_VERSION, RPCID: *kademliaid.NewRandom(), Sender: client, Address: "victim", Data: []byte("attack")}
+	if to := relay(attack, "nat"); len(to) != 0 {
+		t.Error("The relay sent a response nobody asked for to", to)
+	}
+	// a request from alice, its response goes back to alice whatever the client says
+	alice := contact.New(kademliaid.NewRandom(), "alice")
+	request := RPCRelay{RPCType: RELAY, Version: PROTOCOL_VERSION, RPCID: *kademliaid.NewRandom(), Sender: alice, Target: *client.ID, Data: []byte("request")}
+	if to := relay(request, "alice"); len(to) != 1 || to[0] != "nat" {
+		t.Fatal("The request was not passed on to the client, sent to", to)
+	}
+	response := RPCRelay{RPCType: RELAY, Version: PROTOCOL_VERSION, RPCID: request.RPCID, Sender: client, Address: "victim", Data: []byte("response")}
+	if to := relay(response, "nat"); len(to) != 1 || to[0] != "alice" {
+		t.Error("Expected the response to go to alice, sent to", to)
+	}
+}
+
+func TestRelayRegister(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewVirtual(start)
+	r := newRelaying(c)
+	id := *kademliaid.NewRandom()
+	if !r.register(id, "nat:1200") {
+		t.Fatal("The registration was refused")
+	}
+	if !r.register(id, "nat:1200") {
+		t.Error("A refresh from the registered address was refused")
+	}
+	if r.register(id, "mallory:1200") {
+		t.Error("Another address took over the registration")
+	}
+	if address, _ := r.client(id); address != "nat:1200" {
+		t.Error("Expected RPCs to be relayed to the registered address, got", address)
+	}
+	// once the registration expired the ID can be registered from elsewhere, e.g. after the NAT mapping changed
+	c.RunUntil(start.Add(constants.RELAY_TTL+time.Second), time.Millisecond)
+	if !r.register(id, "nat:1300") {
+		t.Error("An expired registration was not replaced")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	network := transport.NewNetwork()
+	node := func(address string, compression bool) (*T, contact.T, *recordingTransport) {
+		tr, _ := network.Listen(address)
+		rec := &recordingTransport{T: tr}
+		ct := contact.New(kademliaid.NewRandom(), address)
+		options := DefaultOptions()
+		options.Transport = rec
+		options.Compression = compression
+		nw := NewWithOptions(&ct, options)
+		go nw.Serve()
+		return nw, ct, rec
+	}
+	sent := func(rec *recordingTransport) int {
+		rec.mux.Lock()
+		defer rec.mux.Unlock()
+		n := 0
+		for _, b := range rec.sent {
+			n += len(b)
+		}
+		return n
+	}
+	nw_alice, _, rec_alice := node("alice", true)
+	_, ct_bob, _ := node("bob", true)
+	_, ct_carol, _ := node("carol", false)
+	text := bytes.Repeat([]byte("text compresses well "), 1000)
+
+	// the capabilities are learned from the ping
+	for _, c := range []*contact.T{&ct_bob, &ct_carol} {
+		if err := nw_alice.Ping(context.Background(), c); err != nil {
+			t.Fatal("Ping failed:", err)
+		}
+	}
+	before := sent(rec_alice)
+	val := kvstore.NewValue(false, text)
+	status, err := nw_alice.Store(context.Background(), &ct_bob, &val)
+	if err != nil || status != STORE_ACCEPTED {
+		t.Fatal("Compressed Store failed:", status, err)
+	}
+	if n := sent(rec_alice) - before; n >= len(text)/4 {
+		t.Errorf("The value was not compressed, %v bytes were sent for %v bytes of text", n, len(text))
+	}
+	value, _, found, err := nw_alice.FindValue(context.Background(), &ct_bob, kademliaid.NewHash(text))
+	if err != nil || !found || !bytes.Equal(value.Data, text) {
+		t.Error("FindValue of a compressed value failed:", found, err)
+	}
+
+	// carol doesn't decompress, she gets the value as it is
+	before = sent(rec_alice)
+	status, err = nw_alice.Store(context.Background(), &ct_carol, &val)
+	if err != nil || status != STORE_ACCEPTED {
+		t.Fatal("Uncompressed Store failed:", status, err)
+	}
+	if n := sent(rec_alice) - before; n < len(text) {
+		t.Errorf("Only %v bytes were sent to a node without compression", n)
+	}
+}
+
+func TestStoreTokens(t *testing.T) {
+	network := transport.NewNetwork()
+	node := func(address string) (*T, contact.T) {
+		tr, _ := network.Listen(address)
+		ct := contact.New(kademliaid.NewRandom(), address)
+		nw := NewWithTransport(&ct, tr)
+		go nw.Serve()
+		return nw, ct
+	}
+	nw_server, ct_server := node("server")
+	nw_alice, _ := node("alice")
+	nw_bob, _ := node("bob")
+	store := func(nw *T, token []byte, data string) int {
+		val := kvstore.NewValue(false, []byte(data))
+		msg := RPCStore{RPCType: STORE, Version: PROTOCOL_VERSION, RPCID: *kademliaid.NewRandom(), Sender: nw.me(), Value: val, Token: token}
+		var res RPCStoreResponse
+		err := nw.rpc(context.Background(), &ct_server, msg.RPCID, msg, &res)
+		if err != nil {
+			t.Fatal("Store failed:", err)
+		}
+		return res.Status
+	}
+
+	if status := store(nw_alice, nil, "no token"); status != STORE_BAD_TOKEN {
+		t.Error("A STORE without a token was not refused, status", status)
+	}
+	// Store gets the token with a FIND_NODE
+	val := kvstore.NewValue(false, []byte("with token"))
+	status, err := nw_alice.Store(context.Background(), &ct_server, &val)
+	if err != nil || status != STORE_ACCEPTED {
+		t.Fatal("Store with a token failed:", status, err)
+	}
+	token := nw_alice.storeTokens.get(*ct_server.ID)
+	if len(token) != TOKEN_SIZE {
+		t.Fatal("Alice did not keep the token of the server")
+	}
+	if status := store(nw_bob, token, "stolen token"); status != STORE_BAD_TOKEN {
+		t.Error("A token given to alice was accepted from bob, status", status)
+	}
+
+	// the secret rotates twice, alice's token expires and Store gets a new one
+	nw_server.tokens.mux.Lock()
+	nw_server.tokens.rotated = time.Now().Add(-2 * constants.TOKEN_ROTATION)
+	nw_server.tokens.mux.Unlock()
+	if status := store(nw_alice, token, "expired token"); status != STORE_BAD_TOKEN {
+		t.Error("An expired token was accepted, status", status)
+	}
+	val = kvstore.NewValue(false, []byte("new token"))
+	status, err = nw_alice.Store(context.Background(), &ct_server, &val)
+	if err != nil || status != STORE_ACCEPTED {
+		t.Error("Store did not get a new token:", status, err)
+	}
+
+	// a node that claims to be somewhere else is answered, but not added to the routing table
+	tr_mallory, _ := network.Listen("mallory")
+	ct_mallory := contact.New(kademliaid.NewRandom(), "10.0.0.1:1200")
+	nw_mallory := NewWithTransport(&ct_mallory, tr_mallory)
+	go nw_mallory.Serve()
+	if err := nw_mallory.Ping(context.Background(), &ct_server); err != nil {
+		t.Fatal("Ping failed:", err)
+	}
+	if _, ok := nw_server.routingtable.GetContact(ct_mallory.ID); ok {
+		t.Error("A contact whose address doesn't match the source of its request was added")
+	}
+	if _, ok := nw_server.routingtable.GetContact(nw_alice.me().ID); !ok {
+		t.Error("Alice was not added to the routing table")
+	}
+}
+
+func TestSourceMatches(t *testing.T) {
+	direct := contact.New(kademliaid.NewRandom(), "192.0.2.1:4000")
+	named := contact.New(kademliaid.NewRandom(), "node.example:4000")
+	relayed := contact.New(kademliaid.NewRandom(), "192.0.2.9:4000")
+	relayed.Relayed = true
+	tests := []struct {
+		c *contact.T
+		raddr string
+		matches bool
+	}{
+		{&direct, "192.0.2.1:4000", true},
+		{&direct, "192.0.2.1:5000", true},
+		{&direct, "192.0.2.2:4000", false},
+		{&direct, "192.0.2.1:4000" + relayedSeparator + "192.0.2.9:4000", true},
+		// host names are not resolved on the receive path
+		{&named, "node.example:4000", true},
+		{&named, "127.0.0.1:4000", false},
+		{&relayed, "192.0.2.9:4000", false},
+		{&relayed, "198.51.100.1:4000", false},
+		{&relayed, "198.51.100.1:4000" + relayedSeparator + "192.0.2.9:4000", true},
+		{&relayed, "198.51.100.1:4000" + relayedSeparator + "192.0.2.8:4000", false},
+	}
+	for _, test := range tests {
+		if sourceMatches(test.c, test.raddr) != test.matches {
+			t.Errorf("sourceMatches(%v, %v) is not %v", test.c.Address, test.raddr, test.matches)
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	network := transport.NewNetwork()
+	node := func(address string) (*T, contact.T) {
+		tr, _ := network.Listen(address)
+		ct := contact.New(kademliaid.NewRandom(), address)
+		nw := NewWithTransport(&ct, tr)
+		go nw.Serve()
+		return nw, ct
+	}
+	nw_alice, ct_alice := node("alice")
+	_, ct_bob := node("bob")
+	_, ct_carol := node("carol")
+	faults := Faults{Partitions: [][]kademliaid.T{{*ct_alice.ID}, {*ct_bob.ID}}}
+	nw_alice.SetFaults(faults)
+
+	if err := nw_alice.Ping(context.Background(), &ct_bob); err == nil {
+		t.Error("Ping crossed the partition")
+	}
+	// carol is in no set, she is not affected
+	if err := nw_alice.Ping(context.Background(), &ct_carol); err != nil {
+		t.Error("Ping to a node outside the partitions failed:", err)
+	}
+	nw_alice.SetFaults(Faults{})
+	if err := nw_alice.Ping(context.Background(), &ct_bob); err != nil {
+		t.Error("Ping failed after the partition was healed:", err)
+	}
+
+	nw_alice.SetFaults(Faults{DropRate: 1})
+	if err := nw_alice.Ping(context.Background(), &ct_carol); err == nil {
+		t.Error("Ping succeeded although every datagram is dropped")
+	}
+	// every datagram arrives twice, late and out of order
+	nw_alice.SetFaults(Faults{DuplicateRate: 1, Delay: 5 * time.Millisecond, Jitter: 20 * time.Millisecond, Seed: 1})
+	val := kvstore.NewValue(false, []byte("sent twice"))
+	status, err := nw_alice.Store(context.Background(), &ct_carol, &val)
+	if err != nil || status != STORE_ACCEPTED {
+		t.Error("Store with duplicated datagrams failed:", status, err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	network := transport.NewNetwork()
+	node := func(address string) (*T, contact.T) {
+		tr, _ := network.Listen(address)
+		ct := contact.New(kademliaid.NewRandom(), address)
+		nw := NewWithTransport(&ct, tr)
+		go nw.Serve()
+		return nw, ct
+	}
+	nw_alice, _ := node("alice")
+	nw_bob, ct_bob := node("bob")
+	if err := nw_alice.Ping(context.Background(), &ct_bob); err != nil {
+		t.Fatal("Ping failed:", err)
+	}
+	// bob stops answering, without a deadline the lookup would wait for all the retries
+	nw_bob.SetFaults(Faults{DropRate: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := nw_alice.LookupData(ctx, kademliaid.NewRandom())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected the deadline to end the lookup, got", err)
+	}
+	if elapsed := time.Since(start); elapsed > constants.TIMEOUT {
+		t.Error("The lookup went on after its deadline for", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := nw_alice.Cat(ctx, *kademliaid.NewRandom()); !errors.Is(err, context.Canceled) {
+		t.Error("Expected a cancelled Cat to fail with context.Canceled, got", err)
+	}
+	if _, err := nw_alice.FindNode(ctx, &ct_bob, kademliaid.NewRandom()); !errors.Is(err, context.Canceled) {
+		t.Error("Expected a cancelled FindNode to fail with context.Canceled, got", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	val := kvstore.NewValue(false, []byte("popular"))
+	key := kademliaid.NewHash(val.Data)
+	network := transport.NewNetwork()
+	// the IDs are the key with the given bits flipped
+	node := func(address string, at int, bits byte) (*T, contact.T) {
+		id := *key
+		id[at] ^= bits
+		tr, _ := network.Listen(address)
+		ct := contact.New(&id, address)
+		nw := NewWithTransport(&ct, tr)
+		go nw.Serve()
+		return nw, ct
+	}
+	nw_alice, _ := node("alice", 0, 0x80)
+	nw_bob, ct_bob := node("bob", kademliaid.IDLength-1, 1)
+	nw_carol, ct_carol := node("carol", 0, 0)
+	nw_dave, _ := node("dave", 0, 0x40)
+	// only carol has the value, alice knows bob, who knows carol
+	nw_carol.kvstore.Store(val)
+	nw_bob.Ping(context.Background(), &ct_carol)
+	nw_alice.Ping(context.Background(), &ct_bob)
+
+	if _, err := nw_alice.LookupData(context.Background(), key); err != nil {
+		t.Fatal("LookupData failed:", err)
+	}
+	// bob is the closest node that answered without the value, he is sent a copy in the background
+	cached := false
+	for i := 0; i < 100 && !cached; i++ {
+		time.Sleep(5 * time.Millisecond)
+		_, cached = nw_bob.kvstore.GetCached(*key)
+	}
+	if !cached {
+		t.Fatal("The node on the path of the lookup did not cache the value")
+	}
+	if _, ok := nw_bob.kvstore.Get(*key); ok {
+		t.Error("The cached copy was stored as a value the node is responsible for")
+	}
+	// dave only knows bob, his lookup ends there
+	nw_dave.Ping(context.Background(), &ct_bob)
+	_, stats, err := nw_dave.LookupDataStats(context.Background(), key)
+	if err != nil || stats.Hops != 1 || stats.Queried != 1 {
+		t.Error("The lookup was not answered from the cache:", stats, err)
+	}
+
+	// carol is the only contact closer to the key than bob, none is closer to bob's own ID
+	if expiry := nw_bob.cacheExpiry(key); expiry != constants.CACHE_EXPIRE_TIME/2 {
+		t.Error("Expected the expiry to be halved by the closer contact, got", expiry)
+	}
+	if expiry := nw_bob.cacheExpiry(ct_bob.ID); expiry != constants.CACHE_EXPIRE_TIME {
+		t.Error("Expected the longest expiry without closer contacts, got", expiry)
+	}
+}
+
+func TestQuorum(t *testing.T) {
+	network := transport.NewNetwork()
+	node := func(address string) (*T, contact.T) {
+		tr, _ := network.Listen(address)
+		ct := contact.New(kademliaid.NewRandom(), address)
+		nw := NewWithTransport(&ct, tr)
+		go nw.Serve()
+		return nw, ct
+	}
+	// an unpin reached dave but not bob and carol, erin has an old copy in her cache
+	pinned := kvstore.NewValue(true, []byte("pinned and unpinned"))
+	unpinned := pinned
+	unpinned.Pin = false
+	unpinned.Timestamp = pinned.Timestamp.Add(time.Second)
+	key := kademliaid.NewHash(pinned.Data)
+	nw_alice, _ := node("alice")
+	for _, name := range []string{"bob", "carol", "dave", "erin"} {
+		nw, ct := node(name)
+		switch name {
+		case "dave":
+			nw.kvstore.Store(unpinned)
+		case "erin":
+			nw.kvstore.StoreCached(pinned)
+		default:
+			nw.kvstore.Store(pinned)
+		}
+		nw_alice.Ping(context.Background(), &ct)
+	}
+
+	value, stats, err := nw_alice.LookupDataQuorum(context.Background(), key, 3)
+	if err != nil {
+		t.Fatal("LookupDataQuorum failed:", err)
+	}
+	if value.Pin || !value.Timestamp.Equal(unpinned.Timestamp) {
+		t.Error("The newest version was not returned:", value)
+	}
+	if stats.Replicas != 3 || stats.Versions != 2 || stats.Stale != 2 {
+		t.Errorf("Expected 3 replicas with 2 versions and 2 stale ones, got %+v", stats)
+	}
+	// the cached copy is not a replica
+	value, stats, err = nw_alice.LookupDataQuorum(context.Background(), key, 4)
+	if err != ErrNoQuorum || stats.Replicas != 3 || value.Pin {
+		t.Errorf("Expected the newest of 3 replicas with ErrNoQuorum, got %+v %v", stats, err)
+	}
+	// alice counts herself once she is a replica too
+	nw_alice.kvstore.Store(pinned)
+	if _, stats, err = nw_alice.LookupDataQuorum(context.Background(), key, 4); err != nil || stats.Replicas != 4 {
+		t.Errorf("Expected alice to be the 4th replica, got %+v %v", stats, err)
+	}
+
+	// a pin and an unpin at the same time, the pin is kept
+	q := newQuorum(2)
+	unpinned.Timestamp = pinned.Timestamp
+	q.add(kademliaid.NewRandom(), unpinned)
+	q.add(kademliaid.NewRandom(), pinned)
+	if !q.newest().Pin {
+		t.Error("The pinned version should win a tie")
+	}
+}
+
+func TestFragmentLimits(t *testing.T) {
+	network := transport.NewNetwork()
+	tr, _ := network.Listen("server")
+	ct := contact.New(kademliaid.NewRandom(), "server")
+	nw := NewWithTransport(&ct, tr)
+	go nw.Serve()
+	defer nw.Close(context.Background())
+	sender := contact.New(kademliaid.NewRandom(), "mallory")
+	// the first fragments of the largest messages there can be, which never arrive in full
+	first := func(raddr string) {
+		msg := RPCFragment{RPCType: FRAGMENT, Version: PROTOCOL_VERSION, RPCID: *kademliaid.NewRandom(), Sender: sender, Index: 0, Count: constants.MAX_MESSAGE_SIZE / constants.FRAGMENT_SIZE, Data: []byte("x")}
+		b, _ := MsgPack.Marshal(msg)
+		nw.fragmentReceived(MsgPack, b, raddr)
+	}
+	incoming := func() int {
+		nw.transfers.mux.Lock()
+		defer nw.transfers.mux.Unlock()
+		for _, r := range nw.transfers.incoming {
+			if len(r.parts) != 1 {
+				t.Error("Room was made for fragments that haven't arrived")
+			}
+		}
+		return len(nw.transfers.incoming)
+	}
+	for i := 0; i < 2*constants.MAX_SOURCE_REASSEMBLIES; i++ {
+		first("10.0.0.1:1200")
+	}
+	if n := incoming(); n != constants.MAX_SOURCE_REASSEMBLIES {
+		t.Errorf("Expected %v messages from one source to be reassembled, got %v", constants.MAX_SOURCE_REASSEMBLIES, n)
+	}
+	// other ports of the same host are the same source, other hosts are not
+	first("10.0.0.1:1201")
+	first("10.0.0.2:1200")
+	if n := incoming(); n != constants.MAX_SOURCE_REASSEMBLIES+1 {
+		t.Errorf("Expected %v messages to be reassembled, got %v", constants.MAX_SOURCE_REASSEMBLIES+1, n)
+	}
+	for i := 0; i < constants.MAX_REASSEMBLIES; i++ {
+		first(fmt.Sprintf("10.0.%v.%v:1200", 1+i/200, 3+i%200))
+	}
+	if n := incoming(); n != constants.MAX_REASSEMBLIES {
+		t.Errorf("Expected at most %v messages to be reassembled, got %v", constants.MAX_REASSEMBLIES, n)
+	}
+	nw.transfers.stop()
+	nw.transfers.mux.Lock()
+	if nw.transfers.unsolicited != 0 || len(nw.transfers.sources) != 0 {
+		t.Error("The reassemblies were not counted down")
+	}
+	nw.transfers.mux.Unlock()
+}
+
+func TestFragmentChecks(t *testing.T) {
+	network := transport.NewNetwork()
+	tr, _ := network.Listen("server")
+	ct := contact.New(kademliaid.NewRandom(), "server")
+	nw := NewWithTransport(&ct, tr)
+	defer nw.Close(context.Background())
+	sender := contact.New(kademliaid.NewRandom(), "mallory")
+	id := *kademliaid.NewRandom()
+	fragment := func(index int, data string) {
+		msg := RPCFragment{RPCType: FRAGMENT, Version: PROTOCOL_VERSION, RPCID: id, Sender: sender, Index: index, Count: 3, Data: []byte(data)}
+		b, _ := MsgPack.Marshal(msg)
+		nw.fragmentReceived(MsgPack, b, "mallory")
+	}
+	hasPart := func(parts map[int][]byte, index int) bool {
+		_, ok := parts[index]
+		return ok
+	}
+	parts := func() map[int][]byte {
+		nw.transfers.mux.Lock()
+		defer nw.transfers.mux.Unlock()
+		return nw.transfers.incoming[transferKey{"mallory", id}].parts
+	}
+	// only the last fragment may be empty
+	fragment(0, "")
+	fragment(2, "")
+	if p := parts(); len(p) != 1 || !hasPart(p, 2) {
+		t.Error("Expected only the empty last fragment to be kept, got", p)
+	}
+	// a fragment that arrives again doesn't replace the first one, not even the empty last one
+	fragment(0, "a")
+	fragment(0, "b")
+	fragment(2, "c")
+	if p := parts(); len(p) != 2 || string(p[0]) != "a" || len(p[2]) != 0 {
+		t.Error("Expected duplicates to be dropped, got", p)
+	}
+	fragment(3, "d")
+	fragment(-1, "d")
+	if p := parts(); len(p) != 2 {
+		t.Error("Expected fragments outside the message to be dropped, got", p)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	network := transport.NewNetwork()
+	tr, _ := network.Listen("server")
+	ct := contact.New(kademliaid.NewRandom(), "server")
+	nw := NewWithTransport(&ct, tr)
+	defer nw.Close(context.Background())
+	id := *kademliaid.NewRandom()
+	// a STORE sent again while the first one is still handled is left to the first
+	nw.handling(id, "client")
+	if !nw.resendResponse(id, "client") {
+		t.Error("A request that is being handled was handled again")
+	}
+	nw.handled(id, "client")
+	if nw.resendResponse(id, "client") {
+		t.Error("A request that was handled without a response was not handled again")
+	}
+	nw.handling(id, "client")
+	nw.cacheResponse(id, []byte("response"), "client")
+	nw.handled(id, "client")
+	if !nw.resendResponse(id, "client") {
+		t.Error("The response was not kept")
+	}
+	// large responses don't fit
+	large := *kademliaid.NewRandom()
+	nw.cacheResponse(large, make([]byte, constants.RESPONSE_CACHE_SIZE), "client")
+	if nw.resendResponse(large, "client") {
+		t.Error("More than RESPONSE_CACHE_SIZE bytes of responses were kept")
+	}
+	nw.transfers.mux.Lock()
+	if nw.transfers.responsesSize != len("response") {
+		t.Error("Expected the size of the kept responses to be", len("response"), "got", nw.transfers.responsesSize)
+	}
+	nw.transfers.mux.Unlock()
+}
+
+func TestObserve(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewVirtual(start)
+	ct := contact.New(kademliaid.NewRandom(), "10.0.0.1:1200")
+	options := DefaultOptions()
+	options.Clock = c
+	nw := NewWithOptions(&ct, options)
+	// a host with many IDs has one vote
+	for i := 0; i < 10; i++ {
+		peer := contact.New(kademliaid.NewRandom(), fmt.Sprintf("10.0.0.2:%v", 1200+i))
+		nw.observe(&peer, "203.0.113.1:1200")
+	}
+	for _, address := range []string{"10.0.0.3:1200", "10.0.0.4:1200"} {
+		peer := contact.New(kademliaid.NewRandom(), address)
+		nw.observe(&peer, "198.51.100.1:1200")
+	}
+	if observed, votes := nw.ObservedAddress(); observed != "198.51.100.1:1200" || votes != 2 {
+		t.Errorf("Expected 2 votes for 198.51.100.1:1200, got %v with %v votes", observed, votes)
+	}
+	for i := 0; i < 2*constants.MAX_OBSERVERS; i++ {
+		peer := contact.New(kademliaid.NewRandom(), fmt.Sprintf("10.1.0.%v:1200", i))
+		nw.observe(&peer, "203.0.113.1:1200")
+	}
+	nw.mux.Lock()
+	if len(nw.observed) > constants.MAX_OBSERVERS {
+		t.Error("Kept more than MAX_OBSERVERS votes:", len(nw.observed))
+	}
+	nw.mux.Unlock()
+	c.RunUntil(start.Add(constants.OBSERVATION_TTL+time.Second), time.Second)
+	if observed, votes := nw.ObservedAddress(); observed != "" {
+		t.Errorf("Votes did not expire, got %v with %v votes", observed, votes)
+	}
+}
+
+func TestDecompressLimits(t *testing.T) {
+	// a few bytes that claim to decompress to 60MB
+	frame := []byte{frameEscape, frameCompressed}
+	frame = binary.AppendUvarint(frame, 60*1024*1024)
+	frame = append(frame, 0, 0, 0, 0)
+	if _, err := decompress(frame); err == nil {
+		t.Error("A small frame that claims to be large was decompressed")
+	}
+	text := bytes.Repeat([]byte("text compresses well "), 1000)
+	frame = append([]byte{frameEscape, frameCompressed}, snappy.Encode(nil, text)...)
+	b, err := decompress(frame)
+	if err != nil || !bytes.Equal(b, text) {
+		t.Error("Decompressing failed:", err)
+	}
+	zeros := make([]byte, constants.MAX_DECOMPRESSED_SIZE)
+	frame = append([]byte{frameEscape, frameCompressed}, snappy.Encode(nil, zeros)...)
+	if _, err := decompress(frame); err != nil {
+		t.Error("Decompressing the most compressible message failed:", err)
+	}
+}
@@ -0,0 +1,592 @@
+package kademlia
+
+import (
+	"net/netip"
+	"time"
+	"errors"
+	"reflect"
+	"google.golang.org/protobuf/encoding/protowire"
+	"github.com/mjolnir92/kdfs/kademliaid"
+	"github.com/mjolnir92/kdfs/contact"
+	"github.com/mjolnir92/kdfs/kvstore"
+	"github.com/mjolnir92/kdfs/constants"
+)
+
+// Every protobuf message starts with the type, field 1 as a varint
+const protobufFirstByte = 0x08
+
+// Field numbers of the RPC message in messages.proto
+const (
+	pbType = 1
+	pbRPCID = 2
+	pbSender = 3
+	pbFindID = 4
+	pbContacts = 5
+	pbValue = 6
+	pbStatus = 7
+	pbIndex = 8
+	pbCount = 9
+	pbChecksum = 10
+	pbData = 11
+	pbMissing = 12
+	pbVersion = 13
+	pbCapabilities = 14
+	pbCode = 15
+	pbMinVersion = 16
+	pbMaxVersion = 17
+	pbMessage = 18
+	pbEncryptionKey = 19
+	pbObservedAddress = 20
+	pbProbe = 21
+	pbTarget = 22
+	pbRelayTarget = 23
+	pbRelayAddress = 24
+	pbToken = 25
+	pbCache = 26
+	pbCached = 27
+)
+
+// Field numbers of the Contact message
+const (
+	pbContactID = 1
+	pbContactAddressS = 2
+	pbContactAddressB = 3
+	pbContactPublicKey = 4
+	pbContactNonce = 5
+	pbContactAddrs = 6
+	pbContactRelayed = 7
+)
+
+// Field numbers of the Value message
+const (
+	pbValueTimestamp = 1
+	pbValuePin = 2
+	pbValueData = 3
+)
+
+// Encodes the RPC structs as the RPC message in messages.proto, so that nodes written in other languages can talk to us
+type protobufCodec struct{}
+
+// pbRPC has the fields of the RPC message. Which of them are used depends on the type.
+type pbRPC struct {
+	Type int
+	Version int
+	RPCID kademliaid.T
+	Sender contact.T
+	FindID kademliaid.T
+	Contacts []contact.T
+	Value kvstore.Value
+	Status int
+	Index int
+	Count int
+	Checksum uint32
+	Data []byte
+	Missing []int
+	Capabilities uint64
+	Code int
+	MinVersion int
+	MaxVersion int
+	Message string
+	EncryptionKey []byte
+	ObservedAddress string
+	Probe kademliaid.T
+	Target contact.T
+	RelayTarget kademliaid.T
+	RelayAddress string
+	Token []byte
+	Cache bool
+	Cached bool
+}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Marshal(msg interface{}) ([]byte, error) {
+	// the RPC structs are usually passed by value
+	v := reflect.ValueOf(msg)
+	if v.Kind() == reflect.Ptr {
+		msg = v.Elem().Interface()
+	}
+	var p pbRPC
+	switch m := msg.(type) {
+	case RPCHeader:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender}
+	case RPCPing:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, Capabilities: m.Capabilities, EncryptionKey: m.EncryptionKey, Probe: m.Probe}
+	case RPCPingResponse:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, Capabilities: m.Capabilities, EncryptionKey: m.EncryptionKey, ObservedAddress: m.ObservedAddress}
+	case RPCDialBack:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, Probe: m.Probe, Target: m.Target}
+	case RPCDialBackResponse:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, Status: m.Status}
+	case RPCRelay:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, RelayTarget: m.Target, RelayAddress: m.Address, Data: m.Data}
+	case RPCRelayRegister:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender}
+	case RPCRelayRegisterResponse:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, Status: m.Status}
+	case RPCFindNode:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, FindID: m.FindID}
+	case RPCFindNodeResponse:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, Contacts: m.Contacts, Token: m.Token}
+	case RPCFindValue:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, FindID: m.FindID}
+	case RPCFindValueResponse:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, Value: m.Value, Contacts: m.Contacts, Token: m.Token, Cached: m.Cached}
+	case RPCStore:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, Value: m.Value, Token: m.Token, Cache: m.Cache}
+	case RPCStoreResponse:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, Status: m.Status}
+	case RPCFragment:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, Index: m.Index, Count: m.Count, Checksum: m.Checksum, Data: m.Data}
+	case RPCFragmentNack:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, Missing: m.Missing}
+	case RPCError:
+		p = pbRPC{Type: m.RPCType, RPCID: m.RPCID, Sender: m.Sender, Code: m.Code, MinVersion: m.MinVersion, MaxVersion: m.MaxVersion, Message: m.Message}
+	default:
+		return nil, errors.New("protobuf: can't marshal " + v.Type().String())
+	}
+	// every RPC struct has a Version
+	p.Version = int(reflect.Indirect(v).FieldByName("Version").Int())
+	return p.marshal(), nil
+}
+
+func (protobufCodec) Unmarshal(b []byte, msg interface{}) error {
+	var p pbRPC
+	err := p.unmarshal(b)
+	if err != nil {
+		return err
+	}
+	switch m := msg.(type) {
+	case *RPCHeader:
+		*m = RPCHeader{RPCType: p.Type, Version: p.Version, RPCID: p.RPCID, Sender: p.Sender}
+	case *RPCPing:
+		*m = RPCPing{RPCType: p.Type, Version: p.Version, RPCID: p.RPCID, Sender: p.Sender, Capabilities: p.Capabilities, EncryptionKey: p.EncryptionKey, Probe: p.Probe}
+	case *RPCPingResponse:
+		*m = RPCPingResponse{RPCType: p.Type, Version: p.Version, RPCID: p.RPCID, Sender: p.Sender, Capabilities: p.Capabilities, EncryptionKey: p.EncryptionKey, ObservedAddress: p.ObservedAddress}
+	case *RPCDialBack:
+		*m = RPCDialBack{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, Probe: p.Probe, Target: p.Target}
+	case *RPCDialBackResponse:
+		*m = RPCDialBackResponse{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, Status: p.Status}
+	case *RPCRelay:
+		*m = RPCRelay{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, Target: p.RelayTarget, Address: p.RelayAddress, Data: p.Data}
+	case *RPCRelayRegister:
+		*m = RPCRelayRegister{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender}
+	case *RPCRelayRegisterResponse:
+		*m = RPCRelayRegisterResponse{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, Status: p.Status}
+	case *RPCFindNode:
+		*m = RPCFindNode{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, FindID: p.FindID}
+	case *RPCFindNodeResponse:
+		*m = RPCFindNodeResponse{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, Contacts: p.Contacts, Token: p.Token}
+	case *RPCFindValue:
+		*m = RPCFindValue{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, FindID: p.FindID}
+	case *RPCFindValueResponse:
+		*m = RPCFindValueResponse{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, Value: p.Value, Contacts: p.Contacts, Token: p.Token, Cached: p.Cached}
+	case *RPCStore:
+		*m = RPCStore{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, Value: p.Value, Token: p.Token, Cache: p.Cache}
+	case *RPCStoreResponse:
+		*m = RPCStoreResponse{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, Status: p.Status}
+	case *RPCFragment:
+		*m = RPCFragment{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, Index: p.Index, Count: p.Count, Checksum: p.Checksum, Data: p.Data}
+	case *RPCFragmentNack:
+		*m = RPCFragmentNack{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, Missing: p.Missing}
+	case *RPCError:
+		*m = RPCError{RPCType: p.Type, RPCID: p.RPCID, Sender: p.Sender, Code: p.Code, MinVersion: p.MinVersion, MaxVersion: p.MaxVersion, Message: p.Message}
+	default:
+		return errors.New("protobuf: can't unmarshal into " + reflect.TypeOf(msg).String())
+	}
+	reflect.ValueOf(msg).Elem().FieldByName("Version").SetInt(int64(p.Version))
+	return nil
+}
+
+func (p *pbRPC) marshal() []byte {
+	var b []byte
+	// the type is always written, even PING = 0, so that the message can be recognized by its first byte
+	b = appendInt(b, pbType, p.Type)
+	b = protowire.AppendTag(b, pbRPCID, protowire.BytesType)
+	b = protowire.AppendBytes(b, p.RPCID[:])
+	b = protowire.AppendTag(b, pbSender, protowire.BytesType)
+	b = protowire.AppendBytes(b, marshalContact(&p.Sender))
+	if p.FindID != (kademliaid.T{}) {
+		b = protowire.AppendTag(b, pbFindID, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.FindID[:])
+	}
+	for i := range p.Contacts {
+		b = protowire.AppendTag(b, pbContacts, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalContact(&p.Contacts[i]))
+	}
+	if len(p.Value.Data) > 0 || !p.Value.Timestamp.IsZero() {
+		b = protowire.AppendTag(b, pbValue, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalValue(&p.Value))
+	}
+	if p.Status != 0 {
+		b = appendInt(b, pbStatus, p.Status)
+	}
+	if p.Index != 0 {
+		b = appendInt(b, pbIndex, p.Index)
+	}
+	if p.Count != 0 {
+		b = appendInt(b, pbCount, p.Count)
+	}
+	if p.Checksum != 0 {
+		b = protowire.AppendTag(b, pbChecksum, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(p.Checksum))
+	}
+	if len(p.Data) > 0 {
+		b = protowire.AppendTag(b, pbData, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.Data)
+	}
+	if p.Version != 0 {
+		b = appendInt(b, pbVersion, p.Version)
+	}
+	if p.Capabilities != 0 {
+		b = protowire.AppendTag(b, pbCapabilities, protowire.VarintType)
+		b = protowire.AppendVarint(b, p.Capabilities)
+	}
+	if p.Code != 0 {
+		b = appendInt(b, pbCode, p.Code)
+	}
+	if p.MinVersion != 0 {
+		b = appendInt(b, pbMinVersion, p.MinVersion)
+	}
+	if p.MaxVersion != 0 {
+		b = appendInt(b, pbMaxVersion, p.MaxVersion)
+	}
+	if p.Message != "" {
+		b = protowire.AppendTag(b, pbMessage, protowire.BytesType)
+		b = protowire.AppendString(b, p.Message)
+	}
+	if len(p.EncryptionKey) > 0 {
+		b = protowire.AppendTag(b, pbEncryptionKey, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.EncryptionKey)
+	}
+	if p.ObservedAddress != "" {
+		b = protowire.AppendTag(b, pbObservedAddress, protowire.BytesType)
+		b = protowire.AppendString(b, p.ObservedAddress)
+	}
+	if p.Probe != (kademliaid.T{}) {
+		b = protowire.AppendTag(b, pbProbe, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.Probe[:])
+	}
+	if p.Target.ID != nil {
+		b = protowire.AppendTag(b, pbTarget, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalContact(&p.Target))
+	}
+	if p.RelayTarget != (kademliaid.T{}) {
+		b = protowire.AppendTag(b, pbRelayTarget, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.RelayTarget[:])
+	}
+	if p.RelayAddress != "" {
+		b = protowire.AppendTag(b, pbRelayAddress, protowire.BytesType)
+		b = protowire.AppendString(b, p.RelayAddress)
+	}
+	if len(p.Token) > 0 {
+		b = protowire.AppendTag(b, pbToken, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.Token)
+	}
+	if p.Cache {
+		b = protowire.AppendTag(b, pbCache, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(p.Cache))
+	}
+	if p.Cached {
+		b = protowire.AppendTag(b, pbCached, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(p.Cached))
+	}
+	if len(p.Missing) > 0 {
+		// repeated scalars are packed in proto3
+		var packed []byte
+		for _, m := range p.Missing {
+			packed = protowire.AppendVarint(packed, uint64(int64(m)))
+		}
+		b = protowire.AppendTag(b, pbMissing, protowire.BytesType)
+		b = protowire.AppendBytes(b, packed)
+	}
+	return b
+}
+
+func (p *pbRPC) unmarshal(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var err error
+		switch {
+		case num == pbType && typ == protowire.VarintType:
+			p.Type, n = consumeInt(b)
+		case num == pbRPCID && typ == protowire.BytesType:
+			n, err = consumeID(b, &p.RPCID)
+		case num == pbSender && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				p.Sender, err = unmarshalContact(v)
+			}
+		case num == pbFindID && typ == protowire.BytesType:
+			n, err = consumeID(b, &p.FindID)
+		case num == pbContacts && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				var c contact.T
+				c, err = unmarshalContact(v)
+				p.Contacts = append(p.Contacts, c)
+			}
+		case num == pbValue && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				p.Value, err = unmarshalValue(v)
+			}
+		case num == pbStatus && typ == protowire.VarintType:
+			p.Status, n = consumeInt(b)
+		case num == pbIndex && typ == protowire.VarintType:
+			p.Index, n = consumeInt(b)
+		case num == pbCount && typ == protowire.VarintType:
+			p.Count, n = consumeInt(b)
+		case num == pbChecksum && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			p.Checksum = uint32(v)
+		case num == pbData && typ == protowire.BytesType:
+			p.Data, n = protowire.ConsumeBytes(b)
+		case num == pbMissing && typ == protowire.BytesType:
+			var packed []byte
+			packed, n = protowire.ConsumeBytes(b)
+			for len(packed) > 0 && n >= 0 {
+				var m, k int
+				m, k = consumeInt(packed)
+				if k < 0 {
+					return protowire.ParseError(k)
+				}
+				p.Missing = append(p.Missing, m)
+				packed = packed[k:]
+			}
+		case num == pbMissing && typ == protowire.VarintType:
+			var m int
+			m, n = consumeInt(b)
+			p.Missing = append(p.Missing, m)
+		case num == pbVersion && typ == protowire.VarintType:
+			p.Version, n = consumeInt(b)
+		case num == pbCapabilities && typ == protowire.VarintType:
+			p.Capabilities, n = protowire.ConsumeVarint(b)
+		case num == pbCode && typ == protowire.VarintType:
+			p.Code, n = consumeInt(b)
+		case num == pbMinVersion && typ == protowire.VarintType:
+			p.MinVersion, n = consumeInt(b)
+		case num == pbMaxVersion && typ == protowire.VarintType:
+			p.MaxVersion, n = consumeInt(b)
+		case num == pbMessage && typ == protowire.BytesType:
+			p.Message, n = protowire.ConsumeString(b)
+		case num == pbEncryptionKey && typ == protowire.BytesType:
+			p.EncryptionKey, n = protowire.ConsumeBytes(b)
+		case num == pbObservedAddress && typ == protowire.BytesType:
+			p.ObservedAddress, n = protowire.ConsumeString(b)
+		case num == pbProbe && typ == protowire.BytesType:
+			n, err = consumeID(b, &p.Probe)
+		case num == pbRelayTarget && typ == protowire.BytesType:
+			n, err = consumeID(b, &p.RelayTarget)
+		case num == pbRelayAddress && typ == protowire.BytesType:
+			p.RelayAddress, n = protowire.ConsumeString(b)
+		case num == pbToken && typ == protowire.BytesType:
+			p.Token, n = protowire.ConsumeBytes(b)
+		case num == pbCache && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			p.Cache = protowire.DecodeBool(v)
+		case num == pbCached && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			p.Cached = protowire.DecodeBool(v)
+		case num == pbTarget && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				p.Target, err = unmarshalContact(v)
+			}
+		default:
+			// skip fields we don't know about, they may come from a newer node
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func marshalContact(c *contact.T) []byte {
+	var b []byte
+	if c.ID != nil {
+		b = protowire.AppendTag(b, pbContactID, protowire.BytesType)
+		b = protowire.AppendBytes(b, c.ID[:])
+	}
+	if len(c.Addrs) > 0 && c.Address == c.Addrs[0].String() {
+		// Address is implied by the first of the addresses below
+	} else if addr, ok := contact.ParseAddr(c.Address); ok {
+		b = protowire.AppendTag(b, pbContactAddressB, protowire.BytesType)
+		b = protowire.AppendBytes(b, contact.AppendAddr(nil, addr))
+	} else {
+		b = protowire.AppendTag(b, pbContactAddressS, protowire.BytesType)
+		b = protowire.AppendString(b, c.Address)
+	}
+	if len(c.PublicKey) > 0 {
+		b = protowire.AppendTag(b, pbContactPublicKey, protowire.BytesType)
+		b = protowire.AppendBytes(b, c.PublicKey)
+	}
+	if c.Nonce != (kademliaid.T{}) {
+		b = protowire.AppendTag(b, pbContactNonce, protowire.BytesType)
+		b = protowire.AppendBytes(b, c.Nonce[:])
+	}
+	for _, addr := range c.Addrs {
+		b = protowire.AppendTag(b, pbContactAddrs, protowire.BytesType)
+		b = protowire.AppendBytes(b, contact.AppendAddr(nil, addr))
+	}
+	if c.Relayed {
+		b = protowire.AppendTag(b, pbContactRelayed, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(c.Relayed))
+	}
+	return b
+}
+
+func unmarshalContact(b []byte) (contact.T, error) {
+	var c contact.T
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return c, protowire.ParseError(n)
+		}
+		b = b[n:]
+		var err error
+		switch {
+		case num == pbContactID && typ == protowire.BytesType:
+			var id kademliaid.T
+			n, err = consumeID(b, &id)
+			c.ID = &id
+		case num == pbContactAddressS && typ == protowire.BytesType:
+			c.Address, n = protowire.ConsumeString(b)
+		case num == pbContactAddressB && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				var addr netip.AddrPort
+				addr, err = contact.DecodeAddr(v)
+				c.Address = addr.String()
+			}
+		case num == pbContactPublicKey && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			// b is the whole message, don't keep it alive through the contact
+			c.PublicKey = append([]byte(nil), v...)
+		case num == pbContactNonce && typ == protowire.BytesType:
+			n, err = consumeID(b, &c.Nonce)
+		case num == pbContactRelayed && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			c.Relayed = protowire.DecodeBool(v)
+		case num == pbContactAddrs && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				var addr netip.AddrPort
+				addr, err = contact.DecodeAddr(v)
+				c.Addrs = append(c.Addrs, addr)
+				if len(c.Addrs) > constants.MAX_ADDRS {
+					err = contact.ErrTooManyAddrs
+				}
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return c, protowire.ParseError(n)
+		}
+		if err != nil {
+			return c, err
+		}
+		b = b[n:]
+	}
+	if c.ID == nil {
+		return c, errors.New("protobuf: contact without ID")
+	}
+	if c.Address == "" && len(c.Addrs) > 0 {
+		c.Address = c.Addrs[0].String()
+	}
+	return c, nil
+}
+
+func marshalValue(v *kvstore.Value) []byte {
+	var b []byte
+	if !v.Timestamp.IsZero() {
+		b = protowire.AppendTag(b, pbValueTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v.Timestamp.UnixNano()))
+	}
+	if v.Pin {
+		b = protowire.AppendTag(b, pbValuePin, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v.Pin))
+	}
+	if len(v.Data) > 0 {
+		b = protowire.AppendTag(b, pbValueData, protowire.BytesType)
+		b = protowire.AppendBytes(b, v.Data)
+	}
+	return b
+}
+
+func unmarshalValue(b []byte) (kvstore.Value, error) {
+	var v kvstore.Value
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return v, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == pbValueTimestamp && typ == protowire.VarintType:
+			var ts uint64
+			ts, n = protowire.ConsumeVarint(b)
+			v.Timestamp = time.Unix(0, int64(ts))
+		case num == pbValuePin && typ == protowire.VarintType:
+			var pin uint64
+			pin, n = protowire.ConsumeVarint(b)
+			v.Pin = protowire.DecodeBool(pin)
+		case num == pbValueData && typ == protowire.BytesType:
+			v.Data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return v, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return v, nil
+}
+
+// int32 fields are varints, negative numbers are sign extended to 64 bits
+func appendInt(b []byte, num protowire.Number, v int) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(int64(v)))
+}
+
+func consumeInt(b []byte) (int, int) {
+	v, n := protowire.ConsumeVarint(b)
+	return int(int32(v)), n
+}
+
+func consumeID(b []byte, id *kademliaid.T) (int, error) {
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+	if len(v) != kademliaid.IDLength {
+		return n, errors.New("protobuf: ID has the wrong length")
+	}
+	copy(id[:], v)
+	return n, nil
+}
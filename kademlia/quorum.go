@@ -0,0 +1,70 @@
+package kademlia
+
+import (
+	"errors"
+	"github.com/mjolnir92/kdfs/kademliaid"
+	"github.com/mjolnir92/kdfs/kvstore"
+)
+
+//Returned with the newest value found when a quorum read ended before enough replicas answered
+var ErrNoQuorum = errors.New("Fewer replicas than the quorum answered")
+
+//A value a node answered a FIND_VALUE with
+type foundValue struct {
+	value kvstore.Value
+	//The value came from the node's cache, it is not a replica the node is responsible for
+	cached bool
+}
+
+//Collects the versions of a value the replicas answered a quorum read with
+type quorum struct {
+	r int
+	//The version each replica answered with
+	replicas map[kademliaid.T]kvstore.Value
+}
+
+func newQuorum(r int) *quorum {
+	return &quorum{r: r, replicas: make(map[kademliaid.T]kvstore.Value)}
+}
+
+// add adds the version the replica with ID id has, true once r replicas have answered
+func (q *quorum) add(id *kademliaid.T, v kvstore.Value) bool {
+	q.replicas[*id] = v
+	return q.reached()
+}
+
+func (q *quorum) reached() bool {
+	return len(q.replicas) >= q.r
+}
+
+// newest returns the version with the latest timestamp. If two have the same timestamp, the pinned one wins,
+// losing a pin loses data while keeping one only keeps it longer.
+func (q *quorum) newest() kvstore.Value {
+	var newest kvstore.Value
+	for _, v := range q.replicas {
+		if newest.Before(v) || (v.Timestamp.Equal(newest.Timestamp) && v.Pin && !newest.Pin) {
+			newest = v
+		}
+	}
+	return newest
+}
+
+//A version of a value, the data of all versions is the same as its hash is the key
+type version struct {
+	timestamp int64
+	pin bool
+}
+
+// report sets how the replicas answered in stats
+func (q *quorum) report(stats *LookupStats) {
+	newest := q.newest()
+	versions := make(map[version]bool)
+	stats.Replicas = len(q.replicas)
+	for _, v := range q.replicas {
+		versions[version{v.Timestamp.UnixNano(), v.Pin}] = true
+		if !v.Timestamp.Equal(newest.Timestamp) || v.Pin != newest.Pin {
+			stats.Stale++
+		}
+	}
+	stats.Versions = len(versions)
+}
@@ -0,0 +1,286 @@
+package kademlia
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+	"github.com/mjolnir92/kdfs/kademliaid"
+	"github.com/mjolnir92/kdfs/contact"
+	"github.com/mjolnir92/kdfs/constants"
+	"github.com/mjolnir92/kdfs/clock"
+)
+
+// A node that is not reachable from the outside registers with a relay and advertises the relay's address with
+// contact.T.Relayed set. Requests for it are wrapped in a RELAY and sent to the relay, which passes them on over
+// the address the registration came from. The response goes back the same way:
+//
+//	A --RELAY(Target: N)--> R --RELAY(Target: N, Address: A)--> N
+//	N --RELAY(Address: A)--> R --response--> A
+//
+// The RPC inside is signed and encrypted for N as usual, the RELAY itself is not encrypted so that R can read it.
+
+// Status of a RELAY_REGISTER_RESPONSE
+const (
+	RELAY_ACCEPTED = 0
+	// the node is not a relay or relays for too many nodes already
+	RELAY_REFUSED = 1
+)
+
+// The address of a request that arrived through a relay, responses to it are sent back through the relay
+const relayedSeparator = " via "
+
+type relayClient struct {
+	// the address the registration came from, which NAT lets the relay send to
+	address string
+	expires time.Time
+}
+
+// A request we passed on to a node we relay for
+type relayedRequest struct {
+	client kademliaid.T
+	id kademliaid.T
+}
+
+type relaying struct {
+	// the nodes we relay for, by ID
+	clients map[kademliaid.T]relayClient
+	// the addresses the requests we passed on came from, the only ones their responses are sent to
+	requests map[relayedRequest]relayClient
+	swept time.Time
+	// the relay we are registered with, nil if we don't use one
+	relay *contact.T
+	clock clock.T
+	mux sync.Mutex
+}
+
+func newRelaying(c clock.T) relaying {
+	return relaying{clients: make(map[kademliaid.T]relayClient), requests: make(map[relayedRequest]relayClient), swept: c.Now(), clock: c}
+}
+
+// forwarded records that the request with RPC ID id from address was passed on to client
+func (r *relaying) forwarded(client kademliaid.T, id kademliaid.T, address string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	now := r.clock.Now()
+	r.requests[relayedRequest{client, id}] = relayClient{address: address, expires: now.Add(constants.RELAYED_REQUEST_TTL)}
+	if now.Sub(r.swept) < constants.RELAYED_REQUEST_TTL {
+		return
+	}
+	for request, requester := range r.requests {
+		if now.After(requester.expires) {
+			delete(r.requests, request)
+		}
+	}
+	r.swept = now
+}
+
+// requester returns the address the request with RPC ID id we passed on to client came from
+func (r *relaying) requester(client kademliaid.T, id kademliaid.T) (string, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	requester, ok := r.requests[relayedRequest{client, id}]
+	if !ok || r.clock.Now().After(requester.expires) {
+		return "", false
+	}
+	return requester.address, true
+}
+
+// client returns the address of a node we relay for
+func (r *relaying) client(id kademliaid.T) (string, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	client, ok := r.clients[id]
+	if !ok || r.clock.Now().After(client.expires) {
+		return "", false
+	}
+	return client.address, true
+}
+
+// register adds or refreshes a node we relay for, returns false if we relay for too many already.
+// Until a registration expires it is only refreshed from the address it came from, so that nobody else can
+// register the ID and have its RPCs sent to them.
+func (r *relaying) register(id kademliaid.T, address string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	now := r.clock.Now()
+	for clientID, client := range r.clients {
+		if now.After(client.expires) {
+			delete(r.clients, clientID)
+		}
+	}
+	client, ok := r.clients[id]
+	if ok && client.address != address {
+		return false
+	}
+	if !ok && len(r.clients) >= constants.MAX_RELAYED_NODES {
+		return false
+	}
+	r.clients[id] = relayClient{address: address, expires: now.Add(constants.RELAY_TTL)}
+	return true
+}
+
+func (r *relaying) getRelay() *contact.T {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.relay
+}
+
+func (r *relaying) setRelay(relay *contact.T) {
+	r.mux.Lock()
+	r.relay = relay
+	r.mux.Unlock()
+}
+
+// splitRelayed splits the address of a request that came through a relay into the address of its sender and the relay
+func splitRelayed(raddr string) (string, string, bool) {
+	return strings.Cut(raddr, relayedSeparator)
+}
+
+// sendRelayed wraps b in a RELAY for the relay to pass on. target is the node to pass it to, or
+// empty for a response that the relay sends to the address to.
+func (nw *T) sendRelayed(id kademliaid.T, b []byte, relay string, target kademliaid.T, to string) error {
+	msg := RPCRelay{RPCType: RELAY, Version: PROTOCOL_VERSION, RPCID: id, Sender: nw.me(), Target: target, Address: to, Data: b}
+	// every node understands msgpack
+	wrapped, err := nw.marshal(MsgPack, msg)
+	if err != nil {
+		return err
+	}
+	return nw.writeTo(id, wrapped, relay)
+}
+
+// relayReceived handles a RELAY. It is either for us, from the relay we are registered with, or we pass it on as a relay.
+func (nw *T) relayReceived(codec Codec, b []byte, raddr string) {
+	var msg RPCRelay
+	err := codec.Unmarshal(b, &msg)
+	if err != nil {
+		log.Printf("Failed to unmarshal into struct")
+		return
+	}
+	me := nw.me()
+	switch {
+	case msg.Target == *me.ID:
+		relay := nw.relaying.getRelay()
+		if relay == nil || !msg.Sender.ID.Equals(relay.ID) {
+			log.Printf("Dropping relayed RPC from %v, it is not our relay\n", raddr)
+			return
+		}
+		nw.resolveRPC(msg.Data, msg.Address+relayedSeparator+raddr)
+	case msg.Target == kademliaid.T{}:
+		// a response from a node we relay for. It only goes to the address of a request we passed on to the node,
+		// msg.Address is ignored so that the node can't use us to send to anybody else.
+		address, ok := nw.relaying.client(*msg.Sender.ID)
+		if !ok || address != raddr {
+			log.Printf("Dropping RELAY from %v, it is not registered\n", raddr)
+			return
+		}
+		requester, ok := nw.relaying.requester(*msg.Sender.ID, msg.RPCID)
+		if !ok {
+			log.Printf("Dropping RELAY from %v, it is no response to a request we passed on\n", raddr)
+			return
+		}
+		err = nw.writeTo(msg.RPCID, msg.Data, requester)
+	default:
+		address, ok := nw.relaying.client(msg.Target)
+		if !ok {
+			log.Printf("Dropping RELAY for %v, it is not registered\n", msg.Target.String())
+			return
+		}
+		nw.relaying.forwarded(msg.Target, msg.RPCID, raddr)
+		err = nw.sendRelayed(msg.RPCID, msg.Data, address, msg.Target, raddr)
+	}
+	if err != nil {
+		log.Printf("Failed to relay: %v\n", err)
+	}
+}
+
+func (nw *T) relayRegisterResponse(codec Codec, b []byte, raddr string) {
+	var msg RPCRelayRegister
+	err := codec.Unmarshal(b, &msg)
+	if err != nil {
+		log.Printf("Failed to unmarshal into struct")
+		return
+	}
+	status := RELAY_REFUSED
+	if nw.options.Relay && nw.relaying.register(*msg.Sender.ID, raddr) {
+		status = RELAY_ACCEPTED
+	}
+	response := RPCRelayRegisterResponse{RPCType: RELAY_REGISTER_RESPONSE, Version: PROTOCOL_VERSION, RPCID: msg.RPCID, Sender: nw.me(), Status: status}
+	err = nw.respond(codec, msg.Sender.ID, msg.RPCID, response, raddr)
+	if err != nil {
+		log.Printf("Failed to respond to relay registration: %v\n", err)
+	}
+}
+
+// registerWith asks relay to relay for us, or to keep doing so
+func (nw *T) registerWith(relay *contact.T) error {
+	msg := RPCRelayRegister{RPCType: RELAY_REGISTER, Version: PROTOCOL_VERSION, RPCID: *nw.newRandomID(), Sender: nw.me()}
+	var res RPCRelayRegisterResponse
+	err := nw.rpc(context.Background(), relay, msg.RPCID, msg, &res)
+	if err != nil {
+		return err
+	}
+	if res.Status != RELAY_ACCEPTED {
+		return errors.New("Relay refused the registration")
+	}
+	return nil
+}
+
+//Registers with relay and advertises it as our address. The registration is refreshed every constants.RELAY_REFRESH,
+//which also keeps the NAT mapping open. If that fails another relay is looked for.
+func (nw *T) UseRelay(relay *contact.T) error {
+	if relay.Relayed {
+		return errors.New("A relayed node can't be a relay")
+	}
+	err := nw.registerWith(relay)
+	if err != nil {
+		return err
+	}
+	r := *relay
+	nw.relaying.setRelay(&r)
+	nw.mux.Lock()
+	nw.contactMe.Address = r.Address
+	nw.contactMe.Addrs = r.Addrs
+	nw.contactMe.Relayed = true
+	nw.mux.Unlock()
+	log.Printf("Advertising relay %v, we are not reachable\n", r.Address)
+	f := func() {
+		current := nw.relaying.getRelay()
+		if current == nil {
+			return
+		}
+		if err := nw.registerWith(current); err != nil {
+			log.Printf("Lost relay %v: %v\n", current.Address, err)
+			nw.findRelay()
+		}
+	}
+	nw.eventmanager.InsertEvent(*nw.contactMe.ID, constants.RELAY, f, constants.RELAY_REFRESH)
+	return nil
+}
+
+// stopRelay stops refreshing the registration, the relay forgets us after constants.RELAY_TTL
+func (nw *T) stopRelay() {
+	if nw.relaying.getRelay() == nil {
+		return
+	}
+	nw.relaying.setRelay(nil)
+	nw.eventmanager.DeleteEvent(*nw.contactMe.ID, constants.RELAY)
+}
+
+// findRelay registers with the first node in the routing table that offers to relay, returns false if none did
+func (nw *T) findRelay() bool {
+	me := nw.me()
+	current := nw.relaying.getRelay()
+	for _, c := range nw.routingtable.FindClosestContacts(me.ID, constants.K) {
+		capabilities, _ := nw.routingtable.GetCapabilities(c.ID)
+		if capabilities&CAP_RELAY == 0 || c.Relayed || (current != nil && c.ID.Equals(current.ID)) {
+			continue
+		}
+		if nw.UseRelay(&c) == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package kademlia
+
+import (
+	"errors"
+	"crypto/ed25519"
+	"github.com/mjolnir92/kdfs/kademliaid"
+	"github.com/mjolnir92/kdfs/identity"
+)
+
+// Messages that are not plain RPCs start with frameEscape followed by the kind of frame.
+// 0xc1 is never used by msgpack and our protobuf messages always start with 0x08, so a frame can't be mistaken for an RPC.
+const (
+	frameEscape = 0xc1
+	// followed by the Ed25519 signature of the rest of the message
+	frameSigned = 'S'
+	// see encrypt.go
+	frameEncrypted = 'E'
+	// see compress.go
+	frameCompressed = 'Z'
+)
+
+// marshal encodes msg and signs it if the node has an identity
+func (nw *T) marshal(codec Codec, msg interface{}) ([]byte, error) {
+	b, err := codec.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if nw.options.Identity == nil {
+		return b, nil
+	}
+	signed := make([]byte, 0, 2+ed25519.SignatureSize+len(b))
+	signed = append(signed, frameEscape, frameSigned)
+	signed = append(signed, nw.options.Identity.Sign(b)...)
+	return append(signed, b...), nil
+}
+
+// unframe splits a signed message into the RPC and its signature. The signature is nil if the message isn't signed.
+func unframe(b []byte) ([]byte, []byte, error) {
+	if len(b) == 0 || b[0] != frameEscape {
+		return b, nil, nil
+	}
+	if len(b) < 2+ed25519.SignatureSize || b[1] != frameSigned {
+		return nil, nil, errors.New("Unknown frame")
+	}
+	return b[2+ed25519.SignatureSize:], b[2:2+ed25519.SignatureSize], nil
+}
+
+// verify checks that the sender of an RPC signed it and that its ID is derived from its key.
+// Unsigned RPCs are only accepted by nodes without an identity.
+func (nw *T) verify(header *RPCHeader, message []byte, signature []byte) error {
+	if signature == nil {
+		if nw.options.Identity != nil {
+			return errors.New("RPC is not signed")
+		}
+		return nil
+	}
+	key := header.Sender.PublicKey
+	if header.Sender.ID == nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("Sender has no public key")
+	}
+	if *kademliaid.NewFromPublicKey(key) != *header.Sender.ID {
+		return errors.New("Sender ID is not derived from its public key")
+	}
+	if !identity.Verify(key, message, signature) {
+		return errors.New("Bad signature")
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package kademlia
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+	"github.com/mjolnir92/kdfs/clock"
+	"github.com/mjolnir92/kdfs/contact"
+	"github.com/mjolnir92/kdfs/constants"
+	"github.com/mjolnir92/kdfs/kademliaid"
+)
+
+// Bytes of a STORE token
+const TOKEN_SIZE = 16
+
+// STORE tokens, like the ones of BitTorrent's DHT. FIND_NODE and FIND_VALUE responses hand out a token
+// made from the requester's IP and a secret, a STORE is only accepted with a token for the IP it comes from.
+// Nobody can make us store values for an address they can't receive responses on.
+// The secret changes every TOKEN_ROTATION, tokens made with the previous one are still accepted.
+type tokens struct {
+	secret []byte
+	previous []byte
+	rotated time.Time
+	clock clock.T
+	mux sync.Mutex
+}
+
+// The tokens other nodes gave us, by node ID
+type storeTokens struct {
+	tokens map[kademliaid.T]storeToken
+	swept time.Time
+	clock clock.T
+	mux sync.Mutex
+}
+
+type storeToken struct {
+	token []byte
+	received time.Time
+}
+
+func newTokens(c clock.T) *tokens {
+	return &tokens{secret: newSecret(), previous: newSecret(), rotated: c.Now(), clock: c}
+}
+
+func newStoreTokens(c clock.T) storeTokens {
+	return storeTokens{tokens: make(map[kademliaid.T]storeToken), swept: c.Now(), clock: c}
+}
+
+func newSecret() []byte {
+	secret := make([]byte, sha256.Size)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// rotate changes the secrets that are due, must be called with mux held
+func (t *tokens) rotate() {
+	elapsed := clock.Since(t.clock, t.rotated)
+	if elapsed < constants.TOKEN_ROTATION {
+		return
+	}
+	if elapsed < 2*constants.TOKEN_ROTATION {
+		t.previous = t.secret
+	} else {
+		// the previous secret is too old as well
+		t.previous = newSecret()
+	}
+	t.secret = newSecret()
+	t.rotated = t.clock.Now()
+}
+
+// token returns the token for STOREs from raddr
+func (t *tokens) token(raddr string) []byte {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.rotate()
+	return makeToken(t.secret, raddr)
+}
+
+// valid tells whether token was handed out to raddr
+func (t *tokens) valid(token []byte, raddr string) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.rotate()
+	return hmac.Equal(token, makeToken(t.secret, raddr)) || hmac.Equal(token, makeToken(t.previous, raddr))
+}
+
+func makeToken(secret []byte, raddr string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(sourceHost(raddr)))
+	return mac.Sum(nil)[:TOKEN_SIZE]
+}
+
+// sourceHost returns the IP a request came from. The port is left out, NAT may change it between requests.
+func sourceHost(raddr string) string {
+	if to, _, ok := splitRelayed(raddr); ok {
+		// the relay saw the request come from to
+		raddr = to
+	}
+	host, _, err := net.SplitHostPort(raddr)
+	if err != nil {
+		// not an IP address and a port, e.g. an in-memory transport
+		return raddr
+	}
+	return host
+}
+
+// get returns the token id gave us, nil if we have none that is still valid
+func (s *storeTokens) get(id kademliaid.T) []byte {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	t, ok := s.tokens[id]
+	// a token is accepted for at least TOKEN_ROTATION
+	if !ok || clock.Since(s.clock, t.received) >= constants.TOKEN_ROTATION {
+		return nil
+	}
+	return t.token
+}
+
+func (s *storeTokens) put(id kademliaid.T, token []byte) {
+	if len(token) == 0 {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := s.clock.Now()
+	s.tokens[id] = storeToken{token: token, received: now}
+	if now.Sub(s.swept) < constants.TOKEN_ROTATION {
+		return
+	}
+	// lookups collect tokens from many nodes, the expired ones are removed now and then
+	for id, t := range s.tokens {
+		if now.Sub(t.received) >= constants.TOKEN_ROTATION {
+			delete(s.tokens, id)
+		}
+	}
+	s.swept = now
+}
+
+func (s *storeTokens) forget(id kademliaid.T) {
+	s.mux.Lock()
+	delete(s.tokens, id)
+	s.mux.Unlock()
+}
+
+// sourceMatches tells whether a request from raddr can come from the node c, i.e. whether it was sent from
+// one of the IPs c advertises. Without the check anybody could put other nodes' IDs or addresses in our buckets.
+// It runs on the receive path, so host names are not resolved: a node that advertises one matches only that address.
+func sourceMatches(c *contact.T, raddr string) bool {
+	to, relay, relayed := splitRelayed(raddr)
+	if c.Relayed {
+		// the address of a relayed node is its relay's, only a request that came through that relay can be from it.
+		// The relay only passes RPCs on to the node that registered the ID.
+		return relayed && relay == c.Address
+	}
+	if relayed {
+		raddr = to
+	}
+	if c.Address == raddr {
+		return true
+	}
+	ip, err := netip.ParseAddr(sourceHost(raddr))
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, a := range c.Addrs {
+		if a.Addr().Unmap() == ip {
+			return true
+		}
+	}
+	addr, err := netip.ParseAddrPort(c.Address)
+	return err == nil && addr.Addr().Unmap() == ip
+}
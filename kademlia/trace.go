@@ -0,0 +1,64 @@
+package kademlia
+
+import (
+	"sync"
+	"time"
+	"github.com/mjolnir92/kdfs/clock"
+	"github.com/mjolnir92/kdfs/contact"
+	"github.com/mjolnir92/kdfs/kademliaid"
+)
+
+//A query of a traced lookup and what came of it
+type TraceStep struct {
+	//The node that was queried
+	Contact contact.T
+	//Distance of the node to the target
+	Distance kademliaid.T
+	//Round the node was queried in: 1 for the contacts the lookup started with, 2 for those they returned and so on
+	Round int
+	//Path of a disjoint lookup the query was sent on, from 0
+	Path int
+	//Time from sending the query to its answer or failure, retries included
+	RTT time.Duration
+	//Contacts the node returned
+	Contacts []contact.T
+	//The node returned the value
+	Found bool
+	//Why the query failed, nil if it didn't
+	Err error
+}
+
+//The queries of a lookup, in the order they finished. Queries still in flight when the lookup ended are left out.
+type Trace struct {
+	Target kademliaid.T
+	Steps []TraceStep
+}
+
+//Records the queries of a lookup, from the goroutines that send them
+type tracer struct {
+	clock clock.T
+	trace Trace
+	mux sync.Mutex
+}
+
+func newTracer(c clock.T, target *kademliaid.T) *tracer {
+	return &tracer{clock: c, trace: Trace{Target: *target}}
+}
+
+// record adds the query that was sent at start on path in round and was answered with reply or failed with err
+func (tr *tracer) record(path int, round int, start time.Time, reply *lookupReply, err error) {
+	step := TraceStep{Contact: reply.from, Round: round, Path: path, RTT: clock.Since(tr.clock, start), Contacts: reply.contacts, Found: reply.value != nil, Err: err}
+	step.Distance = *reply.from.ID.CalcDistance(&tr.trace.Target)
+	tr.mux.Lock()
+	tr.trace.Steps = append(tr.trace.Steps, step)
+	tr.mux.Unlock()
+}
+
+// get returns the steps recorded so far
+func (tr *tracer) get() Trace {
+	tr.mux.Lock()
+	defer tr.mux.Unlock()
+	trace := tr.trace
+	trace.Steps = append([]TraceStep(nil), tr.trace.Steps...)
+	return trace
+}
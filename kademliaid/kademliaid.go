@@ -3,6 +3,7 @@ package kademliaid
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"io"
 	"math/rand"
 )
 
@@ -27,6 +28,11 @@ func NewHash(data []byte) *T {
 	return &newKademliaID
 }
 
+//The ID of a node is the hash of its public key, so that a node can prove that it owns its ID by signing with the key
+func NewFromPublicKey(publicKey []byte) *T {
+	return NewHash(publicKey)
+}
+
 func NewRandom() *T {
 	newKademliaID := T{}
 	for i := 0; i < IDLength; i++ {
@@ -35,10 +41,21 @@ func NewRandom() *T {
 	return &newKademliaID
 }
 
+//Returns a random kademliaid read from r, e.g. a seeded source so that a simulation can be repeated
+func NewRandomFrom(r io.Reader) *T {
+	newKademliaID := T{}
+	io.ReadFull(r, newKademliaID[:])
+	return &newKademliaID
+}
+
 //Returns a random kademliaid with common prefix of length n to contact
 func NewRandomCommonPrefix(id T, n uint8) *T {
+	return CommonPrefix(*NewRandom(), id, n)
+}
+
+//Returns the random kademliaid id_rand changed to have a common prefix of length n with id, see NewRandomCommonPrefix
+func CommonPrefix(id_rand T, id T, n uint8) *T {
 	id_old := id
-	id_rand := *NewRandom()
 	//Iterate through the byte slice. Replace entire bytes in the new id if the prefix covers that byte
 	//If the prefix only covers part of a byte, mask out the bytes from the prefix that should remain
 	for i := 0; i < IDLength; i++ {
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"fmt"
 	"strings"
+	"math/rand"
 )
 
 func TestNewRandomCommonPrefix(t *testing.T) {
@@ -23,4 +24,44 @@ func TestNewRandomCommonPrefix(t *testing.T) {
 			t.Error("TestNewRandomCommonPrefix failed, The bit after the prefix ended was still common")
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestNewRandomFrom(t *testing.T) {
+	first := NewRandomFrom(rand.New(rand.NewSource(1)))
+	second := NewRandomFrom(rand.New(rand.NewSource(1)))
+	if *first != *second {
+		t.Error("TestNewRandomFrom failed, the same seed gave different IDs")
+	}
+	if *first == *NewRandomFrom(rand.New(rand.NewSource(2))) {
+		t.Error("TestNewRandomFrom failed, another seed gave the same ID")
+	}
+}
+
+func TestPuzzle(t *testing.T) {
+	if New("00F0000000000000000000000000000000000000").LeadingZeros() != 8 {
+		t.Error("TestPuzzle failed, wrong number of leading zeros")
+	}
+	puzzle := Puzzle{Dynamic: 12}
+	id := NewRandom()
+	nonce := puzzle.Solve(id)
+	if !puzzle.Check(id, &nonce) {
+		t.Error("TestPuzzle failed, the solution doesn't check out")
+	}
+	if (Puzzle{Dynamic: 24}).CheckDynamic(NewRandom(), &nonce) {
+		t.Error("TestPuzzle failed, the solution should not work for other IDs")
+	}
+	if !(Puzzle{}).Check(id, &T{}) {
+		t.Error("TestPuzzle failed, a difficulty of 0 should accept every ID")
+	}
+	static := Puzzle{Static: 4}
+	found := 0
+	for i := 0; i < 1000; i++ {
+		if static.CheckStatic(NewRandom()) {
+			found++
+		}
+	}
+	// about 1 in 16 random IDs solve it
+	if found == 0 || found > 200 {
+		t.Error("TestPuzzle failed, the static puzzle accepted", found, "of 1000 random IDs")
+	}
+}
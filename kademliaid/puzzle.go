@@ -0,0 +1,54 @@
+package kademliaid
+
+import (
+	"math/bits"
+)
+
+//S/Kademlia crypto puzzles, they make node IDs expensive so that an attacker can't place nodes next to a key.
+//Static: the hash of the ID has to start with Static zero bits. The ID is the hash of a public key,
+//so a node has to generate keys until it finds one that solves the puzzle.
+//Dynamic: the hash of the ID xor a nonce has to start with Dynamic zero bits. The nonce is sent with the contact
+//and can be solved again if the network raises the difficulty, without changing the ID.
+//A difficulty of 0 turns the puzzle off.
+type Puzzle struct {
+	Static int
+	Dynamic int
+}
+
+//Returns the number of leading zero bits
+func (kademliaID T) LeadingZeros() int {
+	for i := 0; i < IDLength; i++ {
+		if kademliaID[i] != 0 {
+			return i*8 + bits.LeadingZeros8(kademliaID[i])
+		}
+	}
+	return IDLength * 8
+}
+
+func (p Puzzle) CheckStatic(id *T) bool {
+	return p.Static <= 0 || NewHash(id[:]).LeadingZeros() >= p.Static
+}
+
+func (p Puzzle) CheckDynamic(id *T, nonce *T) bool {
+	return p.Dynamic <= 0 || NewHash(id.CalcDistance(nonce)[:]).LeadingZeros() >= p.Dynamic
+}
+
+//Checks that id and nonce solve both puzzles
+func (p Puzzle) Check(id *T, nonce *T) bool {
+	return p.CheckStatic(id) && p.CheckDynamic(id, nonce)
+}
+
+//Finds a nonce that solves the dynamic puzzle for id. Takes about 2^Dynamic hashes.
+func (p Puzzle) Solve(id *T) T {
+	nonce := T{}
+	for !p.CheckDynamic(id, &nonce) {
+		//count upwards, the last byte is the least significant
+		for i := IDLength - 1; i >= 0; i-- {
+			nonce[i]++
+			if nonce[i] != 0 {
+				break
+			}
+		}
+	}
+	return nonce
+}
@@ -9,25 +9,82 @@ import (
 	"github.com/mjolnir92/kdfs/kademlia"
 	"github.com/mjolnir92/kdfs/kademliaid"
 	"github.com/mjolnir92/kdfs/contact"
+	"github.com/mjolnir92/kdfs/constants"
+	"github.com/mjolnir92/kdfs/identity"
 	"fmt"
+	"strings"
+	"strconv"
+	"encoding/hex"
 	"net/http"
 	"os"
 	"log"
 	"net"
-	"strconv"
+	"net/netip"
+	"context"
+	"errors"
+	"os/signal"
+	"syscall"
 )
 
 //var port_rest uint16
 var portDHT uint16 = 1200
 var joinAddress string
+var retries int
+var codec string
+var keyFile string
+var puzzle kademliaid.Puzzle
+var limits kademlia.Limits
+var relay bool
+var compression bool
+var paths int
+var faults kademlia.Faults
+var partitions []string
 //var dhtAddress string
 
 func init() {
 	RootCmd.Flags().StringVarP(&joinAddress, "join", "j", "", "join the a network with a node at address")
+	RootCmd.Flags().IntVarP(&retries, "retries", "r", constants.RETRIES, "times an RPC is sent again before a node is considered dead")
+	RootCmd.Flags().StringVar(&codec, "codec", "msgpack", "encoding of the RPCs this node sends, msgpack or protobuf")
+	RootCmd.Flags().IntVar(&puzzle.Static, "static-puzzle", 0, "leading zero bits of the hashed node IDs, all nodes in the network have to agree on it")
+	RootCmd.Flags().IntVar(&puzzle.Dynamic, "dynamic-puzzle", 0, "leading zero bits of the hashed node IDs xor their nonce, all nodes in the network have to agree on it")
+	RootCmd.Flags().Float64Var(&limits.SourceRate, "source-rate", constants.SOURCE_RATE, "requests per second accepted from one IP address, 0 for no limit")
+	RootCmd.Flags().IntVar(&limits.SourceBurst, "source-burst", constants.SOURCE_BURST, "requests accepted at once from one IP address")
+	RootCmd.Flags().Float64Var(&limits.TypeRate, "type-rate", constants.TYPE_RATE, "requests per second accepted of each RPC type, 0 for no limit")
+	RootCmd.Flags().IntVar(&limits.TypeBurst, "type-burst", constants.TYPE_BURST, "requests accepted at once of each RPC type")
+	RootCmd.Flags().IntVar(&limits.MaxStores, "max-stores", constants.MAX_CONCURRENT_STORES, "stores handled at the same time, 0 for no limit")
+	RootCmd.Flags().BoolVar(&relay, "relay", false, "relay RPCs for nodes behind NAT, only useful if this node is publicly reachable")
+	RootCmd.Flags().BoolVar(&compression, "compression", true, "compress RPCs to nodes that support it")
+	RootCmd.Flags().IntVar(&paths, "paths", constants.LOOKUP_PATHS, "disjoint paths of a lookup, more resist lying nodes better but cost more RPCs")
+	RootCmd.Flags().Float64Var(&faults.DropRate, "fault-drop", 0, "probability that a datagram is lost, for chaos experiments")
+	RootCmd.Flags().Float64Var(&faults.DuplicateRate, "fault-duplicate", 0, "probability that a datagram is sent twice, for chaos experiments")
+	RootCmd.Flags().DurationVar(&faults.Delay, "fault-delay", 0, "delay added to every datagram sent, for chaos experiments")
+	RootCmd.Flags().DurationVar(&faults.Jitter, "fault-jitter", 0, "random delay of up to this much added to every datagram sent, reorders them")
+	RootCmd.Flags().StringArrayVar(&partitions, "fault-partition", nil, "comma separated IDs of nodes that can only talk among themselves, can be given more than once")
+	RootCmd.Flags().BoolVar(&faults.Lie, "fault-lie", false, "answer lookups with made up contacts and never with a value, to test how lookups resist it")
+	RootCmd.Flags().Int64Var(&faults.Seed, "fault-seed", 0, "seed of the injected faults, 0 for a random one")
+	RootCmd.Flags().StringVarP(&keyFile, "key", "k", "kademlia.key", "file with the private key of the node, a new key is created if it doesn't exist")
 	//RootCmd.Flags().Uint16VarP(&port, "port", "p", 8080, "the port that the REST API will use")
 	//RootCmd.Flags().StringVarP(&dhtAddress, "dht-address", "a", "localhost:9999", "the internet socket that the DHT will use")
 }
 
+//Parses a comma separated list of node IDs in hex
+func parsePartition(s string) ([]kademliaid.T, error) {
+	var set []kademliaid.T
+	for _, h := range strings.Split(s, ",") {
+		b, err := hex.DecodeString(strings.TrimSpace(h))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != kademliaid.IDLength {
+			return nil, fmt.Errorf("%v is not %v bytes long", h, kademliaid.IDLength)
+		}
+		var id kademliaid.T
+		copy(id[:], b)
+		set = append(set, id)
+	}
+	return set, nil
+}
+
 func main() {
   if err := RootCmd.Execute(); err != nil {
     os.Exit(1)
@@ -44,13 +101,55 @@ var RootCmd = &cobra.Command{
 var kd *kademlia.T
 
 func startServer(cmd *cobra.Command, args []string) {
-	address := getOutboundIP().String() + ":" + strconv.Itoa(int(portDHT))
-	kid := kademliaid.NewHash([]byte(address))
-	contactMe := contact.New(kid, address)
-	kd = kademlia.New(&contactMe)
-	go kd.Listen(address)
+	ip4, ip6 := getOutboundIPs()
+	var addrs contact.Addrs
+	for _, ip := range []net.IP{ip4, ip6} {
+		if ip != nil {
+			addr, _ := netip.AddrFromSlice(ip)
+			addrs = append(addrs, netip.AddrPortFrom(addr.Unmap(), portDHT))
+		}
+	}
+	// the node ID is derived from the key, so that other nodes can check the signatures of our RPCs
+	ident, err := identity.LoadOrCreate(keyFile, puzzle)
+	if err != nil {
+		log.Fatalf("Failed to load the key: %v\n", err)
+	}
+	contactMe := contact.NewWithAddrs(ident.ID(), addrs)
+	options := kademlia.DefaultOptions()
+	options.Identity = ident
+	options.Puzzle = puzzle
+	options.Limits = limits
+	options.Relay = relay
+	options.Compression = compression
+	options.Paths = paths
+	options.Retries = retries
+	options.Faults = faults
+	for _, p := range partitions {
+		set, err := parsePartition(p)
+		if err != nil {
+			log.Fatalf("Bad partition %v: %v\n", p, err)
+		}
+		options.Faults.Partitions = append(options.Faults.Partitions, set)
+	}
+	options.Codec = kademlia.CodecByName(codec)
+	if options.Codec == nil {
+		log.Fatalf("Unknown codec %v\n", codec)
+	}
+	kd = kademlia.NewWithOptions(&contactMe, options)
+	// the socket is bound before joining, the pings of Join are sent from it
+	if len(addrs) == 2 {
+		err = kd.BindDualStack(addrs[0].String(), addrs[1].String())
+	} else {
+		err = kd.Bind(addrs[0].String())
+	}
+	if err != nil {
+		log.Fatalf("Error listening on %v: %v\n", addrs, err)
+	}
+	go kd.Serve()
 	if joinAddress != "" {
-		kd.Join(joinAddress)
+		if err := kd.Join(joinAddress); err != nil {
+			log.Printf("Failed to join the network at %v: %v\n", joinAddress, err)
+		}
 	}
 	router := gin.New()
 	router.Use(gin.Logger())
@@ -62,22 +161,53 @@ func startServer(cmd *cobra.Command, args []string) {
 		v1.GET("/store/:id", getEndpoint)
 		v1.POST("/pin/:id", pinEndpoint)
 		v1.POST("/unpin/:id", unpinEndpoint)
+		v1.GET("/stats", statsEndpoint)
+		v1.GET("/debug/lookup/:id", debugLookupEndpoint)
+	}
+	// same address as gin's router.Run()
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	srv := &http.Server{Addr: ":" + port, Handler: router}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Error serving the REST API: %v\n", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+	log.Printf("Received %v, shutting down\n", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), constants.SHUTDOWN_TIMEOUT)
+	defer cancel()
+	// stop taking requests first, the ones being handled still need the node
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down the REST API: %v\n", err)
+	}
+	if err := kd.Close(ctx); err != nil {
+		log.Printf("Error closing the node: %v\n", err)
 	}
-	router.Run()
 }
 
-// NOTE! this IP will be useless if there is NAT between the nodes
-// from https://stackoverflow.com/a/37382208
-// Get preferred outbound ip of this machine
-func getOutboundIP() net.IP {
-    conn, err := net.Dial("udp", "8.8.8.8:80")
-    if err != nil {
-        log.Fatal(err)
-    }
-    defer conn.Close()
-    //return conn.LocalAddr().String()
-    localAddr := conn.LocalAddr().(*net.UDPAddr)
-    return localAddr.IP
+// NOTE! behind NAT these IPs are private, once the node has joined it advertises the address other nodes see instead if it is reachable there (see kademlia/nat.go)
+// getOutboundIPs returns the IPv4 and IPv6 addresses of the interfaces that have a route to the internet, nil for a family without one.
+// Dialing UDP doesn't send anything, it only picks the local address.
+func getOutboundIPs() (net.IP, net.IP) {
+	var ips [2]net.IP
+	for i, target := range []string{"8.8.8.8:80", "[2001:4860:4860::8888]:80"} {
+		conn, err := net.Dial("udp", target)
+		if err != nil {
+			continue
+		}
+		ips[i] = conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+	}
+	if ips[0] == nil && ips[1] == nil {
+		log.Fatal("No route to the internet over IPv4 or IPv6")
+	}
+	return ips[0], ips[1]
 }
 
 // POST /store
@@ -92,32 +222,105 @@ func storeEndpoint(c *gin.Context) {
 		c.Data(http.StatusOK, binding.MIMEMSGPACK2, b)
 		return
 	}
-	id := kd.KademliaStore(req.File)
-	b, err := msgpack.Marshal(restmsg.StoreResponse{Status: http.StatusOK, Message: "Success", ID: id.String()})
+	id, replicas, err := kd.KademliaStore(c.Request.Context(), req.File)
+	if cancelled(c, err) {
+		return
+	}
+	res := restmsg.StoreResponse{Status: http.StatusOK, Message: "Success", ID: id.String(), Replicas: replicas}
+	if replicas == 0 {
+		res.Status = http.StatusServiceUnavailable
+		res.Message = "No node confirmed storing the data"
+	}
+	b, err := msgpack.Marshal(res)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to marshal response: %v", err))
 	}
 	c.Data(http.StatusOK, binding.MIMEMSGPACK2, b)
 }
 
-// GET /store/:id
+// GET /store/:id?quorum=3
+// With a quorum of more than 1 the data is read from that many replicas, and the newest version they have is returned.
+// A quorum larger than K is read from K replicas.
 func getEndpoint(c *gin.Context) {
 	var id string = c.Param("id")
 	kid := kademliaid.New(id)
-	file := kd.Cat(*kid)
-	b, err := msgpack.Marshal(restmsg.CatResponse{Status: http.StatusOK, Message: "Success", File: file})
+	quorum, err := strconv.Atoi(c.DefaultQuery("quorum", "1"))
+	if err != nil || quorum < 1 {
+		b, err := msgpack.Marshal(restmsg.GenericResponse{Status: http.StatusBadRequest, Message: "The quorum has to be a positive number"})
+		if err != nil {
+			panic(fmt.Sprintf("Failed to marshal response: %v", err))
+		}
+		c.Data(http.StatusOK, binding.MIMEMSGPACK2, b)
+		return
+	}
+	if quorum > constants.K {
+		// no more than K nodes keep a replica
+		quorum = constants.K
+	}
+	var res restmsg.CatResponse
+	if quorum > 1 {
+		res, err = quorumRead(c.Request.Context(), kid, quorum)
+	} else {
+		var file []byte
+		file, err = kd.Cat(c.Request.Context(), *kid)
+		res = restmsg.CatResponse{Status: http.StatusOK, Message: "Success", File: file}
+	}
+	if cancelled(c, err) {
+		return
+	}
+	if err != nil && err != kademlia.ErrNoQuorum {
+		res = restmsg.CatResponse{Status: http.StatusNotFound, Message: err.Error()}
+	}
+	b, err := msgpack.Marshal(res)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to marshal response: %v", err))
+	}
+	c.Data(http.StatusOK, binding.MIMEMSGPACK2, b)
+}
+
+// quorumRead reads the data from quorum replicas. If fewer answer, the newest version they have is in the response.
+func quorumRead(ctx context.Context, kid *kademliaid.T, quorum int) (restmsg.CatResponse, error) {
+	value, stats, err := kd.LookupDataQuorum(ctx, kid, quorum)
+	res := restmsg.CatResponse{Status: http.StatusOK, Message: "Success", File: value.Data, Timestamp: value.Timestamp, Pin: value.Pin, Replicas: stats.Replicas, Versions: stats.Versions, Stale: stats.Stale}
+	if err == kademlia.ErrNoQuorum {
+		res.Status = http.StatusServiceUnavailable
+		res.Message = fmt.Sprintf("Only %v of %v replicas answered", stats.Replicas, quorum)
+	} else if stats.Versions > 1 {
+		res.Message = fmt.Sprintf("The replicas disagree, %v of %v have another version", stats.Stale, stats.Replicas)
+	}
+	return res, err
+}
+
+// cancelled responds if err tells that the client went away or the request ran out of time, the lookups have stopped then
+func cancelled(c *gin.Context, err error) bool {
+	if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	b, err := msgpack.Marshal(restmsg.GenericResponse{Status: http.StatusGatewayTimeout, Message: "The request was cancelled before it finished"})
 	if err != nil {
 		panic(fmt.Sprintf("Failed to marshal response: %v", err))
 	}
 	c.Data(http.StatusOK, binding.MIMEMSGPACK2, b)
+	return true
+}
+
+// replicaResponse reports how many nodes confirmed a pin or unpin
+func replicaResponse(id string, replicas int) restmsg.StoreResponse {
+	if replicas == 0 {
+		return restmsg.StoreResponse{Status: http.StatusNotFound, Message: "The data was not found or no node confirmed the change", ID: id}
+	}
+	return restmsg.StoreResponse{Status: http.StatusOK, Message: "Success", ID: id, Replicas: replicas}
 }
 
 // POST /pin/:id
 func pinEndpoint(c *gin.Context) {
 	var id string = c.Param("id")
 	kid := kademliaid.New(id)
-	kd.Pin(*kid)
-	b, err := msgpack.Marshal(restmsg.GenericResponse{Status: http.StatusOK, Message: "Success"})
+	replicas, err := kd.Pin(c.Request.Context(), *kid)
+	if cancelled(c, err) {
+		return
+	}
+	b, err := msgpack.Marshal(replicaResponse(id, replicas))
 	if err != nil {
 		panic(fmt.Sprintf("Failed to marshal response: %v", err))
 	}
@@ -128,10 +331,68 @@ func pinEndpoint(c *gin.Context) {
 func unpinEndpoint(c *gin.Context) {
 	var id string = c.Param("id")
 	kid := kademliaid.New(id)
-	kd.Unpin(*kid)
-	b, err := msgpack.Marshal(restmsg.GenericResponse{Status: http.StatusOK, Message: "Success"})
+	replicas, err := kd.Unpin(c.Request.Context(), *kid)
+	if cancelled(c, err) {
+		return
+	}
+	b, err := msgpack.Marshal(replicaResponse(id, replicas))
+	if err != nil {
+		panic(fmt.Sprintf("Failed to marshal response: %v", err))
+	}
+	c.Data(http.StatusOK, binding.MIMEMSGPACK2, b)
+}
+
+// GET /stats
+func statsEndpoint(c *gin.Context) {
+	stats := kd.Stats()
+	b, err := msgpack.Marshal(restmsg.StatsResponse{Status: http.StatusOK, Message: "Success", DroppedSource: stats.DroppedSource, DroppedType: stats.DroppedType, DroppedStore: stats.DroppedStore})
+	if err != nil {
+		panic(fmt.Sprintf("Failed to marshal response: %v", err))
+	}
+	c.Data(http.StatusOK, binding.MIMEMSGPACK2, b)
+}
+
+// GET /debug/lookup/:id?type=node
+// Looks up the value with the given ID, or the closest nodes to it with type=node, and responds with every query
+// of the lookup. The trace is sent even if the lookup failed or the request ran out of time, that is when it helps most.
+func debugLookupEndpoint(c *gin.Context) {
+	var id string = c.Param("id")
+	kid := kademliaid.New(id)
+	res := restmsg.LookupTraceResponse{Status: http.StatusOK, Message: "Success", Target: kid.String(), Type: "value"}
+	var trace kademlia.Trace
+	var err error
+	if c.Query("type") == "node" {
+		res.Type = "node"
+		_, trace, err = kd.LookupContactTrace(c.Request.Context(), kid)
+	} else {
+		_, trace, err = kd.LookupDataTrace(c.Request.Context(), kid)
+		res.Found = err == nil
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	for _, step := range trace.Steps {
+		res.Steps = append(res.Steps, traceStep(&step))
+	}
+	b, err := msgpack.Marshal(res)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to marshal response: %v", err))
 	}
 	c.Data(http.StatusOK, binding.MIMEMSGPACK2, b)
 }
+
+// traceStep converts a step of a lookup trace for the REST API
+func traceStep(step *kademlia.TraceStep) restmsg.TraceStep {
+	res := restmsg.TraceStep{Contact: restContact(&step.Contact), Distance: step.Distance.String(), Round: step.Round, Path: step.Path, RTT: step.RTT, Found: step.Found}
+	for i := range step.Contacts {
+		res.Contacts = append(res.Contacts, restContact(&step.Contacts[i]))
+	}
+	if step.Err != nil {
+		res.Error = step.Err.Error()
+	}
+	return res
+}
+
+func restContact(c *contact.T) restmsg.Contact {
+	return restmsg.Contact{ID: c.ID.String(), Address: c.Address}
+}
@@ -0,0 +1,37 @@
+package kvstore
+
+import (
+	"log"
+	"github.com/golang/snappy"
+	"github.com/mjolnir92/kdfs/constants"
+)
+
+//Returns v the way the storer keeps it, with the data compressed if that makes it smaller.
+//The key is computed before, over the original data.
+func compress(v Value) Value {
+	if len(v.Data) < constants.COMPRESS_MIN_SIZE {
+		return v
+	}
+	compressed := snappy.Encode(nil, v.Data)
+	if len(compressed) >= len(v.Data) {
+		return v
+	}
+	v.Data = compressed
+	v.compressed = true
+	return v
+}
+
+//Returns a value from the storer with its original data, false if the data can't be decompressed
+func decompress(v Value) (Value, bool) {
+	if !v.compressed {
+		return v, true
+	}
+	data, err := snappy.Decode(nil, v.Data)
+	if err != nil {
+		log.Printf("Stored value is corrupt: %v\n", err)
+		return Value{}, false
+	}
+	v.Data = data
+	v.compressed = false
+	return v, true
+}
@@ -2,11 +2,28 @@ package kvstore
 
 import (
 	"sync"
+	"errors"
 	"github.com/mjolnir92/kdfs/kademliaid"
+	"github.com/mjolnir92/kdfs/constants"
+)
+
+var (
+	//The stored value is as new or newer than the one being stored
+	ErrStale = errors.New("A newer value is already stored")
+	//Storing the value would use more than the quota
+	ErrOverQuota = errors.New("Not enough space left in the store")
 )
 
 type T struct{
 	store storer
+	//Sum of the length of all stored data as it is stored, compressed or not. May not exceed quota
+	size int
+	quota int
+	//Copies of values that lookups found elsewhere, kept apart from the values this node is responsible for
+	//so that they are never republished and can't use up the space of those
+	cache storer
+	cacheSize int
+	cacheQuota int
 	mux sync.Mutex
 }
 
@@ -19,33 +36,78 @@ type storer interface{
 //Defaults to creating a T with a kvmap.
 //TODO: Options for selecting Store implementation
 func New() *T {
+	return NewWithQuota(constants.STORE_QUOTA)
+}
+
+//Creates a T that holds at most quota bytes of data
+func NewWithQuota(quota int) *T {
 	t := &T{}
 	t.store = NewKvmap()
+	t.quota = quota
+	t.cache = NewKvmap()
+	t.cacheQuota = constants.CACHE_QUOTA
 	return t
 }
 
-//Function to store a key-value pair. Returns true if the value was inserted
-func (t *T) Store(v Value) bool {
+//Function to store a key-value pair. Returns nil if the value was inserted,
+//ErrStale if the stored value is not older than v and ErrOverQuota if there is no room for v.
+//A cached copy of the value is dropped, the node is now responsible for it.
+func (t *T) Store(v Value) error {
 	t.mux.Lock()
+	defer t.mux.Unlock()
 	//Create a kademliaid (key) for the value to be inserted.
 	data := v.GetData()
 	key := kademliaid.NewHash(data)
-	inserted := false
 
-	current, ok := t.store.Get(*key)
+	err := set(t.store, &t.size, t.quota, key, v)
+	if err == nil {
+		unset(t.cache, &t.cacheSize, key)
+	}
+	return err
+}
+
+//Stores a copy of a value in the cache. Returns ErrStale if the value is stored already,
+//in the cache or as one the node is responsible for, and ErrOverQuota if there is no room for v in the cache.
+func (t *T) StoreCached(v Value) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	key := kademliaid.NewHash(v.GetData())
+	if _, ok := t.store.Get(*key); ok {
+		return ErrStale
+	}
+	return set(t.cache, &t.cacheSize, t.cacheQuota, key, v)
+}
+
+//Stores v under key in s, size is the size of the data in s
+func set(s storer, size *int, quota int, key *kademliaid.T, v Value) error {
+	stored := compress(v)
+
+	current, ok := s.Get(*key)
 	if ok {
-		//The key did exist
-		if current.Before(v) {
-			t.store.Set(*key, v)
-			inserted = true
+		//The key did exist, the data is the same so the size only changes if it was compressed differently
+		if !current.Before(v) {
+			return ErrStale
 		}
-	} else {
-		//Key did not already exist
-		t.store.Set(*key, v)
-		inserted = true
+		s.Set(*key, stored)
+		*size += len(stored.Data) - len(current.Data)
+		return nil
+	}
+	//Key did not already exist
+	if *size+len(stored.Data) > quota {
+		return ErrOverQuota
+	}
+	s.Set(*key, stored)
+	*size += len(stored.Data)
+	return nil
+}
+
+//Removes the value under key from s
+func unset(s storer, size *int, key *kademliaid.T) {
+	current, ok := s.Get(*key)
+	if ok {
+		s.Unset(*key)
+		*size -= len(current.Data)
 	}
-	t.mux.Unlock()
-	return inserted
 }
 
 //Removes a key-value pair from the storer
@@ -55,10 +117,14 @@ func (t *T) Remove(v Value) {
 	data := v.GetData()
 	key := kademliaid.NewHash(data)
 
-	_, ok := t.store.Get(*key)
-	if ok {
-		t.store.Unset(*key)
-	}
+	unset(t.store, &t.size, key)
+	t.mux.Unlock()
+}
+
+//Removes a cached copy of a value
+func (t *T) RemoveCached(v Value) {
+	t.mux.Lock()
+	unset(t.cache, &t.cacheSize, kademliaid.NewHash(v.GetData()))
 	t.mux.Unlock()
 }
 
@@ -66,5 +132,19 @@ func (t *T) Get(key kademliaid.T) (Value, bool) {
 	t.mux.Lock()
 	v, ok := t.store.Get(key)
 	t.mux.Unlock()
-	return v, ok
-}
\ No newline at end of file
+	if !ok {
+		return v, false
+	}
+	return decompress(v)
+}
+
+//Returns a cached copy of the value with the given key
+func (t *T) GetCached(key kademliaid.T) (Value, bool) {
+	t.mux.Lock()
+	v, ok := t.cache.Get(key)
+	t.mux.Unlock()
+	if !ok {
+		return v, false
+	}
+	return decompress(v)
+}
@@ -26,4 +26,91 @@ func TestKVStore(t *testing.T) {
 	if _, ok := kv.Get(*id); ok {
 		t.Error("TestKVStore failed, key-value pair did not get removed")
 	}
-}
\ No newline at end of file
+}
+
+func TestKVStoreStatus(t *testing.T) {
+	kv := NewWithQuota(8)
+	old := NewValue(false, []byte("data"))
+	v := NewValue(true, []byte("data"))
+
+	if err := kv.Store(v); err != nil {
+		t.Error("TestKVStoreStatus failed, value was not stored:", err)
+	}
+	if err := kv.Store(old); err != ErrStale {
+		t.Error("TestKVStoreStatus failed, an older value should be stale, got", err)
+	}
+	if err := kv.Store(NewValue(false, []byte("too much"))); err != ErrOverQuota {
+		t.Error("TestKVStoreStatus failed, the quota should be exceeded, got", err)
+	}
+	kv.Remove(v)
+	if err := kv.Store(NewValue(false, []byte("too much"))); err != nil {
+		t.Error("TestKVStoreStatus failed, removing a value should free its space:", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("text compresses well "), 100)
+	//The quota is too small for the uncompressed data
+	kv := NewWithQuota(len(data) / 2)
+	v := NewValue(false, data)
+	if err := kv.Store(v); err != nil {
+		t.Fatal("TestCompression failed, value was not stored:", err)
+	}
+	if kv.size >= len(data) {
+		t.Error("TestCompression failed, the value was stored uncompressed")
+	}
+	//The key is still the hash of the original data
+	got, ok := kv.Get(*kademliaid.NewHash(data))
+	if !ok || !bytes.Equal(got.Data, data) || got.compressed {
+		t.Error("TestCompression failed, the original data was not returned")
+	}
+	//Storing a newer version and removing it keeps the size right
+	if err := kv.Store(NewValue(true, data)); err != nil {
+		t.Error("TestCompression failed, newer value was not stored:", err)
+	}
+	kv.Remove(v)
+	if kv.size != 0 {
+		t.Error("TestCompression failed, expected size 0 after removing, got", kv.size)
+	}
+	//Data that doesn't compress is stored as it is
+	random := kademliaid.NewRandom()
+	kv.Store(NewValue(false, random[:]))
+	if kv.size != len(random) {
+		t.Error("TestCompression failed, small values should not be compressed")
+	}
+}
+
+func TestKVStoreCache(t *testing.T) {
+	kv := New()
+	v := NewValue(false, []byte("data"))
+	id := kademliaid.NewHash(v.Data)
+
+	if err := kv.StoreCached(v); err != nil {
+		t.Fatal("TestKVStoreCache failed, value was not cached:", err)
+	}
+	if _, ok := kv.Get(*id); ok {
+		t.Error("TestKVStoreCache failed, a cached value was returned as a stored one")
+	}
+	if got, ok := kv.GetCached(*id); !ok || !bytes.Equal(got.Data, v.Data) {
+		t.Error("TestKVStoreCache failed, the cached value was not returned")
+	}
+	if kv.size != 0 || kv.cacheSize != len(v.Data) {
+		t.Error("TestKVStoreCache failed, the cached value counted towards the wrong quota")
+	}
+	//Storing the value for real replaces the cached copy, which can't come back
+	if err := kv.Store(v); err != nil {
+		t.Fatal("TestKVStoreCache failed, value was not stored:", err)
+	}
+	if _, ok := kv.GetCached(*id); ok || kv.cacheSize != 0 {
+		t.Error("TestKVStoreCache failed, the cached copy was kept after storing the value")
+	}
+	if err := kv.StoreCached(NewValue(true, v.Data)); err != ErrStale {
+		t.Error("TestKVStoreCache failed, a stored value should not be cached, got", err)
+	}
+	kv.Remove(v)
+	kv.StoreCached(v)
+	kv.RemoveCached(v)
+	if _, ok := kv.GetCached(*id); ok || kv.cacheSize != 0 {
+		t.Error("TestKVStoreCache failed, the cached value was not removed")
+	}
+}
@@ -10,6 +10,8 @@ type Value struct {
 	Timestamp time.Time
 	Pin bool
 	Data []byte
+	//Data is snappy compressed, only for values kept by the storer. It is not sent to other nodes.
+	compressed bool
 }
 
 
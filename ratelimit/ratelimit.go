@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+//Buckets that have been full for this long are forgotten, a new one starts full anyway
+const IDLE_TIME = time.Minute
+
+//A token bucket. Tokens are added at rate per second, up to burst. Every allowed event takes one token.
+type Bucket struct {
+	rate float64
+	burst float64
+	tokens float64
+	last time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+//Takes a token if there is one. A rate of 0 allows everything.
+func (b *Bucket) Allow(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	//now can be a bit before last when callers race for the bucket
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+//Keeps one token bucket for every key, e.g. a bucket per IP address
+type T struct {
+	rate float64
+	burst int
+	buckets map[string]*Bucket
+	lastCleanup time.Time
+	mux sync.Mutex
+}
+
+func New(rate float64, burst int) *T {
+	return &T{rate: rate, burst: burst, buckets: make(map[string]*Bucket), lastCleanup: time.Now()}
+}
+
+//Takes a token from the bucket of key if there is one
+func (l *T) Allow(key string) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if now.Sub(l.lastCleanup) > IDLE_TIME {
+		l.cleanup(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	return b.Allow(now)
+}
+
+//Removes the buckets that have filled up again, so that keys that are not used anymore don't take up memory
+func (l *T) cleanup(now time.Time) {
+	full := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full+IDLE_TIME {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastCleanup = now
+}
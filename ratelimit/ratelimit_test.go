@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	b := NewBucket(10, 5)
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if !b.Allow(now) {
+			t.Fatal("TestBucket failed, the burst was not allowed")
+		}
+	}
+	if b.Allow(now) {
+		t.Error("TestBucket failed, more than the burst was allowed")
+	}
+	//one token is added every 100ms
+	if !b.Allow(now.Add(100 * time.Millisecond)) {
+		t.Error("TestBucket failed, the bucket was not refilled")
+	}
+	if b.Allow(now.Add(100 * time.Millisecond)) {
+		t.Error("TestBucket failed, the bucket was refilled too fast")
+	}
+	//never more than the burst
+	later := now.Add(time.Hour)
+	allowed := 0
+	for b.Allow(later) {
+		allowed++
+	}
+	if allowed != 5 {
+		t.Error("TestBucket failed, expected the burst after a long pause, got", allowed)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := New(1, 2)
+	if !l.Allow("a") || !l.Allow("a") {
+		t.Fatal("TestLimiter failed, the burst was not allowed")
+	}
+	if l.Allow("a") {
+		t.Error("TestLimiter failed, more than the burst was allowed")
+	}
+	if !l.Allow("b") {
+		t.Error("TestLimiter failed, the keys should have separate buckets")
+	}
+	unlimited := New(0, 0)
+	for i := 0; i < 1000; i++ {
+		if !unlimited.Allow("a") {
+			t.Fatal("TestLimiter failed, a rate of 0 should allow everything")
+		}
+	}
+}
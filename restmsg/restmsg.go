@@ -1,22 +1,86 @@
 package restmsg
 
+import (
+	"time"
+)
+
 type StoreRequest struct {
 	File []byte
 }
 
+// Also used to respond to pin and unpin.
+// Replicas is the number of nodes that confirmed storing the data.
 type StoreResponse struct {
 	Status int
 	Message string
 	ID string
+	Replicas int
 }
 
+// The fields after File are only set by quorum reads
 type CatResponse struct {
 	Status int
 	Message string
 	File []byte
+	// the newest version the replicas have
+	Timestamp time.Time
+	Pin bool
+	// replicas that answered, versions they have between them and replicas with another version than the newest
+	Replicas int
+	Versions int
+	Stale int
 }
 
 type GenericResponse struct {
 	Status int
 	Message string
 }
+
+// Counters of the requests from other nodes that the server has dropped
+type StatsResponse struct {
+	Status int
+	Message string
+	// too many requests from the same IP address
+	DroppedSource uint64
+	// too many requests of the same RPC type, by type
+	DroppedType map[string]uint64
+	// too many STOREs being handled at the same time
+	DroppedStore uint64
+}
+
+// A node as the lookup trace shows it
+type Contact struct {
+	ID string
+	Address string
+}
+
+// A query of a traced lookup
+type TraceStep struct {
+	Contact Contact
+	// XOR distance of the contact to the target, in hex
+	Distance string
+	// 1 for the contacts the lookup started with, 2 for those they returned and so on
+	Round int
+	// path of a disjoint lookup the query was sent on
+	Path int
+	RTT time.Duration
+	// contacts the node returned
+	Contacts []Contact
+	// the node returned the value
+	Found bool
+	// why the query failed, empty if it didn't
+	Error string
+}
+
+// The queries of a lookup in the order they finished, and how it ended
+type LookupTraceResponse struct {
+	Status int
+	Message string
+	Target string
+	// value for a FIND_VALUE lookup, node for a FIND_NODE one
+	Type string
+	Found bool
+	// why the lookup failed, empty if it didn't
+	Error string
+	Steps []TraceStep
+}
@@ -2,18 +2,30 @@ package routingtable
 
 import (
 	"sync"
+	"net/netip"
 	"sort"
 	"github.com/mjolnir92/kdfs/contact"
 	"github.com/mjolnir92/kdfs/bucket"
 	"github.com/mjolnir92/kdfs/kademliaid"
 	"github.com/mjolnir92/kdfs/constants"
 	"github.com/mjolnir92/kdfs/eventmanager"
+	"github.com/mjolnir92/kdfs/rtt"
 )
 
 type T struct {
 	me      contact.T
 	eventmanager *eventmanager.T
 	buckets [kademliaid.IDLength * 8]*bucket.T
+	//Capabilities of the nodes we have exchanged pings with
+	capabilities map[kademliaid.T]uint64
+	//Size of capabilities at which those of nodes that are not kept any more are removed
+	capabilitiesSweep int
+	//The address each node was last heard from, out of the addresses it advertises
+	reachable map[kademliaid.T]netip.AddrPort
+	//Size of reachable at which the addresses of nodes that are not kept any more are removed
+	reachableSweep int
+	//Contacts that don't solve the puzzles are not added
+	puzzle kademliaid.Puzzle
 	mux sync.Mutex
 }
 
@@ -24,12 +36,22 @@ func New(me contact.T, em *eventmanager.T, bucketSize int) *T {
 	}
 	routingTable.me = me
 	routingTable.eventmanager = em
+	routingTable.capabilities = make(map[kademliaid.T]uint64)
+	routingTable.capabilitiesSweep = constants.K
+	routingTable.reachable = make(map[kademliaid.T]netip.AddrPort)
+	routingTable.reachableSweep = constants.K
 	return routingTable
 }
 
 //Add a contact to the correct bucket.
 //The timer of the bucket refresh event is reset here to prevent non-stale buckets from needlessly updating
 func (routingTable *T) AddContact(contact contact.T) {
+	if !routingTable.Admits(contact) {
+		return
+	}
+	if contact.RTT == nil {
+		contact.RTT = rtt.New()
+	}
 	routingTable.mux.Lock()
 	bucketIndex := routingTable.GetBucketIndex(contact.ID)
 	bucket := routingTable.buckets[bucketIndex]
@@ -38,16 +60,99 @@ func (routingTable *T) AddContact(contact contact.T) {
 	routingTable.mux.Unlock()
 }
 
+//Sets the crypto puzzles that the IDs of contacts have to solve
+func (routingTable *T) SetPuzzle(puzzle kademliaid.Puzzle) {
+	routingTable.mux.Lock()
+	routingTable.puzzle = puzzle
+	routingTable.mux.Unlock()
+}
+
+//Checks that a contact solves the puzzles. With a static puzzle the ID also has to be
+//derived from the public key of the contact, otherwise it could be found without generating keys.
+func (routingTable *T) Admits(contact contact.T) bool {
+	routingTable.mux.Lock()
+	puzzle := routingTable.puzzle
+	routingTable.mux.Unlock()
+	if puzzle.Static > 0 && (contact.PublicKey == nil || *kademliaid.NewFromPublicKey(contact.PublicKey) != *contact.ID) {
+		return false
+	}
+	return puzzle.Check(contact.ID, &contact.Nonce)
+}
+
 //Evicts contact from the routingtable and replace it with a contact from the cache, if any exists
 func (routingTable *T) EvictAndReplace(contact contact.T) {
 	routingTable.mux.Lock()
 	bucketIndex := routingTable.GetBucketIndex(contact.ID)
 	bucket := routingTable.buckets[bucketIndex]
 	bucket.EvictAndReplace(contact)
+	if _, ok := bucket.GetContact(contact.ID); !ok {
+		delete(routingTable.capabilities, *contact.ID)
+		delete(routingTable.reachable, *contact.ID)
+	}
 	routingTable.eventmanager.ResetEvent(*routingTable.me.ID, bucketIndex, constants.BUCKET_REFRESH)
 	routingTable.mux.Unlock()
 }
 
+//Remembers the capabilities a node announced in a ping. Those of nodes that are neither in a bucket nor in a
+//replacement cache are removed once in a while, the node is usually added right after its ping.
+func (routingTable *T) SetCapabilities(id *kademliaid.T, capabilities uint64) {
+	routingTable.mux.Lock()
+	routingTable.capabilities[*id] = capabilities
+	if len(routingTable.capabilities) >= routingTable.capabilitiesSweep {
+		for other := range routingTable.capabilities {
+			if other != *id && !routingTable.kept(&other) {
+				delete(routingTable.capabilities, other)
+			}
+		}
+		routingTable.capabilitiesSweep = 2*len(routingTable.capabilities) + constants.K
+	}
+	routingTable.mux.Unlock()
+}
+
+//Returns the capabilities of a node, the bool is false if they are not known
+func (routingTable *T) GetCapabilities(id *kademliaid.T) (uint64, bool) {
+	routingTable.mux.Lock()
+	defer routingTable.mux.Unlock()
+	capabilities, ok := routingTable.capabilities[*id]
+	return capabilities, ok
+}
+
+//Remembers that a node could be reached on addr. Like capabilities, the addresses of nodes that are not kept
+//are removed once in a while.
+func (routingTable *T) SetReachable(id *kademliaid.T, addr netip.AddrPort) {
+	routingTable.mux.Lock()
+	routingTable.reachable[*id] = addr
+	if len(routingTable.reachable) >= routingTable.reachableSweep {
+		for other := range routingTable.reachable {
+			if other != *id && !routingTable.kept(&other) {
+				delete(routingTable.reachable, other)
+			}
+		}
+		routingTable.reachableSweep = 2*len(routingTable.reachable) + constants.K
+	}
+	routingTable.mux.Unlock()
+}
+
+//Returns the address a node was last reached on, the bool is false if it is not known
+func (routingTable *T) GetReachable(id *kademliaid.T) (netip.AddrPort, bool) {
+	routingTable.mux.Lock()
+	defer routingTable.mux.Unlock()
+	addr, ok := routingTable.reachable[*id]
+	return addr, ok
+}
+
+//Tells whether the node with the given ID is in a bucket or a replacement cache, call with mux held
+func (routingTable *T) kept(id *kademliaid.T) bool {
+	return routingTable.buckets[routingTable.GetBucketIndex(id)].Knows(id)
+}
+
+//Returns the contact with the given ID if it is in the routing table
+func (routingTable *T) GetContact(id *kademliaid.T) (contact.T, bool) {
+	routingTable.mux.Lock()
+	defer routingTable.mux.Unlock()
+	return routingTable.buckets[routingTable.GetBucketIndex(id)].GetContact(id)
+}
+
 func (routingTable *T) FindClosestContacts(target *kademliaid.T, count int) []contact.T {
 	routingTable.mux.Lock()
 	var candidates []contact.T
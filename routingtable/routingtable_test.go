@@ -70,4 +70,120 @@ func TestReplacementCache(t *testing.T) {
 		t.Error("TestReplacementCache failed, contact was not in bucket")
 	}
 
-}
\ No newline at end of file
+}
+
+func TestGetContact(t *testing.T) {
+	c0 := contact.New(kademliaid.New("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"), "localhost:8000")
+	routingtable := New(c0, eventmanager.New(), constants.K)
+	c1 := contact.New(kademliaid.New("FFFFFFFF00000000000000000000000000000000"), "localhost:8001")
+
+	if _, ok := routingtable.GetContact(c1.ID); ok {
+		t.Error("TestGetContact failed, found a contact that was never added")
+	}
+	routingtable.AddContact(c1)
+	got, ok := routingtable.GetContact(c1.ID)
+	if !ok || got.RTT == nil {
+		t.Fatal("TestGetContact failed, the contact should be found with a round trip time estimate")
+	}
+	//Adding the contact again should keep the estimate
+	routingtable.AddContact(c1)
+	again, _ := routingtable.GetContact(c1.ID)
+	if again.RTT != got.RTT {
+		t.Error("TestGetContact failed, the round trip time estimate was replaced")
+	}
+}
+
+func TestPuzzle(t *testing.T) {
+	c0 := contact.New(kademliaid.New("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"), "localhost:8000")
+	routingtable := New(c0, eventmanager.New(), constants.K)
+	puzzle := kademliaid.Puzzle{Dynamic: 16}
+	routingtable.SetPuzzle(puzzle)
+	c1 := contact.New(kademliaid.NewRandom(), "localhost:8001")
+	//A nonce of zero solves the puzzle for about 1 in 65536 IDs
+	for puzzle.CheckDynamic(c1.ID, &c1.Nonce) {
+		c1 = contact.New(kademliaid.NewRandom(), "localhost:8001")
+	}
+	routingtable.AddContact(c1)
+	if _, ok := routingtable.GetContact(c1.ID); ok {
+		t.Error("TestPuzzle failed, a contact that doesn't solve the puzzle was added")
+	}
+	c1.Nonce = puzzle.Solve(c1.ID)
+	routingtable.AddContact(c1)
+	if _, ok := routingtable.GetContact(c1.ID); !ok {
+		t.Error("TestPuzzle failed, a contact that solves the puzzle was not added")
+	}
+	//With a static puzzle the ID has to be derived from a public key
+	routingtable.SetPuzzle(kademliaid.Puzzle{Static: 1})
+	if routingtable.Admits(contact.New(kademliaid.NewRandom(), "localhost:8002")) {
+		t.Error("TestPuzzle failed, a contact without a public key solves the static puzzle")
+	}
+}
+
+func TestPreferDirect(t *testing.T) {
+	id0 := kademliaid.New("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF")
+	routingtable := New(contact.New(id0, "localhost:8000"), eventmanager.New(), 2)
+
+	relayed := contact.New(kademliaid.NewRandomCommonPrefix(*id0, 8), "relay:8000")
+	relayed.Relayed = true
+	routingtable.AddContact(relayed)
+	direct1 := contact.New(kademliaid.NewRandomCommonPrefix(*id0, 8), "localhost:8001")
+	routingtable.AddContact(direct1)
+
+	//The bucket is full, the direct contact takes the place of the relayed one
+	direct2 := contact.New(kademliaid.NewRandomCommonPrefix(*id0, 8), "localhost:8002")
+	routingtable.AddContact(direct2)
+	if _, ok := routingtable.GetContact(relayed.ID); ok {
+		t.Error("TestPreferDirect failed, the relayed contact was not replaced")
+	}
+	if _, ok := routingtable.GetContact(direct2.ID); !ok {
+		t.Error("TestPreferDirect failed, the direct contact was not added")
+	}
+
+	//A relayed contact doesn't take the place of a direct one, and the direct one is preferred when a contact is evicted
+	direct3 := contact.New(kademliaid.NewRandomCommonPrefix(*id0, 8), "localhost:8003")
+	routingtable.AddContact(direct3)
+	routingtable.AddContact(relayed)
+	routingtable.EvictAndReplace(direct1)
+	if _, ok := routingtable.GetContact(direct3.ID); !ok {
+		t.Error("TestPreferDirect failed, the direct contact was not taken from the replacement cache")
+	}
+	if _, ok := routingtable.GetContact(relayed.ID); ok {
+		t.Error("TestPreferDirect failed, the relayed contact should still be in the replacement cache")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	c0 := contact.New(kademliaid.New("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"), "localhost:8000")
+	routingtable := New(c0, eventmanager.New(), constants.K)
+	c1 := contact.New(kademliaid.New("FFFFFFFF00000000000000000000000000000000"), "localhost:8001")
+	routingtable.SetCapabilities(c1.ID, 1)
+	routingtable.AddContact(c1)
+	// nodes that ping us but are never added
+	for i := 0; i < 100*constants.K; i++ {
+		routingtable.SetCapabilities(kademliaid.NewRandom(), 1)
+	}
+	if n := len(routingtable.capabilities); n > 4*constants.K {
+		t.Error("TestCapabilities failed, the capabilities of nodes that are not in the routing table were kept:", n)
+	}
+	if _, ok := routingtable.GetCapabilities(c1.ID); !ok {
+		t.Error("TestCapabilities failed, the capabilities of a node in the routing table were removed")
+	}
+}
+
+func TestReachable(t *testing.T) {
+	c0 := contact.New(kademliaid.New("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"), "localhost:8000")
+	routingtable := New(c0, eventmanager.New(), constants.K)
+	c1 := contact.New(kademliaid.New("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:8001")
+	routingtable.SetReachable(c1.ID, c1.Addrs[0])
+	routingtable.AddContact(c1)
+	// requests from nodes that are never added
+	for i := 0; i < 100*constants.K; i++ {
+		routingtable.SetReachable(kademliaid.NewRandom(), c1.Addrs[0])
+	}
+	if n := len(routingtable.reachable); n > 4*constants.K {
+		t.Error("TestReachable failed, the addresses of nodes that are not in the routing table were kept:", n)
+	}
+	if _, ok := routingtable.GetReachable(c1.ID); !ok {
+		t.Error("TestReachable failed, the address of a node in the routing table was removed")
+	}
+}
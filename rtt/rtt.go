@@ -0,0 +1,64 @@
+package rtt
+
+import (
+	"sync"
+	"time"
+	"github.com/mjolnir92/kdfs/constants"
+)
+
+//Estimates the round trip time to a node the way TCP does (RFC 6298).
+//A T is shared by all copies of a contact, so it is safe for concurrent use.
+type T struct {
+	srtt time.Duration
+	rttvar time.Duration
+	samples int
+	mux sync.Mutex
+}
+
+func New() *T {
+	return &T{}
+}
+
+//Adds a measured round trip time to the estimate
+func (t *T) Update(sample time.Duration) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.samples == 0 {
+		t.srtt = sample
+		t.rttvar = sample / 2
+	} else {
+		diff := t.srtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		// alpha = 1/8, beta = 1/4
+		t.rttvar = (3*t.rttvar + diff) / 4
+		t.srtt = (7*t.srtt + sample) / 8
+	}
+	t.samples++
+}
+
+//Returns how long to wait for a response before sending the RPC again.
+//Until there are any samples the default constants.TIMEOUT is used.
+func (t *T) Timeout() time.Duration {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.samples == 0 {
+		return constants.TIMEOUT
+	}
+	timeout := t.srtt + 4*t.rttvar
+	if timeout < constants.MIN_TIMEOUT {
+		return constants.MIN_TIMEOUT
+	}
+	if timeout > constants.MAX_TIMEOUT {
+		return constants.MAX_TIMEOUT
+	}
+	return timeout
+}
+
+//Returns the smoothed round trip time, its variance and the number of samples the estimate is based on
+func (t *T) Stats() (time.Duration, time.Duration, int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.srtt, t.rttvar, t.samples
+}
@@ -0,0 +1,41 @@
+package rtt
+
+import (
+	"testing"
+	"time"
+	"github.com/mjolnir92/kdfs/constants"
+)
+
+func TestRTT(t *testing.T) {
+	r := New()
+	if r.Timeout() != constants.TIMEOUT {
+		t.Error("TestRTT failed, the timeout should be the default before any samples")
+	}
+	for i := 0; i < 50; i++ {
+		r.Update(2 * time.Second)
+	}
+	srtt, rttvar, samples := r.Stats()
+	if samples != 50 {
+		t.Error("TestRTT failed, wrong number of samples")
+	}
+	if srtt != 2*time.Second {
+		t.Error("TestRTT failed, a constant round trip time should give the same estimate, got", srtt)
+	}
+	if rttvar > 10*time.Millisecond {
+		t.Error("TestRTT failed, the variance should go to zero, got", rttvar)
+	}
+	if r.Timeout() < srtt {
+		t.Error("TestRTT failed, the timeout should be at least the round trip time")
+	}
+
+	fast := New()
+	fast.Update(time.Microsecond)
+	if fast.Timeout() != constants.MIN_TIMEOUT {
+		t.Error("TestRTT failed, the timeout should not go below MIN_TIMEOUT")
+	}
+	slow := New()
+	slow.Update(time.Minute)
+	if slow.Timeout() != constants.MAX_TIMEOUT {
+		t.Error("TestRTT failed, the timeout should not go above MAX_TIMEOUT")
+	}
+}
@@ -0,0 +1,159 @@
+package simulator
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+	"github.com/mjolnir92/kdfs/clock"
+	"github.com/mjolnir92/kdfs/transport"
+)
+
+//Datagrams waiting to be read by a node, more are dropped like by a full socket buffer
+const QUEUE_SIZE = 1024
+
+//A simulated network on a virtual clock. Every pair of nodes gets a fixed latency between MinLatency and MaxLatency,
+//each datagram some jitter on top of it. The latencies and losses only depend on the seed, the addresses and
+//how many datagrams were sent between the two nodes before.
+type Network struct {
+	clock *clock.Virtual
+	seed int64
+	minLatency time.Duration
+	maxLatency time.Duration
+	jitter time.Duration
+	dropRate float64
+	endpoints map[string]*endpoint
+	// datagrams sent so far, by sender and receiver
+	counts map[[2]string]uint64
+	sent uint64
+	dropped uint64
+	mux sync.Mutex
+}
+
+type datagram struct {
+	b []byte
+	from string
+}
+
+type endpoint struct {
+	network *Network
+	address string
+	queue chan datagram
+	closed chan struct{}
+	closeOnce sync.Once
+}
+
+func NewNetwork(c *clock.Virtual, config Config) *Network {
+	return &Network{clock: c, seed: config.Seed, minLatency: config.MinLatency, maxLatency: config.MaxLatency, jitter: config.Jitter, dropRate: config.DropRate, endpoints: make(map[string]*endpoint), counts: make(map[[2]string]uint64)}
+}
+
+//Creates an endpoint for address
+func (n *Network) Listen(address string) (transport.T, error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if _, ok := n.endpoints[address]; ok {
+		return nil, errors.New("Address already in use: " + address)
+	}
+	e := &endpoint{network: n, address: address, queue: make(chan datagram, QUEUE_SIZE), closed: make(chan struct{})}
+	n.endpoints[address] = e
+	return e, nil
+}
+
+//Datagrams sent and dropped so far
+func (n *Network) Stats() (uint64, uint64) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.sent, n.dropped
+}
+
+// random returns a number in [0, 1) that only depends on the seed and the arguments
+func (n *Network) random(from, to string, i uint64, purpose byte) float64 {
+	h := fnv.New64a()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n.seed))
+	h.Write(b[:])
+	h.Write([]byte(from))
+	h.Write([]byte{0})
+	h.Write([]byte(to))
+	binary.BigEndian.PutUint64(b[:], i)
+	h.Write(b[:])
+	h.Write([]byte{purpose})
+	// the high bits of FNV hardly change with the last bytes, mix them like splitmix64 does, or datagrams
+	// sent one after another would all be lost together
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11) / (1 << 53)
+}
+
+func (n *Network) send(b []byte, from, to string) {
+	n.mux.Lock()
+	key := [2]string{from, to}
+	i := n.counts[key]
+	n.counts[key]++
+	n.sent++
+	e, ok := n.endpoints[to]
+	if !ok || n.random(from, to, i, 'd') < n.dropRate {
+		n.dropped++
+		n.mux.Unlock()
+		return
+	}
+	n.mux.Unlock()
+
+	// the latency of the pair doesn't depend on the direction
+	a, z := from, to
+	if z < a {
+		a, z = z, a
+	}
+	latency := n.minLatency + time.Duration(n.random(a, z, 0, 'l')*float64(n.maxLatency-n.minLatency))
+	latency += time.Duration(n.random(from, to, i, 'j') * float64(n.jitter))
+	// the receiver may reuse its buffer
+	d := datagram{b: append([]byte(nil), b...), from: from}
+	n.clock.AfterFunc(latency, func() {
+		select {
+		case e.queue <- d:
+		case <-e.closed:
+		default:
+			n.mux.Lock()
+			n.dropped++
+			n.mux.Unlock()
+		}
+	})
+}
+
+func (e *endpoint) ReadFrom(b []byte) (int, string, error) {
+	select {
+	case d := <-e.queue:
+		return copy(b, d.b), d.from, nil
+	case <-e.closed:
+		return 0, "", transport.ErrClosed
+	}
+}
+
+func (e *endpoint) WriteTo(b []byte, address string) error {
+	select {
+	case <-e.closed:
+		return transport.ErrClosed
+	default:
+	}
+	e.network.send(b, e.address, address)
+	return nil
+}
+
+func (e *endpoint) LocalAddr() string {
+	return e.address
+}
+
+func (e *endpoint) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		e.network.mux.Lock()
+		delete(e.network.endpoints, e.address)
+		e.network.mux.Unlock()
+	})
+	return nil
+}
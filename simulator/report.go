@@ -0,0 +1,88 @@
+package simulator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//How a simulation went
+type Report struct {
+	//Nodes that joined and left, and the ones running at the end
+	Joined int
+	Left int
+	Nodes int
+	//Nodes that joined as liars, see Config.Liars
+	Liars int
+	//KademliaStores, the failed ones were accepted by no node
+	Stores int
+	FailedStores int
+	//Values that were stored, and how many of them could still be found at the end
+	Values int
+	Durable int
+	//Lookups of stored values and how many didn't find the value
+	Lookups int
+	FailedLookups int
+	//Hops of the successful lookups, see kademlia.LookupStats
+	Hops map[int]int
+	//Nodes queried by all lookups together
+	Queried int
+	//Datagrams sent over the simulated network and how many were lost
+	Datagrams uint64
+	Dropped uint64
+}
+
+//Fraction of the lookups that found the value
+func (r Report) SuccessRate() float64 {
+	if r.Lookups == 0 {
+		return 0
+	}
+	return float64(r.Lookups-r.FailedLookups) / float64(r.Lookups)
+}
+
+//Average hops of the successful lookups
+func (r Report) MeanHops() float64 {
+	n, sum := 0, 0
+	for h, count := range r.Hops {
+		n += count
+		sum += h * count
+	}
+	if n == 0 {
+		return 0
+	}
+	return float64(sum) / float64(n)
+}
+
+//Fraction of the stored values that could still be found at the end
+func (r Report) Durability() float64 {
+	if r.Values == 0 {
+		return 0
+	}
+	return float64(r.Durable) / float64(r.Values)
+}
+
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "nodes: %v joined, %v left, %v at the end\n", r.Joined, r.Left, r.Nodes)
+	if r.Liars > 0 {
+		fmt.Fprintf(&b, "liars: %v joined\n", r.Liars)
+	}
+	fmt.Fprintf(&b, "stores: %v, %v failed\n", r.Stores, r.FailedStores)
+	fmt.Fprintf(&b, "lookups: %v, %v failed, success rate %.4f\n", r.Lookups, r.FailedLookups, r.SuccessRate())
+	queried := 0.0
+	if r.Lookups > 0 {
+		queried = float64(r.Queried) / float64(r.Lookups)
+	}
+	fmt.Fprintf(&b, "hops: mean %.2f, %.1f nodes queried per lookup\n", r.MeanHops(), queried)
+	hops := make([]int, 0, len(r.Hops))
+	for h := range r.Hops {
+		hops = append(hops, h)
+	}
+	sort.Ints(hops)
+	for _, h := range hops {
+		fmt.Fprintf(&b, "  %v hops: %v\n", h, r.Hops[h])
+	}
+	fmt.Fprintf(&b, "durability: %v of %v values found at the end, %.4f\n", r.Durable, r.Values, r.Durability())
+	fmt.Fprintf(&b, "datagrams: %v sent, %v lost\n", r.Datagrams, r.Dropped)
+	return b.String()
+}
@@ -0,0 +1,426 @@
+package simulator
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"github.com/mjolnir92/kdfs/clock"
+	"github.com/mjolnir92/kdfs/contact"
+	"github.com/mjolnir92/kdfs/kademlia"
+	"github.com/mjolnir92/kdfs/kademliaid"
+)
+
+//What to simulate. All durations and rates are in simulated time.
+type Config struct {
+	//Nodes in the network, they join one after another every JoinInterval before the workload starts
+	Nodes int
+	JoinInterval time.Duration
+	//Seed of all random decisions: node IDs, latencies, losses, churn and workload
+	Seed int64
+	//Time the workload and churn run for
+	Duration time.Duration
+	//One way latency between two nodes, fixed per pair, and the jitter added to each datagram
+	MinLatency time.Duration
+	MaxLatency time.Duration
+	Jitter time.Duration
+	//Probability that a datagram is lost
+	DropRate float64
+	//Fraction of the nodes that leave per hour, each is replaced by a new node
+	Churn float64
+	//Values stored and lookups of stored values started per hour, each by a random node
+	Stores float64
+	Lookups float64
+	//Bytes of a stored value
+	ValueSize int
+	//Fraction of the nodes that answer lookups with made up contacts and never with a value, see kademlia.Faults.Lie.
+	//The workload only runs on the honest nodes.
+	Liars float64
+	//Disjoint paths of the lookups, see kademlia.Options.Paths. 0 leaves the default.
+	Paths int
+	//Timers due within Resolution of each other fire at the same time, one after another. Coarser is less exact
+	Resolution time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{Nodes: 100, JoinInterval: 100 * time.Millisecond, Seed: 1, Duration: time.Hour, MinLatency: 10 * time.Millisecond, MaxLatency: 150 * time.Millisecond, Jitter: 10 * time.Millisecond, Stores: 60, Lookups: 600, ValueSize: 64, Resolution: time.Millisecond}
+}
+
+//Runs kademlia nodes on a simulated network and a virtual clock. Nothing happens in real time, an hour with
+//thousands of nodes takes as long as the nodes need to handle their RPCs.
+//Actions are run in the order of their times from the goroutine that calls Run, so that everything the
+//simulator decides only depends on the seed. The nodes run their lookups and RPCs in their own goroutines,
+//which the clock waits for before it moves on.
+type Simulator struct {
+	config Config
+	clock *clock.Virtual
+	network *Network
+	// only used by actions, which run one at a time
+	rand *rand.Rand
+	// the seeds of the nodes, apart from rand so that the nodes don't change what the simulation decides
+	seeds *rand.Rand
+	actions actionHeap
+	seq uint64
+	nodes []*kademlia.T
+	addresses map[*kademlia.T]string
+	liars map[*kademlia.T]bool
+	// addresses are never reused, a datagram for a node that left is lost
+	nextAddress int
+	// keys of the values stored so far, in order
+	stored []kademliaid.T
+	report Report
+	// lookups and stores that are still running
+	running sync.WaitGroup
+	mux sync.Mutex
+}
+
+type action struct {
+	at time.Time
+	seq uint64
+	f func()
+}
+
+//The simulation starts at this virtual time
+var Epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func New(config Config) *Simulator {
+	c := clock.NewVirtual(Epoch)
+	s := &Simulator{config: config, clock: c, network: NewNetwork(c, config), rand: rand.New(rand.NewSource(config.Seed))}
+	s.seeds = rand.New(rand.NewSource(config.Seed + 1))
+	s.addresses = make(map[*kademlia.T]string)
+	s.liars = make(map[*kademlia.T]bool)
+	s.report.Hops = make(map[int]int)
+	return s
+}
+
+//Now returns the simulated time
+func (s *Simulator) Now() time.Time {
+	return s.clock.Now()
+}
+
+//Schedules f at d after the start of the simulation. f runs alone and may use Rand, it must not block on the
+//nodes, start goroutines for that.
+func (s *Simulator) At(d time.Duration, f func()) {
+	heap.Push(&s.actions, &action{at: Epoch.Add(d), seq: s.seq, f: f})
+	s.seq++
+}
+
+//The random source of the simulation, for actions
+func (s *Simulator) Rand() *rand.Rand {
+	return s.rand
+}
+
+//The nodes that are running
+func (s *Simulator) Nodes() []*kademlia.T {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]*kademlia.T(nil), s.nodes...)
+}
+
+//AddNode starts a node and joins it through a random running node, if there is one
+func (s *Simulator) AddNode() *kademlia.T {
+	address := "node" + strconv.Itoa(s.nextAddress)
+	s.nextAddress++
+	tr, err := s.network.Listen(address)
+	if err != nil {
+		log.Fatalf("Can't add node: %v\n", err)
+	}
+	var id kademliaid.T
+	s.rand.Read(id[:])
+	ct := contact.New(&id, address)
+	options := kademlia.DefaultOptions()
+	options.Transport = tr
+	options.Clock = s.clock
+	// the RPC IDs, probes and bucket refreshes of the node are drawn from the seed of the simulation too
+	options.Seed = s.seeds.Int63()
+	// the rate limits run on real time, which hardly passes in a simulation
+	options.Limits = kademlia.Limits{}
+	if s.config.Paths > 0 {
+		options.Paths = s.config.Paths
+	}
+	liar := s.config.Liars > 0 && s.rand.Float64() < s.config.Liars
+	options.Faults.Lie = liar
+	nw := kademlia.NewWithOptions(&ct, options)
+	go nw.Serve()
+
+	s.mux.Lock()
+	var bootstrap string
+	if len(s.nodes) > 0 {
+		bootstrap = s.addresses[s.nodes[s.rand.Intn(len(s.nodes))]]
+	}
+	s.nodes = append(s.nodes, nw)
+	s.addresses[nw] = address
+	s.report.Joined++
+	if liar {
+		s.liars[nw] = true
+		s.report.Liars++
+	}
+	s.mux.Unlock()
+	if bootstrap != "" {
+		go nw.Join(bootstrap)
+	}
+	return nw
+}
+
+//RemoveNode stops a node without a goodbye, like a crash
+func (s *Simulator) RemoveNode(nw *kademlia.T) {
+	s.mux.Lock()
+	for i, n := range s.nodes {
+		if n == nw {
+			s.nodes = append(s.nodes[:i], s.nodes[i+1:]...)
+			delete(s.addresses, nw)
+			delete(s.liars, nw)
+			s.report.Left++
+			break
+		}
+	}
+	s.mux.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	go nw.Close(ctx)
+}
+
+// randomNode returns a random running node, nil if there is none
+func (s *Simulator) randomNode() *kademlia.T {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.nodes) == 0 {
+		return nil
+	}
+	return s.nodes[s.rand.Intn(len(s.nodes))]
+}
+
+// randomHonest returns a random running node that doesn't lie, nil if there is none
+func (s *Simulator) randomHonest() *kademlia.T {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	honest := make([]*kademlia.T, 0, len(s.nodes))
+	for _, nw := range s.nodes {
+		if !s.liars[nw] {
+			honest = append(honest, nw)
+		}
+	}
+	if len(honest) == 0 {
+		return nil
+	}
+	return honest[s.rand.Intn(len(honest))]
+}
+
+//Store stores a value of ValueSize random bytes from nw and records it for lookups and the durability check
+func (s *Simulator) Store(nw *kademlia.T) {
+	data := make([]byte, s.config.ValueSize)
+	s.rand.Read(data)
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		id, replicas, _ := nw.KademliaStore(context.Background(), data)
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		s.report.Stores++
+		if replicas == 0 {
+			s.report.FailedStores++
+			return
+		}
+		// sorted, stores that finish at the same time may do so in any order
+		i := sort.Search(len(s.stored), func(i int) bool {
+			return !s.stored[i].Less(&id)
+		})
+		s.stored = append(s.stored, kademliaid.T{})
+		copy(s.stored[i+1:], s.stored[i:])
+		s.stored[i] = id
+	}()
+}
+
+//Lookup looks a value up from nw and records how it went
+func (s *Simulator) Lookup(nw *kademlia.T, id kademliaid.T) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		_, stats, err := nw.LookupDataStats(context.Background(), &id)
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		s.report.Lookups++
+		s.report.Queried += stats.Queried
+		if err != nil {
+			s.report.FailedLookups++
+			return
+		}
+		s.report.Hops[stats.Hops]++
+	}()
+}
+
+// randomStored returns the key of a random stored value
+func (s *Simulator) randomStored() (kademliaid.T, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.stored) == 0 {
+		return kademliaid.T{}, false
+	}
+	return s.stored[s.rand.Intn(len(s.stored))], true
+}
+
+// poisson schedules f at random times between start and end, rate times per hour on average
+func (s *Simulator) poisson(start, end time.Duration, rate float64, f func()) {
+	if rate <= 0 {
+		return
+	}
+	mean := float64(time.Hour) / rate
+	for t := start + time.Duration(s.rand.ExpFloat64()*mean); t < end; t += time.Duration(s.rand.ExpFloat64() * mean) {
+		s.At(t, f)
+	}
+}
+
+//Run schedules the joins, churn and workload of the config, runs the simulation and reports how it went.
+//After the workload every stored value is looked up once more to see whether it survived.
+func (s *Simulator) Run() Report {
+	warmup := time.Duration(s.config.Nodes) * s.config.JoinInterval
+	for i := 0; i < s.config.Nodes; i++ {
+		s.At(time.Duration(i)*s.config.JoinInterval, func() {
+			s.AddNode()
+		})
+	}
+	end := warmup + s.config.Duration
+	s.poisson(warmup, end, s.config.Churn*float64(s.config.Nodes), func() {
+		if nw := s.randomNode(); nw != nil {
+			s.RemoveNode(nw)
+			s.AddNode()
+		}
+	})
+	s.poisson(warmup, end, s.config.Stores, func() {
+		if nw := s.randomHonest(); nw != nil {
+			s.Store(nw)
+		}
+	})
+	s.poisson(warmup, end, s.config.Lookups, func() {
+		id, ok := s.randomStored()
+		nw := s.randomHonest()
+		if ok && nw != nil {
+			s.Lookup(nw, id)
+		}
+	})
+	s.RunUntil(end)
+	s.wait()
+
+	report := s.Report()
+	s.mux.Lock()
+	stored := append([]kademliaid.T(nil), s.stored...)
+	s.mux.Unlock()
+	for _, id := range stored {
+		nw := s.randomHonest()
+		if nw == nil {
+			break
+		}
+		id := id
+		s.running.Add(1)
+		go func() {
+			defer s.running.Done()
+			_, err := nw.LookupData(context.Background(), &id)
+			s.mux.Lock()
+			defer s.mux.Unlock()
+			if err == nil {
+				s.report.Durable++
+			}
+		}()
+		s.clock.Settle()
+	}
+	s.wait()
+	durable := s.Report().Durable
+	report.Durable = durable
+	report.Datagrams, report.Dropped = s.network.Stats()
+	s.stop()
+	return report
+}
+
+// stop closes the nodes that still run and runs the clock until no timer is left, so that none of their
+// goroutines outlive the simulation
+func (s *Simulator) stop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, nw := range s.Nodes() {
+		go nw.Close(ctx)
+	}
+	s.clock.Settle()
+	for s.clock.Fire(s.config.Resolution) {
+		s.clock.Settle()
+	}
+}
+
+//RunUntil runs the actions and timers up to d after the start of the simulation
+func (s *Simulator) RunUntil(d time.Duration) {
+	end := Epoch.Add(d)
+	for len(s.actions) > 0 && !s.actions[0].at.After(end) {
+		a := heap.Pop(&s.actions).(*action)
+		s.clock.RunUntil(a.at, s.config.Resolution)
+		a.f()
+		s.clock.Settle()
+	}
+	s.clock.RunUntil(end, s.config.Resolution)
+}
+
+// wait runs the clock until the lookups and stores that were started are done
+func (s *Simulator) wait() {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if !s.clock.Fire(s.config.Resolution) {
+			// nothing left that could finish them
+			<-done
+			return
+		}
+		s.clock.Settle()
+	}
+}
+
+//Report returns how the simulation went so far
+func (s *Simulator) Report() Report {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	r := s.report
+	r.Hops = make(map[int]int)
+	for h, n := range s.report.Hops {
+		r.Hops[h] = n
+	}
+	r.Values = len(s.stored)
+	r.Nodes = len(s.nodes)
+	return r
+}
+
+type actionHeap []*action
+
+func (h actionHeap) Len() int {
+	return len(h)
+}
+
+func (h actionHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h actionHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *actionHeap) Push(x interface{}) {
+	*h = append(*h, x.(*action))
+}
+
+func (h *actionHeap) Pop() interface{} {
+	old := *h
+	a := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return a
+}
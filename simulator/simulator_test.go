@@ -0,0 +1,94 @@
+package simulator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSimulator(t *testing.T) {
+	config := DefaultConfig()
+	config.Nodes = 30
+	config.Duration = 10 * time.Minute
+	config.Stores = 60
+	config.Lookups = 300
+	report := New(config).Run()
+	t.Log("\n" + report.String())
+	if report.Nodes != 30 || report.Joined != 30 {
+		t.Error("Unexpected nodes:", report.Nodes, report.Joined)
+	}
+	if report.Stores == 0 || report.Lookups == 0 {
+		t.Fatal("The workload didn't run")
+	}
+	if report.FailedStores != 0 {
+		t.Error("Stores failed without churn or loss:", report.FailedStores)
+	}
+	if report.SuccessRate() < 0.99 {
+		t.Error("Lookups failed without churn or loss, success rate", report.SuccessRate())
+	}
+	if report.Durability() != 1 {
+		t.Error("Values were lost without churn:", report.Durable, "of", report.Values)
+	}
+	if h := report.MeanHops(); h < 1 || h > 4 {
+		t.Error("Unexpected mean hops:", h)
+	}
+}
+
+func TestChurn(t *testing.T) {
+	config := DefaultConfig()
+	config.Nodes = 30
+	config.Duration = 30 * time.Minute
+	config.Churn = 0.4
+	config.DropRate = 0.02
+	config.Stores = 30
+	config.Lookups = 120
+	report := New(config).Run()
+	t.Log("\n" + report.String())
+	if report.Left == 0 || report.Joined != 30+report.Left {
+		t.Error("Nodes didn't churn:", report.Joined, report.Left)
+	}
+	if report.Dropped == 0 {
+		t.Error("No datagrams were lost")
+	}
+	if report.Lookups == 0 || report.SuccessRate() < 0.9 {
+		t.Error("Too many lookups failed:", report.FailedLookups, "of", report.Lookups)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	config := DefaultConfig()
+	config.Nodes = 20
+	config.Duration = 10 * time.Minute
+	config.Churn = 0.5
+	config.DropRate = 0.05
+	first := New(config).Run()
+	second := New(config).Run()
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Two runs with the same seed went differently:\n%v\n%v", first, second)
+	}
+}
+
+func TestLiars(t *testing.T) {
+	config := DefaultConfig()
+	config.Nodes = 50
+	config.Duration = 10 * time.Minute
+	config.Liars = 0.05
+	config.Stores = 120
+	config.Lookups = 600
+	rates := make(map[int]float64)
+	for _, paths := range []int{1, 4} {
+		config.Paths = paths
+		report := New(config).Run()
+		t.Logf("%v paths:\n%v", paths, report.String())
+		if report.Liars == 0 {
+			t.Fatal("No node lied")
+		}
+		rates[paths] = report.SuccessRate()
+	}
+	if rates[4] <= rates[1] {
+		t.Error("Disjoint paths didn't help against the liars:", rates)
+	}
+	if rates[4] < 0.85 {
+		t.Error("Too many lookups failed over 4 paths, success rate", rates[4])
+	}
+}
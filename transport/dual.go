@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"net"
+	"log"
+	"sync"
+	"github.com/mjolnir92/kdfs/constants"
+)
+
+//An implementation of T with one UDP socket for IPv4 and one for IPv6.
+//Datagrams are sent from the socket of the destination's family, so the node can listen on both
+//even where an IPv6 socket doesn't accept IPv4.
+type DualUDP struct {
+	udp4 *UDP
+	udp6 *UDP
+	inbox chan datagram
+	closed chan struct{}
+	once sync.Once
+}
+
+//ListenDualUDP listens on address4, which has to be an IPv4 address, and address6, which has to be an IPv6 address
+func ListenDualUDP(address4 string, address6 string) (*DualUDP, error) {
+	udp4, err := listenUDP("udp4", address4)
+	if err != nil {
+		return nil, err
+	}
+	udp6, err := listenUDP("udp6", address6)
+	if err != nil {
+		udp4.Close()
+		return nil, err
+	}
+	d := &DualUDP{udp4: udp4, udp6: udp6, inbox: make(chan datagram, MEMORY_QUEUE_SIZE), closed: make(chan struct{})}
+	go d.read(udp4)
+	go d.read(udp6)
+	return d, nil
+}
+
+// read passes the datagrams arriving on u to ReadFrom until u is closed
+func (d *DualUDP) read(u *UDP) {
+	buf := make([]byte, constants.MAX_DATAGRAM_SIZE)
+	for {
+		n, raddr, err := u.ReadFrom(buf)
+		if err == ErrClosed {
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading from %v: %v\n", u.LocalAddr(), err)
+			continue
+		}
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		select {
+		case d.inbox <- datagram{b: b, from: raddr}:
+		case <-d.closed:
+			return
+		}
+	}
+}
+
+func (d *DualUDP) ReadFrom(b []byte) (int, string, error) {
+	select {
+	case dg := <-d.inbox:
+		return copy(b, dg.b), dg.from, nil
+	case <-d.closed:
+		return 0, "", ErrClosed
+	}
+}
+
+func (d *DualUDP) WriteTo(b []byte, address string) error {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	if raddr.IP.To4() != nil {
+		return d.udp4.writeToUDP(b, raddr)
+	}
+	return d.udp6.writeToUDP(b, raddr)
+}
+
+//Returns both local addresses, separated by a comma
+func (d *DualUDP) LocalAddr() string {
+	return d.udp4.LocalAddr() + "," + d.udp6.LocalAddr()
+}
+
+func (d *DualUDP) Close() error {
+	var err error
+	d.once.Do(func() {
+		close(d.closed)
+		err = d.udp4.Close()
+		if err6 := d.udp6.Close(); err == nil {
+			err = err6
+		}
+	})
+	return err
+}
@@ -0,0 +1,58 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDualUDP(t *testing.T) {
+	d, err := ListenDualUDP("127.0.0.1:12600", "[::1]:12600")
+	if err != nil {
+		t.Skip("No IPv6 loopback:", err)
+	}
+	defer d.Close()
+	a4, err := ListenUDP("127.0.0.1:12601")
+	if err != nil {
+		t.Fatal("ListenUDP failed:", err)
+	}
+	defer a4.Close()
+	a6, err := ListenUDP("[::1]:12601")
+	if err != nil {
+		t.Fatal("ListenUDP failed:", err)
+	}
+	defer a6.Close()
+
+	buf := make([]byte, 16)
+	for _, a := range []*UDP{a4, a6} {
+		// the datagram arrives on the socket of its family and the answer leaves from it
+		host := "127.0.0.1:12600"
+		if a == a6 {
+			host = "[::1]:12600"
+		}
+		if err := a.WriteTo([]byte("ping"), host); err != nil {
+			t.Fatal("WriteTo failed:", err)
+		}
+		n, from, err := d.ReadFrom(buf)
+		if err != nil || !bytes.Equal(buf[:n], []byte("ping")) {
+			t.Fatal("ReadFrom failed:", err)
+		}
+		if from != a.LocalAddr() {
+			t.Errorf("Expected a datagram from %v, got %v", a.LocalAddr(), from)
+		}
+		if err := d.WriteTo([]byte("pong"), from); err != nil {
+			t.Fatal("WriteTo failed:", err)
+		}
+		n, from, err = a.ReadFrom(buf)
+		if err != nil || !bytes.Equal(buf[:n], []byte("pong")) {
+			t.Fatal("ReadFrom failed:", err)
+		}
+		if from != host {
+			t.Errorf("Expected the answer from %v, got %v", host, from)
+		}
+	}
+
+	d.Close()
+	if _, _, err := d.ReadFrom(buf); err != ErrClosed {
+		t.Error("ReadFrom on a closed transport should return ErrClosed, got", err)
+	}
+}
@@ -0,0 +1,99 @@
+package transport
+
+import (
+	"sync"
+	"errors"
+)
+
+//Datagrams that can be queued for a Memory transport before new ones are dropped
+const MEMORY_QUEUE_SIZE = 4096
+
+type datagram struct {
+	b []byte
+	from string
+}
+
+//A Network connects Memory transports within one process.
+//Addresses are arbitrary strings, they only have to be unique within the network.
+type Network struct {
+	nodes map[string]*Memory
+	mux sync.Mutex
+}
+
+func NewNetwork() *Network {
+	return &Network{nodes: make(map[string]*Memory)}
+}
+
+//An implementation of T that delivers datagrams over channels
+type Memory struct {
+	network *Network
+	address string
+	inbox chan datagram
+	closed chan struct{}
+	once sync.Once
+}
+
+//Listen creates a transport that receives the datagrams sent to address
+func (n *Network) Listen(address string) (*Memory, error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if _, ok := n.nodes[address]; ok {
+		return nil, errors.New("Address already in use: " + address)
+	}
+	m := &Memory{network: n, address: address, inbox: make(chan datagram, MEMORY_QUEUE_SIZE), closed: make(chan struct{})}
+	n.nodes[address] = m
+	return m, nil
+}
+
+//deliver queues a copy of b at address. Returns false if nobody is listening or the queue is full.
+func (n *Network) deliver(b []byte, from string, address string) bool {
+	n.mux.Lock()
+	m, ok := n.nodes[address]
+	n.mux.Unlock()
+	if !ok {
+		return false
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	select {
+	case m.inbox <- datagram{b: c, from: from}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *Memory) ReadFrom(b []byte) (int, string, error) {
+	select {
+	case d := <-m.inbox:
+		n := copy(b, d.b)
+		return n, d.from, nil
+	case <-m.closed:
+		return 0, "", ErrClosed
+	}
+}
+
+func (m *Memory) WriteTo(b []byte, address string) error {
+	select {
+	case <-m.closed:
+		return ErrClosed
+	default:
+	}
+	// like UDP, datagrams to nowhere are silently lost
+	m.network.deliver(b, m.address, address)
+	return nil
+}
+
+func (m *Memory) LocalAddr() string {
+	return m.address
+}
+
+func (m *Memory) Close() error {
+	m.once.Do(func() {
+		m.network.mux.Lock()
+		delete(m.network.nodes, m.address)
+		m.network.mux.Unlock()
+		close(m.closed)
+	})
+	return nil
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	network := NewNetwork()
+	a, err := network.Listen("a")
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+	b, err := network.Listen("b")
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+	if _, err := network.Listen("a"); err == nil {
+		t.Error("Listening twice on the same address should fail")
+	}
+
+	msg := []byte("hello")
+	a.WriteTo(msg, "b")
+	// the sender's buffer may be reused as soon as WriteTo returns
+	msg[0] = 'j'
+	buf := make([]byte, 16)
+	n, from, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("ReadFrom failed:", err)
+	}
+	if from != "a" || !bytes.Equal(buf[:n], []byte("hello")) {
+		t.Errorf("Got %q from %v, expected \"hello\" from a", buf[:n], from)
+	}
+
+	if err := a.WriteTo(msg, "nobody"); err != nil {
+		t.Error("Writing to an unknown address should not fail:", err)
+	}
+
+	b.Close()
+	if _, _, err := b.ReadFrom(buf); err != ErrClosed {
+		t.Error("ReadFrom on a closed transport should return ErrClosed, got", err)
+	}
+	if _, err := network.Listen("b"); err != nil {
+		t.Error("The address should be free again after Close:", err)
+	}
+}
@@ -0,0 +1,18 @@
+package transport
+
+import (
+	"errors"
+)
+
+var ErrClosed = errors.New("Transport is closed")
+
+//A T sends and receives datagrams for a kademlia node.
+//Addresses are strings in whatever form the implementation understands, host:port for UDP.
+//Like UDP, delivery is not guaranteed. WriteTo doesn't return an error just because nobody is listening.
+type T interface {
+	//Blocks until a datagram arrives. Returns ErrClosed once the transport has been closed.
+	ReadFrom(b []byte) (int, string, error)
+	WriteTo(b []byte, address string) error
+	LocalAddr() string
+	Close() error
+}
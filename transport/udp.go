@@ -0,0 +1,69 @@
+package transport
+
+import (
+	"net"
+	"log"
+	"errors"
+	"github.com/mjolnir92/kdfs/constants"
+)
+
+//An implementation of T using a UDP socket
+type UDP struct {
+	conn *net.UDPConn
+}
+
+func ListenUDP(address string) (*UDP, error) {
+	return listenUDP("udp", address)
+}
+
+// network is udp, udp4 or udp6
+func listenUDP(network string, address string) (*UDP, error) {
+	laddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	// large values arrive as a burst of fragments, give the kernel room to queue them
+	err = conn.SetReadBuffer(constants.READ_BUFFER_SIZE)
+	if err != nil {
+		log.Printf("Could not set read buffer size: %v\n", err)
+	}
+	return &UDP{conn: conn}, nil
+}
+
+func (u *UDP) ReadFrom(b []byte) (int, string, error) {
+	n, raddr, err := u.conn.ReadFromUDP(b)
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return 0, "", ErrClosed
+		}
+		return 0, "", err
+	}
+	return n, raddr.String(), nil
+}
+
+func (u *UDP) WriteTo(b []byte, address string) error {
+	// TODO: contact should probably store the resolved address already
+	// right now it's a string (who wrote this sample code?!)
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	return u.writeToUDP(b, raddr)
+}
+
+func (u *UDP) writeToUDP(b []byte, raddr *net.UDPAddr) error {
+	_, err := u.conn.WriteToUDP(b, raddr)
+	return err
+}
+
+func (u *UDP) LocalAddr() string {
+	return u.conn.LocalAddr().String()
+}
+
+func (u *UDP) Close() error {
+	return u.conn.Close()
+}